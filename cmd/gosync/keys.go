@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+
+	"gosync/internal/crypto"
+	"gosync/internal/sync"
+	"gosync/pkg/config"
+)
+
+// passphraseEnv names the environment variable read instead of prompting
+// for a passphrase
+const passphraseEnv = "GOSYNC_PASSPHRASE"
+
+func handleKeygen(keyFile string, cfg *config.Config, passphrase, x25519 bool) {
+	if keyFile == "" {
+		keyFile = cfg.Encryption.KeyFile
+	}
+	if keyFile == "" {
+		log.Fatal("Error: no key file given and encryption.key_file is not set")
+	}
+	if passphrase && x25519 {
+		log.Fatal("Error: -passphrase and -x25519 are mutually exclusive")
+	}
+
+	if x25519 {
+		id, err := crypto.WriteIdentityFile(keyFile)
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		// The public key is no secret and goes to the backup hosts
+		recipient := id.Recipient().String()
+		if err := os.WriteFile(keyFile+".pub", []byte(recipient+"\n"), 0644); err != nil {
+			log.Fatalf("Error writing public key: %v", err)
+		}
+		fmt.Printf("Wrote private key to %s and public key to %s.pub\n", keyFile, keyFile)
+		fmt.Printf("Public key: %s\n", recipient)
+		return
+	}
+
+	if passphrase {
+		secret, err := newPassphrase()
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		if err := crypto.WritePassphraseKeyFile(keyFile, secret); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		fmt.Printf("Wrote passphrase key file %s\n", keyFile)
+		return
+	}
+
+	if err := crypto.WriteKeyFile(keyFile); err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	fmt.Printf("Wrote %d-bit key to %s\n", crypto.KeySize*8, keyFile)
+}
+
+// readPassphrase returns the passphrase from the environment, or asks for
+// it on the terminal
+func readPassphrase() ([]byte, error) {
+	if secret, ok := os.LookupEnv(passphraseEnv); ok {
+		return []byte(secret), nil
+	}
+	return promptPassphrase("Passphrase: ")
+}
+
+// newPassphrase returns the passphrase for a new key file from the
+// environment, or asks for it twice on the terminal
+func newPassphrase() ([]byte, error) {
+	if secret, ok := os.LookupEnv(passphraseEnv); ok {
+		return []byte(secret), nil
+	}
+	secret, err := promptPassphrase("New passphrase: ")
+	if err != nil {
+		return nil, err
+	}
+	confirm, err := promptPassphrase("Repeat passphrase: ")
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(secret, confirm) {
+		return nil, fmt.Errorf("passphrases do not match")
+	}
+	return secret, nil
+}
+
+// promptPassphrase reads a passphrase from the terminal without echoing it
+func promptPassphrase(prompt string) ([]byte, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return nil, fmt.Errorf("no terminal to ask for the passphrase, set %s", passphraseEnv)
+	}
+	fmt.Fprint(os.Stderr, prompt)
+	secret, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(strings.TrimRight(string(secret), "\r\n")), nil
+}
+
+func handleKeyRotate(dir string, cfg *config.Config, resume bool, jobs int, names, remote bool) {
+	keyFile := cfg.Encryption.KeyFile
+	if keyFile == "" {
+		log.Fatal("Error: encryption.key_file is not set")
+	}
+	keyring, err := crypto.LoadKeyring(keyFile, readPassphrase)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+
+	// A key file holding a single key becomes a keyring that keeps it for
+	// the files not rotated yet
+	if !resume {
+		id, err := keyring.Rotate()
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		if err := keyring.Save(keyFile); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		fmt.Printf("Added key %s to %s and made it active\n", id, keyFile)
+	}
+
+	cryptoManager, err := crypto.NewKeyringManager(keyring)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	if jobs == 0 {
+		jobs = cfg.Sync.Workers
+	}
+	target, dir, closeTarget := openTarget(dir, cfg, remote)
+	defer closeTarget()
+	target = encryptedTarget(target, cryptoManager, names || cfg.Encryption.EncryptNames)
+
+	fmt.Printf("Rotating %s to key %s\n", dir, cryptoManager.ActiveKey())
+	syncManager := sync.NewManager(sync.Options{Workers: jobs})
+	stats, err := syncManager.Rotate(target, cryptoManager)
+	if err != nil {
+		log.Fatalf("Error: %v\nRun gosync key rotate -resume %s to finish the rotation", err, dir)
+	}
+
+	fmt.Printf("Rotated %d files, %d already used the active key\n", stats.Rotated, stats.Current)
+	if len(stats.Failed) > 0 {
+		fmt.Printf("%d files could not be decrypted and were left as they are:\n", len(stats.Failed))
+		for _, failure := range stats.Failed {
+			fmt.Printf("  %s\n", failure)
+		}
+		os.Exit(1)
+	}
+	fmt.Println("Rotation completed successfully")
+}
+
+func handleKeyList(cfg *config.Config) {
+	keyFile := cfg.Encryption.KeyFile
+	if keyFile == "" {
+		log.Fatal("Error: encryption.key_file is not set")
+	}
+	keyring, err := crypto.LoadKeyring(keyFile, readPassphrase)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	for _, key := range keyring.Keys {
+		active := ""
+		if key.ID == keyring.Active {
+			active = " (active)"
+		}
+		fmt.Printf("%s  created %s%s\n", key.ID, key.Created.Format("2006-01-02 15:04:05"), active)
+	}
+}
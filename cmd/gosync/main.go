@@ -7,11 +7,7 @@ import (
 	"os"
 	"path/filepath"
 
-	"gosync/internal/crypto"
-	"gosync/internal/network"
 	"gosync/internal/platform"
-	"gosync/internal/sync"
-	"gosync/internal/watcher"
 	"gosync/pkg/config"
 )
 
@@ -27,21 +23,144 @@ Commands:
          
          Options:
            -encrypt    Enable encryption (requires config with key file)
+           -encrypt-names  Also encrypt file and directory names and
+                           symlink targets (implies -encrypt)
            -compress   Enable compression (default: true)
            -remote     Sync to remote host (requires remote config)
-
-  watch  Watch a directory for changes and sync automatically
-         gosync watch [options] <directory>
+           -compare    How to detect changed files: mtime-size, checksum
+                       or always (default: mtime-size)
+           -delete     Delete destination files missing from the source
+           -delete-before    Delete before transferring (implies -delete)
+           -delete-after     Delete after transferring (the default)
+           -delete-excluded  Also delete destination files matching
+                             ignore patterns (implies -delete)
+           -dry-run    Print the planned changes without applying them
+           -bidirectional  Propagate changes in both directions using
+                           a state file that remembers the last sync
+           -state      State file remembering the last sync (default: one
+                       file per directory pair in the user state directory)
+           -conflict   What to do when the destination changed since the
+                       last sync: newer-wins, source-wins, dest-wins,
+                       keep-both, ask or skip (default: source-wins, or
+                       skip with -bidirectional)
+           -jobs       Number of files transferred in parallel
+                       (default: number of CPUs)
+           -preserve   Attributes to preserve, comma separated: mode,
+                       owner, times, xattrs or all (default: mode,times)
+           -a          Archive mode, same as -preserve=all (extended
+                       attributes are left out for -remote)
+
+  plan   Write the changes sync would make to a plan file for review
+         gosync plan [options] -o <plan.json> <source> <dest>
+
+         Accepts the same options as sync.
+
+  apply  Apply a previously written plan, refusing if the source changed
+         gosync apply [-jobs N] <plan.json>
+
+  watch  Sync once, then keep the destination in sync with every change
+         gosync watch [options] <source> <dest>
          
+         Accepts the same options as sync except -bidirectional.
+         Files deleted from the source while watching are always
+         deleted from the destination. The rescan that follows missed
+         events only removes other files missing from the source with
+         -delete.
+
          Options:
            -recursive  Watch directories recursively (default: true)
            -debounce   Debounce time in milliseconds (default: 100)
+           -mode       How to detect changes: inotify, poll or auto;
+                       poll works on NFS, SMB and FUSE mounts, auto falls
+                       back to it when out of inotify watches (default: auto)
+
+  restore Decrypt a destination written by sync -encrypt
+         gosync restore [options] <encrypted-dir> <target>
+
+         Restores permissions and modification times, and reports files
+         that were modified, truncated or encrypted with another key. Every
+         entry is checked against the manifest sync keeps at the
+         destination, which also reports swapped and deleted files.
+
+         Options:
+           -path       File or directory to restore, relative to the
+                       encrypted directory; may be repeated (default: all)
+           -jobs       Number of files decrypted in parallel
+                       (default: number of CPUs)
+           -encrypt-names  The names were encrypted by sync
+                           -encrypt-names; -path takes the original names
+           -remote     The encrypted directory is on the remote host
+                       (requires remote config)
+           -no-manifest  Accept a directory without a manifest, which
+                         cannot reveal deleted or rolled back files
+
+  verify Check a destination written by sync -encrypt without restoring it
+         gosync verify [options] <encrypted-dir>
+
+         Decrypts every file and checks it against the manifest, reporting
+         what restore would.
+
+         Options:
+           -jobs       Number of files decrypted in parallel
+                       (default: number of CPUs)
+           -encrypt-names  The names were encrypted by sync -encrypt-names
+           -remote     The encrypted directory is on the remote host
+           -no-manifest  Accept a directory without a manifest
+
+  keygen Create a key file for -encrypt, readable only by its owner
+         gosync keygen [options] [key-file]
+
+         Writes to encryption.key_file when no key file is given.
+
+         Options:
+           -passphrase  Derive the key from a passphrase with Argon2id
+                        instead of storing a random 256-bit key; the
+                        passphrase is read from GOSYNC_PASSPHRASE or asked
+                        for whenever the key is used
+           -x25519      Create an X25519 private key and print its public
+                        key; hosts with only the public key listed in
+                        encryption.recipients can encrypt but not decrypt
+
+  key    Manage the keys in encryption.key_file
+         gosync key rotate [options] <encrypted-dir>
+         gosync key list
+
+         rotate adds a new key to the keyring, makes it the active one and
+         rewraps every file of the encrypted directory with it. A key file
+         holding a single random key is turned into a keyring that keeps
+         it; passphrase keys cannot be rotated.
+
+         Options:
+           -resume     Finish an interrupted rotation to the active key
+                       instead of adding another key
+           -jobs       Number of files rotated in parallel
+                       (default: number of CPUs)
+           -encrypt-names  The names were encrypted by sync -encrypt-names
+           -remote     The encrypted directory is on the remote host
 
 Examples:
   gosync sync ./source ./backup
   gosync sync -encrypt ./source ./backup
   gosync sync -remote ./source /remote/backup
-  gosync watch -recursive ./directory
+  gosync sync -compare=checksum ./source ./backup
+  gosync sync -delete ./source ./mirror
+  gosync sync -dry-run -delete ./source ./mirror
+  gosync sync -bidirectional ./laptop ./workstation
+  gosync sync -remote -jobs 16 ./source /remote/backup
+  gosync sync -a ./source ./backup
+  gosync plan -o plan.json ./source ./backup
+  gosync apply plan.json
+  gosync watch ./source ./backup
+  gosync watch -remote ./source /remote/backup
+  gosync restore ./backup ./restored
+  gosync restore -path docs/report.pdf ./backup ./restored
+  gosync verify ./backup
+  gosync sync -remote -encrypt ./source /remote/backup
+  gosync restore -remote /remote/backup ./restored
+  gosync keygen ~/.gosync/keys/master.key
+  gosync keygen -passphrase ~/.gosync/keys/master.key
+  gosync keygen -x25519 ~/.gosync/keys/restore.key
+  gosync key rotate ./backup
 
 For more information, visit: https://github.com/yourusername/gosync
 `)
@@ -50,16 +169,52 @@ For more information, visit: https://github.com/yourusername/gosync
 func main() {
 	// Define subcommands
 	syncCmd := flag.NewFlagSet("sync", flag.ExitOnError)
+	planCmd := flag.NewFlagSet("plan", flag.ExitOnError)
+	applyCmd := flag.NewFlagSet("apply", flag.ExitOnError)
 	watchCmd := flag.NewFlagSet("watch", flag.ExitOnError)
+	restoreCmd := flag.NewFlagSet("restore", flag.ExitOnError)
+	verifyCmd := flag.NewFlagSet("verify", flag.ExitOnError)
+	keygenCmd := flag.NewFlagSet("keygen", flag.ExitOnError)
+	keyRotateCmd := flag.NewFlagSet("key rotate", flag.ExitOnError)
+	applyJobs := applyCmd.Int("jobs", 0, "Number of files to transfer in parallel (default: number of CPUs)")
 
 	// Sync command flags
-	syncEncrypt := syncCmd.Bool("encrypt", false, "Enable encryption for sync")
-	syncCompress := syncCmd.Bool("compress", true, "Enable compression")
-	syncRemote := syncCmd.Bool("remote", false, "Sync to remote host (requires remote config)")
+	syncFlags := addSyncFlags(syncCmd)
+	syncDryRun := syncCmd.Bool("dry-run", false, "Print the planned changes without applying them")
+
+	// Plan command flags
+	planFlags := addSyncFlags(planCmd)
+	planOutput := planCmd.String("o", "plan.json", "File to write the plan to")
 
 	// Watch command flags
+	watchFlags := addSyncFlags(watchCmd)
 	watchRecursive := watchCmd.Bool("recursive", true, "Watch directories recursively")
 	watchDebounce := watchCmd.Int("debounce", 100, "Debounce time in milliseconds")
+	watchMode := watchCmd.String("mode", "", "How to detect changes: inotify, poll or auto (default: auto)")
+
+	// Restore command flags
+	var restorePaths pathList
+	restoreCmd.Var(&restorePaths, "path", "File or directory to restore; may be repeated")
+	restoreJobs := restoreCmd.Int("jobs", 0, "Number of files to decrypt in parallel (default: number of CPUs)")
+	restoreNames := restoreCmd.Bool("encrypt-names", false, "The names were encrypted with -encrypt-names")
+	restoreRemote := restoreCmd.Bool("remote", false, "The encrypted directory is on the remote host")
+	restoreNoManifest := restoreCmd.Bool("no-manifest", false, "Accept an encrypted directory without a manifest")
+
+	// Verify command flags
+	verifyJobs := verifyCmd.Int("jobs", 0, "Number of files to decrypt in parallel (default: number of CPUs)")
+	verifyNames := verifyCmd.Bool("encrypt-names", false, "The names were encrypted with -encrypt-names")
+	verifyRemote := verifyCmd.Bool("remote", false, "The encrypted directory is on the remote host")
+	verifyNoManifest := verifyCmd.Bool("no-manifest", false, "Accept an encrypted directory without a manifest")
+
+	// Keygen command flags
+	keygenPassphrase := keygenCmd.Bool("passphrase", false, "Derive the key from a passphrase")
+	keygenX25519 := keygenCmd.Bool("x25519", false, "Create an X25519 key pair for encrypting to a public key")
+
+	// Key command flags
+	keyRotateResume := keyRotateCmd.Bool("resume", false, "Finish an interrupted rotation instead of adding another key")
+	keyRotateJobs := keyRotateCmd.Int("jobs", 0, "Number of files to rotate in parallel (default: number of CPUs)")
+	keyRotateNames := keyRotateCmd.Bool("encrypt-names", false, "The names were encrypted with -encrypt-names")
+	keyRotateRemote := keyRotateCmd.Bool("remote", false, "The encrypted directory is on the remote host")
 
 	if len(os.Args) < 2 {
 		printUsage()
@@ -89,13 +244,40 @@ func main() {
 		if err != nil {
 			log.Fatalf("Error loading config: %v", err)
 		}
-		handleSync(syncCmd.Arg(0), syncCmd.Arg(1), cfg, *syncEncrypt, *syncCompress, *syncRemote)
+		handleSync(syncCmd.Arg(0), syncCmd.Arg(1), cfg, syncFlags, *syncDryRun)
+
+	case "plan":
+		planCmd.Parse(os.Args[2:])
+		if planCmd.NArg() != 2 {
+			fmt.Println("Error: plan requires source and destination paths")
+			fmt.Println("\nUsage: gosync plan [options] -o <plan.json> <source> <dest>")
+			planCmd.PrintDefaults()
+			os.Exit(1)
+		}
+		cfg, err = loadConfig("")
+		if err != nil {
+			log.Fatalf("Error loading config: %v", err)
+		}
+		handlePlan(planCmd.Arg(0), planCmd.Arg(1), cfg, planFlags, *planOutput)
+
+	case "apply":
+		applyCmd.Parse(os.Args[2:])
+		if applyCmd.NArg() != 1 {
+			fmt.Println("Error: apply requires a plan file")
+			fmt.Println("\nUsage: gosync apply <plan.json>")
+			os.Exit(1)
+		}
+		cfg, err = loadConfig("")
+		if err != nil {
+			log.Fatalf("Error loading config: %v", err)
+		}
+		handleApply(applyCmd.Arg(0), cfg, *applyJobs)
 
 	case "watch":
 		watchCmd.Parse(os.Args[2:])
-		if watchCmd.NArg() != 1 {
-			fmt.Println("Error: watch requires a directory path")
-			fmt.Println("\nUsage: gosync watch [options] <directory>")
+		if watchCmd.NArg() != 2 {
+			fmt.Println("Error: watch requires source and destination paths")
+			fmt.Println("\nUsage: gosync watch [options] <source> <dest>")
 			watchCmd.PrintDefaults()
 			os.Exit(1)
 		}
@@ -103,7 +285,75 @@ func main() {
 		if err != nil {
 			log.Fatalf("Error loading config: %v", err)
 		}
-		handleWatch(watchCmd.Arg(0), cfg, *watchRecursive, *watchDebounce)
+		handleWatch(watchCmd.Arg(0), watchCmd.Arg(1), cfg, watchFlags, *watchRecursive, *watchDebounce, *watchMode)
+
+	case "restore":
+		restoreCmd.Parse(os.Args[2:])
+		if restoreCmd.NArg() != 2 {
+			fmt.Println("Error: restore requires the encrypted directory and a target")
+			fmt.Println("\nUsage: gosync restore [options] <encrypted-dir> <target>")
+			restoreCmd.PrintDefaults()
+			os.Exit(1)
+		}
+		cfg, err = loadConfig("")
+		if err != nil {
+			log.Fatalf("Error loading config: %v", err)
+		}
+		handleRestore(restoreCmd.Arg(0), restoreCmd.Arg(1), cfg, restorePaths, *restoreJobs, *restoreNames, *restoreRemote, *restoreNoManifest)
+
+	case "verify":
+		verifyCmd.Parse(os.Args[2:])
+		if verifyCmd.NArg() != 1 {
+			fmt.Println("Error: verify requires the encrypted directory")
+			fmt.Println("\nUsage: gosync verify [options] <encrypted-dir>")
+			verifyCmd.PrintDefaults()
+			os.Exit(1)
+		}
+		cfg, err = loadConfig("")
+		if err != nil {
+			log.Fatalf("Error loading config: %v", err)
+		}
+		handleVerify(verifyCmd.Arg(0), cfg, *verifyJobs, *verifyNames, *verifyRemote, *verifyNoManifest)
+
+	case "keygen":
+		keygenCmd.Parse(os.Args[2:])
+		if keygenCmd.NArg() > 1 {
+			fmt.Println("Error: keygen takes at most one key file")
+			fmt.Println("\nUsage: gosync keygen [options] [key-file]")
+			keygenCmd.PrintDefaults()
+			os.Exit(1)
+		}
+		cfg, err = loadConfig("")
+		if err != nil {
+			log.Fatalf("Error loading config: %v", err)
+		}
+		handleKeygen(keygenCmd.Arg(0), cfg, *keygenPassphrase, *keygenX25519)
+
+	case "key":
+		if len(os.Args) < 3 {
+			fmt.Println("Error: key requires a subcommand: rotate or list")
+			os.Exit(1)
+		}
+		cfg, err = loadConfig("")
+		if err != nil {
+			log.Fatalf("Error loading config: %v", err)
+		}
+		switch os.Args[2] {
+		case "rotate":
+			keyRotateCmd.Parse(os.Args[3:])
+			if keyRotateCmd.NArg() != 1 {
+				fmt.Println("Error: key rotate requires the encrypted directory")
+				fmt.Println("\nUsage: gosync key rotate [options] <encrypted-dir>")
+				keyRotateCmd.PrintDefaults()
+				os.Exit(1)
+			}
+			handleKeyRotate(keyRotateCmd.Arg(0), cfg, *keyRotateResume, *keyRotateJobs, *keyRotateNames, *keyRotateRemote)
+		case "list":
+			handleKeyList(cfg)
+		default:
+			fmt.Printf("%q is not a valid key subcommand.\n", os.Args[2])
+			os.Exit(1)
+		}
 
 	default:
 		fmt.Printf("%q is not valid command.\n", os.Args[1])
@@ -169,104 +419,3 @@ func loadConfig(configPath string) (*config.Config, error) {
 	}
 	return config.LoadConfig(configPath)
 }
-
-func handleSync(source, dest string, cfg *config.Config, encrypt, compress, remote bool) {
-	source, err := filepath.Abs(source)
-	if err != nil {
-		log.Fatalf("Invalid source path: %v", err)
-	}
-
-	if remote {
-		// Check remote configuration
-		if cfg.Remote.Host == "" {
-			log.Fatal("Remote sync requires host configuration in config file")
-		}
-		if cfg.Remote.Port == 0 {
-			cfg.Remote.Port = 22 // Default SSH port
-		}
-
-		// Convert destination path to use forward slashes for remote systems
-		dest = filepath.ToSlash(dest)
-
-		fmt.Printf("Syncing from %s to %s@%s:%s\n", source, cfg.Remote.Username, cfg.Remote.Host, dest)
-		fmt.Printf("Encryption: %v, Compression: %v\n", encrypt, compress)
-
-		// Initialize remote sync
-		remoteSync, err := network.NewRemoteSync(network.RemoteConfig{
-			Host:     cfg.Remote.Host,
-			Port:     cfg.Remote.Port,
-			Username: cfg.Remote.Username,
-			Password: cfg.Remote.Password,
-			KeyFile:  cfg.Remote.KeyFile,
-		}, dest)
-		if err != nil {
-			log.Fatalf("Error initializing remote sync: %v", err)
-		}
-		defer remoteSync.Close()
-
-		// Sync to remote
-		if err := remoteSync.SyncToRemote(source); err != nil {
-			log.Fatalf("Error during remote sync: %v", err)
-		}
-	} else {
-		dest, err = filepath.Abs(dest)
-		if err != nil {
-			log.Fatalf("Invalid destination path: %v", err)
-		}
-
-		fmt.Printf("Syncing from %s to %s\n", source, dest)
-		fmt.Printf("Encryption: %v, Compression: %v\n", encrypt, compress)
-
-		// Initialize sync manager
-		syncManager := sync.NewManager(cfg.Sync.BlockSize, cfg.Sync.IgnorePatterns)
-
-		// Initialize crypto manager if encryption is enabled
-		var cryptoManager *crypto.Manager
-		if encrypt {
-			cryptoManager, err = crypto.NewManager(cfg.Encryption.KeyFile)
-			if err != nil {
-				log.Fatalf("Error initializing crypto manager: %v", err)
-			}
-		}
-
-		// Perform sync
-		if err := syncManager.SyncDirectory(source, dest, cryptoManager); err != nil {
-			log.Fatalf("Error during sync: %v", err)
-		}
-	}
-
-	fmt.Println("Sync completed successfully")
-}
-
-func handleWatch(dir string, cfg *config.Config, recursive bool, debounce int) {
-	dir, err := filepath.Abs(dir)
-	if err != nil {
-		log.Fatalf("Invalid directory path: %v", err)
-	}
-
-	fmt.Printf("Watching directory: %s\n", dir)
-	fmt.Printf("Recursive: %v, Debounce: %dms\n", recursive, debounce)
-
-	// Initialize watcher
-	w, err := watcher.NewWatcher(debounce)
-	if err != nil {
-		log.Fatalf("Error creating watcher: %v", err)
-	}
-	defer w.Close()
-
-	// Start watching
-	if err := w.Watch(dir, recursive); err != nil {
-		log.Fatalf("Error starting watcher: %v", err)
-	}
-
-	// Handle events
-	fmt.Println("Watching for changes. Press Ctrl+C to stop.")
-	for {
-		select {
-		case event := <-w.Events():
-			fmt.Printf("Event: %s - %s\n", event.Operation, event.Path)
-		case err := <-w.Errors():
-			log.Printf("Error: %v\n", err)
-		}
-	}
-}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"gosync/internal/sync"
+	"gosync/pkg/config"
+)
+
+// pathList collects the values of a repeatable flag
+type pathList []string
+
+func (p *pathList) String() string {
+	return strings.Join(*p, ",")
+}
+
+func (p *pathList) Set(value string) error {
+	*p = append(*p, value)
+	return nil
+}
+
+func handleRestore(source, dest string, cfg *config.Config, paths []string, jobs int, names, remote, noManifest bool) {
+	if jobs == 0 {
+		jobs = cfg.Sync.Workers
+	}
+	cryptoManager := newCryptoManager(cfg, true)
+	target, _, closeTarget := openTarget(source, cfg, remote)
+	defer closeTarget()
+	target = encryptedTarget(target, cryptoManager, names || cfg.Encryption.EncryptNames)
+
+	syncManager := sync.NewManager(sync.Options{Workers: jobs, NoManifest: noManifest})
+	fmt.Printf("Restoring %s to %s\n", target, dest)
+	stats, err := syncManager.Restore(target, dest, paths, cryptoManager)
+	if err != nil {
+		fatalRestore(err)
+	}
+
+	fmt.Printf("Restored %d files (%d bytes)\n", stats.Restored, stats.Bytes)
+	if !printVerification(stats, " and were not restored") {
+		os.Exit(1)
+	}
+	fmt.Println("Restore completed successfully")
+}
+
+func handleVerify(source string, cfg *config.Config, jobs int, names, remote, noManifest bool) {
+	if jobs == 0 {
+		jobs = cfg.Sync.Workers
+	}
+	cryptoManager := newCryptoManager(cfg, true)
+	target, _, closeTarget := openTarget(source, cfg, remote)
+	defer closeTarget()
+	target = encryptedTarget(target, cryptoManager, names || cfg.Encryption.EncryptNames)
+
+	syncManager := sync.NewManager(sync.Options{Workers: jobs, NoManifest: noManifest})
+	fmt.Printf("Verifying %s\n", target)
+	stats, err := syncManager.Verify(target, cryptoManager)
+	if err != nil {
+		fatalRestore(err)
+	}
+
+	fmt.Printf("Verified %d files (%d bytes)\n", stats.Restored, stats.Bytes)
+	if !printVerification(stats, "") {
+		os.Exit(1)
+	}
+	fmt.Println("Verification completed successfully")
+}
+
+// fatalRestore exits with an error of restore or verify
+func fatalRestore(err error) {
+	if errors.Is(err, sync.ErrNoManifest) {
+		log.Fatalf("Error: %v; files deleted or rolled back at the destination cannot be detected (pass -no-manifest to check it anyway)", err)
+	}
+	log.Fatalf("Error: %v", err)
+}
+
+// printVerification reports how the encrypted files held up against their
+// authentication and the manifest, and whether all of them did
+func printVerification(stats *sync.RestoreStats, failed string) bool {
+	if stats.Manifest.IsZero() {
+		fmt.Println("No manifest was checked, so deleted files cannot be detected")
+	} else {
+		fmt.Printf("Checked against the manifest written %s\n", stats.Manifest.Format("2006-01-02 15:04:05"))
+	}
+	if len(stats.Failed) > 0 {
+		fmt.Printf("%d files failed verification%s:\n", len(stats.Failed), failed)
+		for _, failure := range stats.Failed {
+			fmt.Printf("  %s\n", failure)
+		}
+	}
+	if len(stats.Missing) > 0 {
+		fmt.Printf("%d entries recorded in the manifest are missing:\n", len(stats.Missing))
+		for _, path := range stats.Missing {
+			fmt.Printf("  %s\n", path)
+		}
+	}
+	return len(stats.Failed) == 0 && len(stats.Missing) == 0
+}
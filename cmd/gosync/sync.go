@@ -0,0 +1,501 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gosync/internal/crypto"
+	"gosync/internal/network"
+	"gosync/internal/platform"
+	"gosync/internal/sync"
+	"gosync/pkg/config"
+)
+
+// stdin reads answers to interactive prompts
+var stdin = bufio.NewReader(os.Stdin)
+
+// syncFlags holds the command line options shared by sync and plan
+type syncFlags struct {
+	encrypt        *bool
+	encryptNames   *bool
+	compress       *bool
+	remote         *bool
+	compare        *string
+	del            *bool
+	deleteBefore   *bool
+	deleteAfter    *bool
+	deleteExcluded *bool
+	bidirectional  *bool
+	statePath      *string
+	conflict       *string
+	jobs           *int
+	preserve       *string
+	archive        *bool
+}
+
+// addSyncFlags registers the sync options on a flag set
+func addSyncFlags(fs *flag.FlagSet) *syncFlags {
+	return &syncFlags{
+		encrypt:        fs.Bool("encrypt", false, "Enable encryption for sync"),
+		encryptNames:   fs.Bool("encrypt-names", false, "Also encrypt file and directory names (implies -encrypt)"),
+		compress:       fs.Bool("compress", true, "Enable compression"),
+		remote:         fs.Bool("remote", false, "Sync to remote host (requires remote config)"),
+		compare:        fs.String("compare", "", "How to detect changed files: mtime-size, checksum or always"),
+		del:            fs.Bool("delete", false, "Delete destination files missing from the source"),
+		deleteBefore:   fs.Bool("delete-before", false, "Delete extraneous files before transferring"),
+		deleteAfter:    fs.Bool("delete-after", false, "Delete extraneous files after transferring"),
+		deleteExcluded: fs.Bool("delete-excluded", false, "Also delete destination files matching ignore patterns"),
+		bidirectional:  fs.Bool("bidirectional", false, "Propagate changes in both directions"),
+		statePath:      fs.String("state", "", "State file remembering the last sync (default: per-pair file in the state directory)"),
+		conflict:       fs.String("conflict", "", "Conflict policy: newer-wins, source-wins, dest-wins, keep-both, ask or skip"),
+		jobs:           fs.Int("jobs", 0, "Number of files to transfer in parallel (default: number of CPUs)"),
+		preserve:       fs.String("preserve", "", "Attributes to preserve: mode, owner, times, xattrs or all (default: mode,times)"),
+		archive:        fs.Bool("a", false, "Archive mode: preserve all attributes"),
+	}
+}
+
+// options combines configuration and command line flags into options for
+// the sync manager
+func (f *syncFlags) options(cfg *config.Config) (sync.Options, error) {
+	compareName := cfg.Sync.Compare
+	if *f.compare != "" {
+		compareName = *f.compare
+	}
+	compare, err := sync.ParseCompareMode(compareName)
+	if err != nil {
+		return sync.Options{}, fmt.Errorf("invalid compare mode: %w", err)
+	}
+
+	if *f.deleteBefore && *f.deleteAfter {
+		return sync.Options{}, fmt.Errorf("-delete-before and -delete-after are mutually exclusive")
+	}
+	deleteMode := sync.DeleteNone
+	switch {
+	case *f.deleteBefore:
+		deleteMode = sync.DeleteBefore
+	case *f.del || *f.deleteAfter || *f.deleteExcluded:
+		deleteMode = sync.DeleteAfter
+	}
+
+	// One-way syncs overwrite by default, two-way syncs never guess
+	conflictName := cfg.Sync.Conflict
+	if *f.conflict != "" {
+		conflictName = *f.conflict
+	}
+	if conflictName == "" {
+		conflictName = string(sync.ConflictSourceWins)
+		if *f.bidirectional {
+			conflictName = string(sync.ConflictSkip)
+		}
+	}
+	conflict, err := sync.ParseConflictPolicy(conflictName)
+	if err != nil {
+		return sync.Options{}, err
+	}
+
+	preserveList := cfg.Sync.Preserve
+	if *f.preserve != "" {
+		preserveList = *f.preserve
+	}
+	preserve, err := sync.ParsePreserve(preserveList)
+	if err != nil {
+		return sync.Options{}, fmt.Errorf("invalid -preserve: %w", err)
+	}
+	if *f.archive {
+		preserve = sync.PreserveAll
+		// Encrypted files carry only their mode and times, and SFTP has
+		// no extended attributes
+		if encrypt, _ := f.encrypting(cfg); encrypt {
+			preserve &^= sync.PreserveOwner | sync.PreserveXattrs
+			log.Printf("Archive mode preserves only the mode and times of encrypted files")
+		} else if *f.remote {
+			preserve &^= sync.PreserveXattrs
+			log.Printf("Archive mode does not preserve extended attributes on remote targets")
+		}
+	}
+	if *f.remote && preserve.Has(sync.PreserveXattrs) {
+		return sync.Options{}, fmt.Errorf("extended attributes cannot be preserved on remote targets")
+	}
+
+	workers := cfg.Sync.Workers
+	if *f.jobs != 0 {
+		workers = *f.jobs
+	}
+	if workers < 0 {
+		return sync.Options{}, fmt.Errorf("invalid number of jobs %d", workers)
+	}
+
+	return sync.Options{
+		BlockSize:      cfg.Sync.BlockSize,
+		IgnorePatterns: cfg.Sync.IgnorePatterns,
+		Compare:        compare,
+		Delete:         deleteMode,
+		DeleteExcluded: *f.deleteExcluded,
+		Conflict:       conflict,
+		Ask:            askConflict,
+		Workers:        workers,
+		Preserve:       preserve,
+	}, nil
+}
+
+// askConflict prompts on the terminal for the resolution of a conflict
+func askConflict(conflict sync.Conflict, source, dest sync.EntryState) (sync.Resolution, error) {
+	fmt.Printf("Conflict: %s (%s)\n", conflict.Path, conflict.Reason)
+	fmt.Printf("  source: %d bytes, modified %s\n", source.Size, source.ModTime.Format(time.RFC3339))
+	fmt.Printf("  dest:   %d bytes, modified %s\n", dest.Size, dest.ModTime.Format(time.RFC3339))
+	for {
+		fmt.Print("Keep [s]ource, [d]estination, [b]oth, or s[k]ip? ")
+		answer, err := stdin.ReadString('\n')
+		if err != nil {
+			return sync.Unresolved, fmt.Errorf("error reading answer: %w", err)
+		}
+		switch strings.TrimSpace(strings.ToLower(answer)) {
+		case "s", "source":
+			return sync.ResolvedSource, nil
+		case "d", "dest", "destination":
+			return sync.ResolvedDest, nil
+		case "b", "both":
+			return sync.ResolvedBoth, nil
+		case "k", "skip":
+			return sync.Unresolved, nil
+		}
+	}
+}
+
+// statePath returns the state file for a pair of trees. One-way syncs use
+// a separate file since they only record the destination side.
+func statePath(override, suffix, a, b string) string {
+	if override != "" {
+		return override
+	}
+	sum := sha256.Sum256([]byte(a + "\x00" + b))
+	return filepath.Join(platform.GetDefaultStateDir(), hex.EncodeToString(sum[:8])+suffix+".json")
+}
+
+// printConflicts prints the summary of every conflict of the last run
+func printConflicts(syncManager *sync.Manager) {
+	for _, conflict := range syncManager.Conflicts() {
+		fmt.Printf("Conflict: %s\n", conflict)
+	}
+}
+
+// openTarget resolves the destination into a sync target, connecting to the
+// remote host if requested. It returns the normalized destination path and
+// a function that releases the target.
+func openTarget(dest string, cfg *config.Config, remote bool) (sync.Target, string, func()) {
+	if !remote {
+		dest, err := filepath.Abs(dest)
+		if err != nil {
+			log.Fatalf("Invalid destination path: %v", err)
+		}
+		return sync.NewLocalTarget(dest), dest, func() {}
+	}
+
+	// Check remote configuration
+	if cfg.Remote.Host == "" {
+		log.Fatal("Remote sync requires host configuration in config file")
+	}
+	if cfg.Remote.Port == 0 {
+		cfg.Remote.Port = 22 // Default SSH port
+	}
+
+	// Convert destination path to use forward slashes for remote systems
+	dest = filepath.ToSlash(dest)
+
+	// Initialize remote sync
+	remoteSync, err := network.NewRemoteSync(network.RemoteConfig{
+		Host:     cfg.Remote.Host,
+		Port:     cfg.Remote.Port,
+		Username: cfg.Remote.Username,
+		Password: cfg.Remote.Password,
+		KeyFile:  cfg.Remote.KeyFile,
+	}, dest)
+	if err != nil {
+		log.Fatalf("Error initializing remote sync: %v", err)
+	}
+	return remoteSync, dest, func() { remoteSync.Close() }
+}
+
+// encrypting reports whether file contents are encrypted, by flag or by
+// the configuration, and whether names are encrypted along with them
+func (f *syncFlags) encrypting(cfg *config.Config) (encrypt, names bool) {
+	encrypt = *f.encrypt || *f.encryptNames || cfg.Encryption.Enabled
+	return encrypt, encrypt && (*f.encryptNames || cfg.Encryption.EncryptNames)
+}
+
+// encryptedTarget wraps the target to store encrypted names if requested
+func encryptedTarget(target sync.Target, cryptoManager *crypto.Manager, names bool) sync.Target {
+	if !names {
+		return target
+	}
+	target, err := sync.EncryptNames(target, cryptoManager)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	return target
+}
+
+// newCryptoManager initializes the crypto manager if encryption is enabled
+func newCryptoManager(cfg *config.Config, encrypt bool) *crypto.Manager {
+	if !encrypt {
+		return nil
+	}
+	cryptoManager, err := crypto.NewManager(cfg.Encryption.KeyFile, cfg.Encryption.Recipients, readPassphrase)
+	if err != nil {
+		log.Fatalf("Error initializing crypto manager: %v", err)
+	}
+	return cryptoManager
+}
+
+// printPlan prints the operations of a plan, one per line
+func printPlan(plan *sync.Plan) {
+	for _, op := range plan.Operations {
+		fmt.Println(op)
+	}
+	fmt.Printf("%d operations, %d files unchanged\n", len(plan.Operations), plan.Unchanged)
+}
+
+// printStats prints the summary of a finished sync
+func printStats(syncManager *sync.Manager) {
+	stats := syncManager.Stats()
+	fmt.Printf("Transferred %d files (%d bytes), skipped %d unchanged, deleted %d\n",
+		stats.Transferred, stats.Bytes, stats.Skipped, stats.Deleted)
+	if stats.Conflicts > 0 {
+		fmt.Printf("%d conflicts:\n", stats.Conflicts)
+		printConflicts(syncManager)
+	}
+}
+
+func handleSync(source, dest string, cfg *config.Config, flags *syncFlags, dryRun bool) {
+	source, err := filepath.Abs(source)
+	if err != nil {
+		log.Fatalf("Invalid source path: %v", err)
+	}
+
+	opts, err := flags.options(cfg)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+
+	target, _, closeTarget := openTarget(dest, cfg, *flags.remote)
+	defer closeTarget()
+
+	if dryRun {
+		// Dry runs report conflicts without prompting
+		opts.Ask = nil
+	}
+
+	encrypt, names := flags.encrypting(cfg)
+	if *flags.bidirectional {
+		if encrypt {
+			log.Fatal("Error: -bidirectional does not support encryption")
+		}
+		handleBidirectional(source, target, *flags.statePath, opts, dryRun)
+		return
+	}
+
+	fmt.Printf("Syncing from %s to %s\n", source, target)
+	fmt.Printf("Encryption: %v, Compression: %v\n", encrypt, *flags.compress)
+
+	cryptoManager := newCryptoManager(cfg, encrypt)
+	target = encryptedTarget(target, cryptoManager, names)
+
+	// The state of the last sync tells destination edits from stale copies
+	stateFile := statePath(*flags.statePath, ".oneway", source, target.String())
+	state, err := sync.LoadState(stateFile, source, target.String())
+	if err != nil {
+		log.Fatalf("Error loading sync state: %v", err)
+	}
+
+	// Initialize sync manager
+	syncManager := sync.NewManager(opts)
+	syncManager.UseState(state)
+	if err := syncManager.LoadManifest(target, cryptoManager); err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+
+	plan, err := syncManager.Plan(source, target, encrypt)
+	if err != nil {
+		log.Fatalf("Error planning sync: %v", err)
+	}
+
+	if dryRun {
+		printPlan(plan)
+		for _, conflict := range plan.Conflicts {
+			fmt.Printf("Conflict: %s\n", conflict)
+		}
+		fmt.Println("Dry run, nothing was changed")
+		return
+	}
+
+	// Perform sync
+	if err := syncManager.Execute(plan, target, cryptoManager); err != nil {
+		log.Fatalf("Error during sync: %v", err)
+	}
+	saveState(syncManager, plan, target, state, stateFile)
+
+	printStats(syncManager)
+	fmt.Println("Sync completed successfully")
+}
+
+// saveState records the destination after a successful one-way sync
+func saveState(syncManager *sync.Manager, plan *sync.Plan, target sync.Target, state *sync.State, stateFile string) {
+	if err := syncManager.RecordState(plan, target, state); err != nil {
+		log.Fatalf("Error recording sync state: %v", err)
+	}
+	if err := sync.SaveState(state, stateFile); err != nil {
+		log.Fatalf("Error saving sync state: %v", err)
+	}
+}
+
+func handleBidirectional(dirA string, target sync.Target, stateOverride string, opts sync.Options, dryRun bool) {
+	if opts.Delete != sync.DeleteNone {
+		log.Fatal("Error: -delete cannot be combined with -bidirectional; deletions are propagated automatically")
+	}
+
+	// Each pair of trees gets its own state file
+	dirB := target.String()
+	stateFile := statePath(stateOverride, "", dirA, dirB)
+
+	state, err := sync.LoadState(stateFile, dirA, dirB)
+	if err != nil {
+		log.Fatalf("Error loading sync state: %v", err)
+	}
+
+	fmt.Printf("Syncing %s <-> %s\n", dirA, dirB)
+
+	syncManager := sync.NewManager(opts)
+	plan, err := syncManager.PlanBidirectional(dirA, target, state)
+	if err != nil {
+		log.Fatalf("Error planning sync: %v", err)
+	}
+
+	if dryRun {
+		for _, action := range plan.Actions {
+			fmt.Println(action)
+		}
+		fmt.Printf("%d actions\n", len(plan.Actions))
+		for _, conflict := range plan.Conflicts {
+			fmt.Printf("Conflict: %s\n", conflict)
+		}
+		fmt.Println("Dry run, nothing was changed")
+		return
+	}
+
+	execErr := syncManager.ExecuteBidirectional(plan, dirA, target, state)
+	if execErr == nil {
+		if err := sync.SaveState(state, stateFile); err != nil {
+			log.Fatalf("Error saving sync state: %v", err)
+		}
+	}
+
+	printStats(syncManager)
+	if execErr != nil {
+		log.Fatalf("Error during sync: %v", execErr)
+	}
+	fmt.Println("Sync completed successfully")
+}
+
+func handlePlan(source, dest string, cfg *config.Config, flags *syncFlags, output string) {
+	source, err := filepath.Abs(source)
+	if err != nil {
+		log.Fatalf("Invalid source path: %v", err)
+	}
+
+	opts, err := flags.options(cfg)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+
+	target, dest, closeTarget := openTarget(dest, cfg, *flags.remote)
+	defer closeTarget()
+
+	state, err := sync.LoadState(statePath(*flags.statePath, ".oneway", source, target.String()), source, target.String())
+	if err != nil {
+		log.Fatalf("Error loading sync state: %v", err)
+	}
+
+	// Planning needs the key to look up encrypted names and to read the
+	// manifest
+	encrypt, names := flags.encrypting(cfg)
+	cryptoManager := newCryptoManager(cfg, encrypt)
+	target = encryptedTarget(target, cryptoManager, names)
+
+	syncManager := sync.NewManager(opts)
+	syncManager.UseState(state)
+	if err := syncManager.LoadManifest(target, cryptoManager); err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	plan, err := syncManager.Plan(source, target, encrypt)
+	if err != nil {
+		log.Fatalf("Error planning sync: %v", err)
+	}
+	plan.Dest = dest
+	plan.Remote = *flags.remote
+	if *flags.statePath != "" {
+		// Apply may run from another directory
+		if plan.State, err = filepath.Abs(*flags.statePath); err != nil {
+			log.Fatalf("Invalid state path: %v", err)
+		}
+	}
+
+	if err := sync.SavePlan(plan, output); err != nil {
+		log.Fatalf("Error saving plan: %v", err)
+	}
+
+	printPlan(plan)
+	for _, conflict := range plan.Conflicts {
+		fmt.Printf("Conflict: %s\n", conflict)
+	}
+	fmt.Printf("Plan written to %s\n", output)
+}
+
+func handleApply(planPath string, cfg *config.Config, jobs int) {
+	plan, err := sync.LoadPlan(planPath)
+	if err != nil {
+		log.Fatalf("Error loading plan: %v", err)
+	}
+
+	if jobs == 0 {
+		jobs = cfg.Sync.Workers
+	}
+
+	// The plan's own ignore patterns decide which source entries it covers
+	syncManager := sync.NewManager(sync.Options{
+		BlockSize:      cfg.Sync.BlockSize,
+		IgnorePatterns: plan.IgnorePatterns,
+		Workers:        jobs,
+	})
+	if err := syncManager.VerifySource(plan); err != nil {
+		log.Fatalf("Refusing to apply plan: %v", err)
+	}
+
+	target, _, closeTarget := openTarget(plan.Dest, cfg, plan.Remote)
+	defer closeTarget()
+
+	fmt.Printf("Applying %d operations from %s to %s\n", len(plan.Operations), plan.Source, target)
+
+	stateFile := statePath(plan.State, ".oneway", plan.Source, target.String())
+	state, err := sync.LoadState(stateFile, plan.Source, target.String())
+	if err != nil {
+		log.Fatalf("Error loading sync state: %v", err)
+	}
+
+	cryptoManager := newCryptoManager(cfg, plan.Encrypt)
+	target = encryptedTarget(target, cryptoManager, plan.EncryptNames)
+	if err := syncManager.Execute(plan, target, cryptoManager); err != nil {
+		log.Fatalf("Error applying plan: %v", err)
+	}
+	saveState(syncManager, plan, target, state, stateFile)
+
+	printStats(syncManager)
+	fmt.Println("Plan applied successfully")
+}
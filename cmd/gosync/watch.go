@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"time"
+
+	"gosync/internal/crypto"
+	"gosync/internal/sync"
+	"gosync/internal/watcher"
+	"gosync/pkg/config"
+)
+
+func handleWatch(source, dest string, cfg *config.Config, flags *syncFlags, recursive bool, debounce int, mode string) {
+	source, err := filepath.Abs(source)
+	if err != nil {
+		log.Fatalf("Invalid source path: %v", err)
+	}
+	if *flags.bidirectional {
+		log.Fatal("Error: watch does not support -bidirectional")
+	}
+
+	opts, err := flags.options(cfg)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	// Nobody is around to answer prompts while watching
+	opts.Ask = nil
+
+	target, _, closeTarget := openTarget(dest, cfg, *flags.remote)
+	defer closeTarget()
+
+	encrypt, names := flags.encrypting(cfg)
+	cryptoManager := newCryptoManager(cfg, encrypt)
+	target = encryptedTarget(target, cryptoManager, names)
+
+	// Watch before the initial sync so no change slips in between
+	if mode == "" {
+		mode = cfg.Watch.Mode
+	}
+	w, err := watcher.NewWatcher(watcher.Options{
+		DebounceMs:     debounce,
+		IgnorePatterns: cfg.Sync.IgnorePatterns,
+		MaxWait:        time.Duration(cfg.Watch.MaxWaitMs) * time.Millisecond,
+		Mode:           watcher.Mode(mode),
+		PollInterval:   time.Duration(cfg.Watch.PollIntervalMs) * time.Millisecond,
+	})
+	if err != nil {
+		log.Fatalf("Error creating watcher: %v", err)
+	}
+	defer w.Close()
+	if err := w.Watch(source, recursive); err != nil {
+		log.Fatalf("Error starting watcher: %v", err)
+	}
+
+	fmt.Printf("Syncing from %s to %s\n", source, target)
+	if err := fullSync(source, target, opts, encrypt, cryptoManager); err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+
+	how := "Watching"
+	if w.Polling() {
+		how = "Polling"
+	}
+	fmt.Printf("%s %s for changes. Press Ctrl+C to stop.\n", how, source)
+	for {
+		select {
+		case batch := <-w.Batches():
+			if batch.Resync {
+				fmt.Println("Changes may have been missed, rescanning")
+				if err := fullSync(source, target, opts, encrypt, cryptoManager); err != nil {
+					log.Printf("Error: %v", err)
+				}
+				// Removals among the dropped changes are propagated like
+				// those of any batch
+				if removed := removalsOf(source, batch); len(removed.paths) > 0 {
+					syncChanges(source, removed, target, opts, encrypt, cryptoManager)
+				}
+				continue
+			}
+			changes := changesOf(source, batch)
+			if len(changes.paths)+len(changes.moves) == 0 {
+				continue
+			}
+			syncChanges(source, changes, target, opts, encrypt, cryptoManager)
+
+		case err := <-w.Errors():
+			log.Printf("Watch error: %v", err)
+
+		case <-interrupt:
+			fmt.Println("Stopped watching")
+			return
+		}
+	}
+}
+
+// fullSync compares the whole tree, as the initial sync and after changes
+// were missed
+func fullSync(source string, target sync.Target, opts sync.Options, encrypt bool, cryptoManager *crypto.Manager) error {
+	syncManager := sync.NewManager(opts)
+	if err := syncManager.LoadManifest(target, cryptoManager); err != nil {
+		return err
+	}
+	plan, err := syncManager.Plan(source, target, encrypt)
+	if err != nil {
+		return fmt.Errorf("error planning sync: %w", err)
+	}
+	if err := syncManager.Execute(plan, target, cryptoManager); err != nil {
+		return fmt.Errorf("error during sync: %w", err)
+	}
+	printStats(syncManager)
+	return nil
+}
+
+// changeBatch holds the changes of one batch, relative to the source
+type changeBatch struct {
+	paths []string
+	moves []sync.Move
+}
+
+// changesOf converts a batch of watcher events to paths relative to the
+// source
+func changesOf(source string, batch watcher.Batch) changeBatch {
+	var changes changeBatch
+	relative := func(path string) (string, bool) {
+		rel, err := filepath.Rel(source, path)
+		if err != nil {
+			log.Printf("Ignoring event for %s: %v", path, err)
+			return "", false
+		}
+		return rel, true
+	}
+
+	for _, event := range batch.Events {
+		if event.Op.Has(watcher.OpMove) {
+			from, okFrom := relative(event.Move.From)
+			to, okTo := relative(event.Move.To)
+			if okFrom && okTo {
+				changes.moves = append(changes.moves, sync.Move{From: from, To: to, Verify: event.Move.Verify})
+			}
+			continue
+		}
+		if rel, ok := relative(event.Path); ok {
+			changes.paths = append(changes.paths, rel)
+		}
+	}
+	return changes
+}
+
+// removalsOf returns the removals a resync batch carries over from the
+// changes it replaced, relative to the source
+func removalsOf(source string, batch watcher.Batch) changeBatch {
+	var changes changeBatch
+	for _, path := range batch.Removed {
+		if rel, err := filepath.Rel(source, path); err == nil {
+			changes.paths = append(changes.paths, rel)
+		}
+	}
+	return changes
+}
+
+// syncChanges brings the changed source paths up to date on the target.
+// Errors are reported without stopping the watch.
+func syncChanges(source string, changes changeBatch, target sync.Target, opts sync.Options, encrypt bool, cryptoManager *crypto.Manager) {
+	syncManager := sync.NewManager(opts)
+	if err := syncManager.LoadManifest(target, cryptoManager); err != nil {
+		log.Printf("Error: %v", err)
+		return
+	}
+	plan, err := syncManager.PlanPaths(source, target, changes.paths, changes.moves, encrypt)
+	if err != nil {
+		log.Printf("Error planning sync: %v", err)
+		return
+	}
+	if len(plan.Operations) == 0 {
+		return
+	}
+	if err := syncManager.Execute(plan, target, cryptoManager); err != nil {
+		log.Printf("Error during sync: %v", err)
+	}
+
+	renamed := 0
+	for _, op := range plan.Operations {
+		if op.Type == sync.OpRename {
+			renamed++
+		}
+	}
+	stats := syncManager.Stats()
+	fmt.Printf("%s Synced %d paths: transferred %d files (%d bytes), renamed %d, deleted %d\n",
+		time.Now().Format("15:04:05"), len(changes.paths)+len(changes.moves), stats.Transferred, stats.Bytes, renamed, stats.Deleted)
+	if stats.Conflicts > 0 {
+		printConflicts(syncManager)
+	}
+}
@@ -6,10 +6,9 @@ require (
 	github.com/fsnotify/fsnotify v1.6.0
 	github.com/pkg/sftp v1.13.6
 	golang.org/x/crypto v0.17.0
+	golang.org/x/sys v0.15.0
+	golang.org/x/term v0.15.0
 	gopkg.in/yaml.v3 v3.0.1
 )
 
-require (
-	github.com/kr/fs v0.1.0 // indirect
-	golang.org/x/sys v0.15.0 // indirect
-)
+require github.com/kr/fs v0.1.0 // indirect
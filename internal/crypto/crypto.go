@@ -1,90 +1,183 @@
 package crypto
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
-	"crypto/rand"
+	"bufio"
 	"fmt"
 	"io"
 	"os"
+
+	"gosync/pkg/utils"
 )
 
 // Manager handles encryption and decryption operations
 type Manager struct {
-	key []byte
+	// keyring holds the symmetric keys, if any
+	keyring *Keyring
+	names   *siv
+	// recipients are the public keys every file is also encrypted to
+	recipients []*Recipient
+	// identities are the private keys to decrypt files encrypted to them
+	identities []*Identity
 }
 
-// NewManager creates a new crypto manager with the given key
-func NewManager(keyFile string) (*Manager, error) {
-	key, err := os.ReadFile(keyFile)
+// NewManager creates a new crypto manager with the keys from keyFile, which
+// holds a symmetric key, a keyring or an X25519 identity, and encrypting to
+// the given recipients. Either may be empty, leaving a manager that only
+// encrypts to recipients, or only decrypts with an identity. passphrase is
+// asked for the passphrase of passphrase key files.
+func NewManager(keyFile string, recipients []string, passphrase PassphraseFunc) (*Manager, error) {
+	m := &Manager{}
+	for _, s := range recipients {
+		r, err := ParseRecipient(s)
+		if err != nil {
+			return nil, err
+		}
+		m.recipients = append(m.recipients, r)
+	}
+	if keyFile == "" {
+		if len(m.recipients) == 0 {
+			return nil, fmt.Errorf("no key file or recipients configured")
+		}
+		return m, nil
+	}
+
+	data, err := os.ReadFile(keyFile)
 	if err != nil {
 		return nil, fmt.Errorf("error reading key file: %w", err)
 	}
+	if isIdentity(data) {
+		id, err := parseIdentity(data)
+		if err != nil {
+			return nil, fmt.Errorf("error reading key file %s: %w", keyFile, err)
+		}
+		m.identities = append(m.identities, id)
+		return m, nil
+	}
 
-	return &Manager{key: key}, nil
-}
-
-// EncryptFile encrypts the source file and writes to destination
-func (m *Manager) EncryptFile(source, dest string) error {
-	plaintext, err := os.ReadFile(source)
+	keyring, err := LoadKeyring(keyFile, passphrase)
 	if err != nil {
-		return fmt.Errorf("error reading source file: %w", err)
+		return nil, err
 	}
+	if err := m.useKeyring(keyring); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
 
-	block, err := aes.NewCipher(m.key)
-	if err != nil {
-		return fmt.Errorf("error creating cipher: %w", err)
+// NewKeyringManager creates a new crypto manager encrypting with the active
+// key of a keyring
+func NewKeyringManager(keyring *Keyring) (*Manager, error) {
+	m := &Manager{}
+	if err := m.useKeyring(keyring); err != nil {
+		return nil, err
 	}
+	return m, nil
+}
 
-	gcm, err := cipher.NewGCM(block)
+func (m *Manager) useKeyring(keyring *Keyring) error {
+	names, err := newSIV(keyring.Names)
 	if err != nil {
-		return fmt.Errorf("error creating GCM: %w", err)
+		return err
 	}
+	m.keyring = keyring
+	m.names = names
+	return nil
+}
 
-	nonce := make([]byte, gcm.NonceSize())
-	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
-		return fmt.Errorf("error generating nonce: %w", err)
+// ActiveKey returns the ID of the key new files are encrypted with, or ""
+// without a keyring
+func (m *Manager) ActiveKey() string {
+	if m.keyring == nil {
+		return ""
 	}
+	return m.keyring.Active
+}
 
-	ciphertext := gcm.Seal(nonce, nonce, plaintext, nil)
-	if err := os.WriteFile(dest, ciphertext, 0644); err != nil {
-		return fmt.Errorf("error writing encrypted file: %w", err)
-	}
+// HasNameKey reports whether names can be encrypted, which takes a
+// symmetric key; public keys alone are not enough
+func (m *Manager) HasNameKey() bool {
+	return m.names != nil
+}
 
-	return nil
+// HasKeyring reports whether metadata can be encrypted and decrypted, which
+// takes a symmetric key as well
+func (m *Manager) HasKeyring() bool {
+	return m.keyring != nil
 }
 
-// DecryptFile decrypts the source file and writes to destination
-func (m *Manager) DecryptFile(source, dest string) error {
-	ciphertext, err := os.ReadFile(source)
+// EncryptFile encrypts the source file and writes to destination, binding
+// it to path
+func (m *Manager) EncryptFile(source, dest, path string) error {
+	err := transformFile(source, dest, func(w io.Writer, r io.Reader) error {
+		return m.Encrypt(w, r, path)
+	})
 	if err != nil {
-		return fmt.Errorf("error reading encrypted file: %w", err)
+		return fmt.Errorf("error encrypting file: %w", err)
 	}
+	return nil
+}
 
-	block, err := aes.NewCipher(m.key)
+// DecryptFile decrypts the source file encrypted for path and writes to
+// destination. The destination is only replaced once the whole file was
+// authenticated.
+func (m *Manager) DecryptFile(source, dest, path string) error {
+	err := transformFile(source, dest, func(w io.Writer, r io.Reader) error {
+		return m.Decrypt(w, r, path)
+	})
 	if err != nil {
-		return fmt.Errorf("error creating cipher: %w", err)
+		return fmt.Errorf("error decrypting file: %w", err)
 	}
+	return nil
+}
+
+// EncryptReader returns the encrypted form of src, bound to path, as a
+// stream. Closing it stops reading from src.
+func (m *Manager) EncryptReader(src io.Reader, path string) io.ReadCloser {
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(m.Encrypt(w, src, path))
+	}()
+	return r
+}
 
-	gcm, err := cipher.NewGCM(block)
+// DecryptToFile decrypts src, encrypted for path, into dest. The
+// destination is only replaced once the whole stream was authenticated.
+func (m *Manager) DecryptToFile(src io.Reader, dest, path string) error {
+	err := writeAtomic(dest, src, func(w io.Writer, r io.Reader) error {
+		return m.Decrypt(w, r, path)
+	})
 	if err != nil {
-		return fmt.Errorf("error creating GCM: %w", err)
+		return fmt.Errorf("error decrypting file: %w", err)
 	}
+	return nil
+}
 
-	nonceSize := gcm.NonceSize()
-	if len(ciphertext) < nonceSize {
-		return fmt.Errorf("ciphertext too short")
+// transformFile streams source through fn into a temporary file that
+// replaces dest when fn succeeds
+func transformFile(source, dest string, fn func(io.Writer, io.Reader) error) error {
+	in, err := os.Open(source)
+	if err != nil {
+		return err
 	}
+	defer in.Close()
+	return writeAtomic(dest, in, fn)
+}
 
-	nonce, ciphertext := ciphertext[:nonceSize], ciphertext[nonceSize:]
-	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+// writeAtomic streams r through fn into a temporary file that replaces dest
+// when fn succeeds
+func writeAtomic(dest string, r io.Reader, fn func(io.Writer, io.Reader) error) error {
+	file, err := utils.CreateAtomic(dest, 0644)
 	if err != nil {
-		return fmt.Errorf("error decrypting file: %w", err)
+		return err
 	}
+	defer file.Abort()
 
-	if err := os.WriteFile(dest, plaintext, 0644); err != nil {
-		return fmt.Errorf("error writing decrypted file: %w", err)
+	out := bufio.NewWriter(file)
+	if err := fn(out, r); err != nil {
+		return err
 	}
-
-	return nil
+	if err := out.Flush(); err != nil {
+		return err
+	}
+	return file.Commit()
 }
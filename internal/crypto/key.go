@@ -0,0 +1,214 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/hkdf"
+)
+
+// KeySize is the size of generated and derived keys
+const KeySize = 32
+
+// A key file holds either the raw key or, for passphrase keys, the
+// parameters to derive it with Argon2id. Passphrase key files hold no
+// secret, only a check value to tell a wrong passphrase from a damaged
+// file.
+//
+// Passphrase key file layout:
+//
+//	magic    9 bytes  "GOSYNCKEY"
+//	version  1 byte   1
+//	time     4 bytes  big endian, Argon2id passes
+//	memory   4 bytes  big endian, Argon2id memory in KiB
+//	threads  1 byte   Argon2id parallelism
+//	salt     16 bytes
+//	check    32 bytes
+const (
+	keyFileMagic   = "GOSYNCKEY"
+	keyFileVersion = 1
+
+	passphraseSaltSize = 16
+	keyCheckSize       = 32
+	keyFileSize        = len(keyFileMagic) + 1 + 4 + 4 + 1 + passphraseSaltSize + keyCheckSize
+
+	// Argon2id parameters for new passphrase keys
+	argonTime    = 3
+	argonMemory  = 64 << 10
+	argonThreads = 4
+	// maxArgonMemory bounds the memory accepted from key files
+	maxArgonMemory = 4 << 20
+)
+
+// ErrWrongPassphrase is returned when a passphrase does not match its key
+// file
+var ErrWrongPassphrase = errors.New("wrong passphrase")
+
+// PassphraseFunc asks for the passphrase of a key file
+type PassphraseFunc func() ([]byte, error)
+
+// passphraseParams describes how a key is derived from a passphrase
+type passphraseParams struct {
+	time    uint32
+	memory  uint32
+	threads uint8
+	salt    [passphraseSaltSize]byte
+	check   [keyCheckSize]byte
+}
+
+func (p *passphraseParams) marshal() []byte {
+	buf := make([]byte, 0, keyFileSize)
+	buf = append(buf, keyFileMagic...)
+	buf = append(buf, keyFileVersion)
+	buf = binary.BigEndian.AppendUint32(buf, p.time)
+	buf = binary.BigEndian.AppendUint32(buf, p.memory)
+	buf = append(buf, p.threads)
+	buf = append(buf, p.salt[:]...)
+	return append(buf, p.check[:]...)
+}
+
+func parsePassphraseParams(buf []byte) (*passphraseParams, error) {
+	if len(buf) != keyFileSize {
+		return nil, fmt.Errorf("invalid passphrase key file")
+	}
+	if version := buf[len(keyFileMagic)]; version != keyFileVersion {
+		return nil, fmt.Errorf("unsupported key file version %d", version)
+	}
+	buf = buf[len(keyFileMagic)+1:]
+	p := &passphraseParams{
+		time:    binary.BigEndian.Uint32(buf),
+		memory:  binary.BigEndian.Uint32(buf[4:]),
+		threads: buf[8],
+	}
+	if p.time == 0 || p.threads == 0 || p.memory == 0 || p.memory > maxArgonMemory {
+		return nil, fmt.Errorf("invalid key derivation parameters")
+	}
+	copy(p.salt[:], buf[9:])
+	copy(p.check[:], buf[9+passphraseSaltSize:])
+	return p, nil
+}
+
+// derive computes the key and its check value from a passphrase
+func (p *passphraseParams) derive(passphrase []byte) ([]byte, []byte, error) {
+	key := argon2.IDKey(passphrase, p.salt[:], p.time, p.memory, p.threads, KeySize)
+	check := make([]byte, keyCheckSize)
+	kdf := hkdf.New(sha256.New, key, nil, []byte("gosync key check"))
+	if _, err := io.ReadFull(kdf, check); err != nil {
+		return nil, nil, fmt.Errorf("error deriving key check: %w", err)
+	}
+	return key, check, nil
+}
+
+// GenerateKey returns a new random key
+func GenerateKey() ([]byte, error) {
+	key := make([]byte, KeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, fmt.Errorf("error generating key: %w", err)
+	}
+	return key, nil
+}
+
+// WriteKeyFile writes a new random key to path, readable only by its owner
+func WriteKeyFile(path string) error {
+	key, err := GenerateKey()
+	if err != nil {
+		return err
+	}
+	return writeKeyFile(path, key)
+}
+
+// WritePassphraseKeyFile writes a key file to path whose key is derived
+// from passphrase
+func WritePassphraseKeyFile(path string, passphrase []byte) error {
+	if len(passphrase) == 0 {
+		return fmt.Errorf("empty passphrase")
+	}
+	p := &passphraseParams{time: argonTime, memory: argonMemory, threads: argonThreads}
+	if _, err := io.ReadFull(rand.Reader, p.salt[:]); err != nil {
+		return fmt.Errorf("error generating salt: %w", err)
+	}
+	_, check, err := p.derive(passphrase)
+	if err != nil {
+		return err
+	}
+	copy(p.check[:], check)
+	return writeKeyFile(path, p.marshal())
+}
+
+// writeKeyFile creates path with mode 0600, refusing to overwrite an
+// existing key
+func writeKeyFile(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("error creating key directory: %w", err)
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("error creating key file: %w", err)
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		os.Remove(path)
+		return fmt.Errorf("error writing key file: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(path)
+		return fmt.Errorf("error writing key file: %w", err)
+	}
+	return nil
+}
+
+// IsPassphraseKeyFile reports whether the key file at path derives its key
+// from a passphrase
+func IsPassphraseKeyFile(path string) (bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false, fmt.Errorf("error reading key file: %w", err)
+	}
+	return bytes.HasPrefix(data, []byte(keyFileMagic)), nil
+}
+
+// LoadKey reads the key from a key file. Passphrase key files ask
+// passphrase for the passphrase.
+func LoadKey(path string, passphrase PassphraseFunc) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading key file: %w", err)
+	}
+
+	if !bytes.HasPrefix(data, []byte(keyFileMagic)) {
+		switch len(data) {
+		case 16, 24, 32:
+			return data, nil
+		}
+		return nil, fmt.Errorf("key file %s holds %d bytes, expected a 16, 24 or 32 byte key (create one with gosync keygen)", path, len(data))
+	}
+
+	p, err := parsePassphraseParams(data)
+	if err != nil {
+		return nil, fmt.Errorf("error reading key file %s: %w", path, err)
+	}
+	if passphrase == nil {
+		return nil, fmt.Errorf("key file %s requires a passphrase", path)
+	}
+	secret, err := passphrase()
+	if err != nil {
+		return nil, fmt.Errorf("error reading passphrase: %w", err)
+	}
+	key, check, err := p.derive(secret)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(check, p.check[:]) {
+		return nil, ErrWrongPassphrase
+	}
+	return key, nil
+}
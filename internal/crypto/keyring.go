@@ -0,0 +1,176 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+
+	"gosync/pkg/utils"
+)
+
+// keyringVersion is bumped whenever the keyring file format changes
+const keyringVersion = 1
+
+// Keyring holds every key files may have been encrypted with. New files are
+// encrypted with the active key, and the others are kept to decrypt older
+// files until they were rotated.
+type Keyring struct {
+	Version int          `json:"version"`
+	Active  string       `json:"active"`
+	Keys    []KeyringKey `json:"keys"`
+	// Names is the key of encrypted names. It stays the same when the
+	// active key changes, so rotating keys never renames anything.
+	Names []byte `json:"names"`
+
+	// passphrase is set for keyrings made from a passphrase key file,
+	// which cannot be stored without giving away the derived key
+	passphrase bool
+}
+
+// KeyringKey is a single key of a keyring
+type KeyringKey struct {
+	ID      string    `json:"id"`
+	Key     []byte    `json:"key"`
+	Created time.Time `json:"created"`
+}
+
+// keyID identifies a key in the headers of encrypted files without
+// revealing anything about it
+func keyID(key []byte) string {
+	id := make([]byte, keyIDSize)
+	kdf := hkdf.New(sha256.New, key, nil, []byte("gosync key id"))
+	io.ReadFull(kdf, id)
+	return hex.EncodeToString(id)
+}
+
+// deriveNameKey derives the key of encrypted names from a key
+func deriveNameKey(key []byte) ([]byte, error) {
+	nameKey := make([]byte, 64)
+	kdf := hkdf.New(sha256.New, key, nil, []byte("gosync names v1"))
+	if _, err := io.ReadFull(kdf, nameKey); err != nil {
+		return nil, fmt.Errorf("error deriving name key: %w", err)
+	}
+	return nameKey, nil
+}
+
+// LoadKeyring reads a key file. Key files holding a single key, random or
+// derived from a passphrase, give a keyring with just that key.
+func LoadKeyring(path string, passphrase PassphraseFunc) (*Keyring, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading key file: %w", err)
+	}
+
+	if bytes.HasPrefix(data, []byte("{")) && json.Valid(data) {
+		keyring := &Keyring{}
+		if err := json.Unmarshal(data, keyring); err != nil {
+			return nil, fmt.Errorf("error parsing keyring %s: %w", path, err)
+		}
+		if err := keyring.check(); err != nil {
+			return nil, fmt.Errorf("invalid keyring %s: %w", path, err)
+		}
+		return keyring, nil
+	}
+
+	if isIdentity(data) {
+		return nil, fmt.Errorf("key file %s holds an X25519 identity, not a keyring", path)
+	}
+	key, err := LoadKey(path, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	names, err := deriveNameKey(key)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading key file: %w", err)
+	}
+	id := keyID(key)
+	return &Keyring{
+		Version:    keyringVersion,
+		Active:     id,
+		Keys:       []KeyringKey{{ID: id, Key: key, Created: info.ModTime()}},
+		Names:      names,
+		passphrase: bytes.HasPrefix(data, []byte(keyFileMagic)),
+	}, nil
+}
+
+// check validates a keyring read from a file
+func (k *Keyring) check() error {
+	if k.Version != keyringVersion {
+		return fmt.Errorf("unsupported keyring version %d", k.Version)
+	}
+	if len(k.Names) != 64 {
+		return fmt.Errorf("missing name key")
+	}
+	for _, key := range k.Keys {
+		switch len(key.Key) {
+		case 16, 24, 32:
+		default:
+			return fmt.Errorf("key %s holds %d bytes", key.ID, len(key.Key))
+		}
+		if keyID(key.Key) != key.ID {
+			return fmt.Errorf("key %s does not match its ID", key.ID)
+		}
+	}
+	if k.key(k.Active) == nil {
+		return fmt.Errorf("active key %s is missing", k.Active)
+	}
+	return nil
+}
+
+// key returns the key with the given ID, or nil if there is none
+func (k *Keyring) key(id string) []byte {
+	for _, key := range k.Keys {
+		if key.ID == id {
+			return key.Key
+		}
+	}
+	return nil
+}
+
+// Rotate adds a new random key and makes it the active one
+func (k *Keyring) Rotate() (string, error) {
+	key, err := GenerateKey()
+	if err != nil {
+		return "", err
+	}
+	id := keyID(key)
+	k.Keys = append(k.Keys, KeyringKey{ID: id, Key: key, Created: time.Now()})
+	k.Active = id
+	return id, nil
+}
+
+// Save replaces the key file at path with the keyring, readable only by its
+// owner
+func (k *Keyring) Save(path string) error {
+	if k.passphrase {
+		return fmt.Errorf("keys derived from a passphrase cannot be stored in a keyring")
+	}
+	data, err := json.MarshalIndent(k, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding keyring: %w", err)
+	}
+
+	file, err := utils.CreateAtomic(path, 0600)
+	if err != nil {
+		return fmt.Errorf("error writing keyring: %w", err)
+	}
+	defer file.Abort()
+	if _, err := file.Write(data); err != nil {
+		return fmt.Errorf("error writing keyring: %w", err)
+	}
+	if err := file.Commit(); err != nil {
+		return fmt.Errorf("error writing keyring: %w", err)
+	}
+	return nil
+}
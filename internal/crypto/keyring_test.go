@@ -0,0 +1,144 @@
+package crypto
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// encryptWith encrypts data for path with the active key of m
+func encryptWith(t *testing.T, m *Manager, data []byte, path string) []byte {
+	t.Helper()
+	var encrypted bytes.Buffer
+	if err := m.Encrypt(&encrypted, bytes.NewReader(data), path); err != nil {
+		t.Fatal(err)
+	}
+	return encrypted.Bytes()
+}
+
+// contentHash hashes an encrypted file like the manifest records it
+func contentHash(encrypted []byte) []byte {
+	hash := NewContentHash()
+	hash.Write(encrypted)
+	return hash.Sum()
+}
+
+func TestKeyringRotate(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "master.key")
+	if err := WriteKeyFile(keyFile); err != nil {
+		t.Fatal(err)
+	}
+	keyring, err := LoadKeyring(keyFile, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldID := keyring.Active
+	old, err := NewKeyringManager(keyring)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext := bytes.Repeat([]byte("rotate "), 20000)
+	encrypted := encryptWith(t, old, plaintext, "dir/file")
+
+	newID, err := keyring.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newID == oldID || keyring.Active != newID {
+		t.Fatalf("active key %s after rotating from %s to %s", keyring.Active, oldID, newID)
+	}
+	if err := keyring.Save(keyFile); err != nil {
+		t.Fatal(err)
+	}
+	rotated, err := NewManager(keyFile, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotated.ActiveKey() != newID {
+		t.Fatalf("saved keyring has active key %s, want %s", rotated.ActiveKey(), newID)
+	}
+	// Names stay encrypted the same way
+	if rotated.EncryptName(".", "file") != old.EncryptName(".", "file") {
+		t.Error("rotating changed the encrypted names")
+	}
+
+	if current, err := rotated.Current(bytes.NewReader(encrypted)); err != nil || current {
+		t.Errorf("Current of a file of the old key = %v, %v", current, err)
+	}
+	var rewrapped bytes.Buffer
+	if err := rotated.Rewrap(&rewrapped, bytes.NewReader(encrypted), "dir/file"); err != nil {
+		t.Fatal(err)
+	}
+	if current, err := rotated.Current(bytes.NewReader(rewrapped.Bytes())); err != nil || !current {
+		t.Errorf("Current of a rewrapped file = %v, %v", current, err)
+	}
+	if !bytes.Equal(contentHash(rewrapped.Bytes()), contentHash(encrypted)) {
+		t.Error("rewrapping changed the content hash")
+	}
+
+	// Without the old key, only the rewrapped file can be decrypted
+	newOnly := *rotated.keyring
+	newOnly.Keys = []KeyringKey{{ID: newID, Key: rotated.key(newID)}}
+	m, err := NewKeyringManager(&newOnly)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decrypted bytes.Buffer
+	if err := m.Decrypt(&decrypted, bytes.NewReader(rewrapped.Bytes()), "dir/file"); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted.Bytes(), plaintext) {
+		t.Errorf("decrypted %d bytes, want the %d encrypted", decrypted.Len(), len(plaintext))
+	}
+	if err := m.Decrypt(&bytes.Buffer{}, bytes.NewReader(encrypted), "dir/file"); err != ErrUnknownKey {
+		t.Errorf("Decrypt without its key: %v, want ErrUnknownKey", err)
+	}
+}
+
+func TestLoadKeyringInvalid(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "master.key")
+	if err := WriteKeyFile(keyFile); err != nil {
+		t.Fatal(err)
+	}
+	keyring, err := LoadKeyring(keyFile, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keyring.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(k *Keyring)
+		want   string
+	}{
+		{name: "version", modify: func(k *Keyring) { k.Version++ }, want: "version"},
+		{name: "key ID", modify: func(k *Keyring) { k.Keys[0].ID = k.Keys[1].ID }, want: "does not match its ID"},
+		{name: "key size", modify: func(k *Keyring) { k.Keys[0].Key = k.Keys[0].Key[:20] }, want: "holds 20 bytes"},
+		{name: "active key", modify: func(k *Keyring) { k.Active = strings.Repeat("0", 2*keyIDSize) }, want: "missing"},
+		{name: "name key", modify: func(k *Keyring) { k.Names = nil }, want: "name key"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			modified := *keyring
+			modified.Keys = append([]KeyringKey{}, keyring.Keys...)
+			tt.modify(&modified)
+			data, err := json.Marshal(&modified)
+			if err != nil {
+				t.Fatal(err)
+			}
+			path := filepath.Join(t.TempDir(), "keyring")
+			if err := os.WriteFile(path, data, 0600); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := LoadKeyring(path, nil); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("LoadKeyring: %v, want an error about %s", err, tt.want)
+			}
+		})
+	}
+}
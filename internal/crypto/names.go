@@ -0,0 +1,52 @@
+package crypto
+
+import (
+	"encoding/base32"
+	"strings"
+)
+
+// nameEncoding encodes encrypted names with lower case letters and digits
+// only, which every filesystem accepts and case-insensitive ones preserve
+var nameEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+// Associated data separating encrypted names from encrypted link targets
+var (
+	nameData = []byte("name")
+	linkData = []byte("link")
+)
+
+// EncryptName encrypts a single path component of the directory parent, a
+// slash-separated plaintext path that is "." for the root. The same name
+// always gives the same result in the same directory, so files keep their
+// encrypted names between runs, while equal names in different directories
+// cannot be told apart.
+func (m *Manager) EncryptName(parent, name string) string {
+	return nameEncoding.EncodeToString(m.names.seal([]byte(name), nameData, []byte(parent)))
+}
+
+// DecryptName reverses EncryptName
+func (m *Manager) DecryptName(parent, name string) (string, error) {
+	return m.decrypt(name, nameData, []byte(parent))
+}
+
+// EncryptLink encrypts the target of a symlink
+func (m *Manager) EncryptLink(link string) string {
+	return nameEncoding.EncodeToString(m.names.seal([]byte(link), linkData))
+}
+
+// DecryptLink reverses EncryptLink
+func (m *Manager) DecryptLink(link string) (string, error) {
+	return m.decrypt(link, linkData)
+}
+
+func (m *Manager) decrypt(encoded string, ad ...[]byte) (string, error) {
+	ciphertext, err := nameEncoding.DecodeString(strings.ToLower(encoded))
+	if err != nil {
+		return "", ErrAuthentication
+	}
+	plaintext, err := m.names.open(ciphertext, ad...)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
@@ -0,0 +1,52 @@
+package crypto
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// testManager creates a manager with a fresh random key
+func testManager(t *testing.T) *Manager {
+	t.Helper()
+	keyFile := filepath.Join(t.TempDir(), "master.key")
+	if err := WriteKeyFile(keyFile); err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewManager(keyFile, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestEncryptName(t *testing.T) {
+	m := testManager(t)
+
+	tests := []struct {
+		parent, name string
+	}{
+		{".", "report.pdf"},
+		{"docs", "report.pdf"},
+		{"docs/old", "report.pdf"},
+		{"docs", "Report.pdf"},
+	}
+	seen := make(map[string]string)
+	for _, tt := range tests {
+		encrypted := m.EncryptName(tt.parent, tt.name)
+		if again := m.EncryptName(tt.parent, tt.name); again != encrypted {
+			t.Errorf("%s/%s encrypted to %s, then %s", tt.parent, tt.name, encrypted, again)
+		}
+		if other, ok := seen[encrypted]; ok {
+			t.Errorf("%s/%s and %s encrypted to the same name", tt.parent, tt.name, other)
+		}
+		seen[encrypted] = tt.parent + "/" + tt.name
+
+		name, err := m.DecryptName(tt.parent, encrypted)
+		if err != nil || name != tt.name {
+			t.Errorf("DecryptName(%q) = %q, %v, want %q", encrypted, name, err, tt.name)
+		}
+		if _, err := m.DecryptName(tt.parent+"/x", encrypted); err != ErrAuthentication {
+			t.Errorf("decrypting %s/%s in another directory: %v, want ErrAuthentication", tt.parent, tt.name, err)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+// Public and private X25519 keys are written as text with these prefixes,
+// followed by the key in the encoding of encrypted names
+const (
+	recipientPrefix = "gosync-pub-"
+	identityPrefix  = "gosync-secret-"
+
+	// wrapRecipient marks data keys wrapped for an X25519 recipient
+	wrapRecipient = 2
+)
+
+// Recipient is an X25519 public key files can be encrypted to. Only the
+// holder of the matching identity can decrypt them.
+type Recipient struct {
+	key [curve25519.PointSize]byte
+}
+
+// ParseRecipient parses a public key as printed by gosync keygen -x25519
+func ParseRecipient(s string) (*Recipient, error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, recipientPrefix) {
+		return nil, fmt.Errorf("invalid recipient %q: missing %s prefix", s, recipientPrefix)
+	}
+	key, err := nameEncoding.DecodeString(strings.TrimPrefix(s, recipientPrefix))
+	if err != nil || len(key) != curve25519.PointSize {
+		return nil, fmt.Errorf("invalid recipient %q", s)
+	}
+	r := &Recipient{}
+	copy(r.key[:], key)
+	return r, nil
+}
+
+func (r *Recipient) String() string {
+	return recipientPrefix + nameEncoding.EncodeToString(r.key[:])
+}
+
+// id identifies the recipient in the headers of encrypted files
+func (r *Recipient) id() [keyIDSize]byte {
+	var id [keyIDSize]byte
+	sum := sha256.Sum256(append([]byte("gosync recipient"), r.key[:]...))
+	copy(id[:], sum[:])
+	return id
+}
+
+// Identity is an X25519 private key, decrypting files encrypted to its
+// recipient
+type Identity struct {
+	secret    [curve25519.ScalarSize]byte
+	recipient *Recipient
+}
+
+// GenerateIdentity creates a new random identity
+func GenerateIdentity() (*Identity, error) {
+	secret := make([]byte, curve25519.ScalarSize)
+	if _, err := io.ReadFull(rand.Reader, secret); err != nil {
+		return nil, fmt.Errorf("error generating key: %w", err)
+	}
+	return newIdentity(secret)
+}
+
+func newIdentity(secret []byte) (*Identity, error) {
+	public, err := curve25519.X25519(secret, curve25519.Basepoint)
+	if err != nil {
+		return nil, fmt.Errorf("error computing public key: %w", err)
+	}
+	id := &Identity{recipient: &Recipient{}}
+	copy(id.secret[:], secret)
+	copy(id.recipient.key[:], public)
+	return id, nil
+}
+
+// Recipient returns the public key of the identity
+func (id *Identity) Recipient() *Recipient {
+	return id.recipient
+}
+
+func (id *Identity) String() string {
+	return identityPrefix + nameEncoding.EncodeToString(id.secret[:])
+}
+
+// WriteIdentityFile writes a new identity to path, readable only by its
+// owner, and returns it
+func WriteIdentityFile(path string) (*Identity, error) {
+	id, err := GenerateIdentity()
+	if err != nil {
+		return nil, err
+	}
+	if err := writeKeyFile(path, []byte(id.String()+"\n")); err != nil {
+		return nil, err
+	}
+	return id, nil
+}
+
+// isIdentity reports whether the contents of a key file are an identity
+func isIdentity(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(identityPrefix))
+}
+
+// LoadIdentity reads an identity file
+func LoadIdentity(path string) (*Identity, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading key file: %w", err)
+	}
+	return parseIdentity(data)
+}
+
+func parseIdentity(data []byte) (*Identity, error) {
+	s := strings.TrimSpace(string(data))
+	secret, err := nameEncoding.DecodeString(strings.TrimPrefix(s, identityPrefix))
+	if !strings.HasPrefix(s, identityPrefix) || err != nil || len(secret) != curve25519.ScalarSize {
+		return nil, fmt.Errorf("invalid identity")
+	}
+	return newIdentity(secret)
+}
+
+// wrapForRecipient wraps a data key with a secret only the recipient can
+// compute: an X25519 exchange with a new ephemeral key, whose public half is
+// stored along with the wrapped key
+func wrapForRecipient(r *Recipient, h *streamHeader, dataKey []byte) (wrappedKey, error) {
+	ephemeral, err := GenerateIdentity()
+	if err != nil {
+		return wrappedKey{}, err
+	}
+	shared, err := curve25519.X25519(ephemeral.secret[:], r.key[:])
+	if err != nil {
+		return wrappedKey{}, fmt.Errorf("error wrapping key for %s: %w", r, err)
+	}
+	aead, err := newAEAD(shared, append(ephemeral.recipient.key[:], r.key[:]...), "gosync x25519 v3")
+	if err != nil {
+		return wrappedKey{}, err
+	}
+
+	// The wrapping key is never reused, so a zero nonce is safe
+	nonce := make([]byte, aead.NonceSize())
+	body := append([]byte{}, ephemeral.recipient.key[:]...)
+	body = aead.Seal(body, nonce, dataKey, h.prefix())
+	return wrappedKey{kind: wrapRecipient, id: r.id(), body: body}, nil
+}
+
+// unwrap reverses wrapForRecipient
+func (id *Identity) unwrap(h *streamHeader, w wrappedKey) ([]byte, error) {
+	if len(w.body) < curve25519.PointSize {
+		return nil, ErrAuthentication
+	}
+	ephemeral := w.body[:curve25519.PointSize]
+	shared, err := curve25519.X25519(id.secret[:], ephemeral)
+	if err != nil {
+		return nil, ErrAuthentication
+	}
+	aead, err := newAEAD(shared, append(append([]byte{}, ephemeral...), id.recipient.key[:]...), "gosync x25519 v3")
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	dataKey, err := aead.Open(nil, nonce, w.body[curve25519.PointSize:], h.prefix())
+	if err != nil || len(dataKey) != dataKeySize {
+		return nil, ErrAuthentication
+	}
+	return dataKey, nil
+}
@@ -0,0 +1,124 @@
+package crypto
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+)
+
+// testIdentity creates a manager holding a fresh identity
+func testIdentity(t *testing.T) (*Manager, *Identity) {
+	t.Helper()
+	keyFile := filepath.Join(t.TempDir(), "identity.key")
+	id, err := WriteIdentityFile(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewManager(keyFile, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m, id
+}
+
+func TestRecipients(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "master.key")
+	if err := WriteKeyFile(keyFile); err != nil {
+		t.Fatal(err)
+	}
+	keyring, err := NewManager(keyFile, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	owner, id := testIdentity(t)
+	other, _ := testIdentity(t)
+
+	recipient, err := ParseRecipient(id.Recipient().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recipient.key != id.Recipient().key {
+		t.Fatalf("%s parsed as %s", id.Recipient(), recipient)
+	}
+	sender, err := NewManager("", []string{recipient.String()}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A keyring holder may add recipients to files it can read itself
+	both, err := NewManager(keyFile, []string{recipient.String()}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		encrypter *Manager
+		decrypter *Manager
+		want      error
+	}{
+		{name: "identity", encrypter: sender, decrypter: owner},
+		{name: "other identity", encrypter: sender, decrypter: other, want: ErrUnknownKey},
+		{name: "recipient only", encrypter: sender, decrypter: sender, want: ErrUnknownKey},
+		{name: "keyring without recipient", encrypter: sender, decrypter: keyring, want: ErrUnknownKey},
+		{name: "keyring and identity, read by identity", encrypter: both, decrypter: owner},
+		{name: "keyring and identity, read by keyring", encrypter: both, decrypter: keyring},
+		{name: "keyring only, read by identity", encrypter: keyring, decrypter: owner, want: ErrUnknownKey},
+	}
+
+	plaintext := bytes.Repeat([]byte("secret "), 20000)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var encrypted bytes.Buffer
+			if err := tt.encrypter.Encrypt(&encrypted, bytes.NewReader(plaintext), "file"); err != nil {
+				t.Fatal(err)
+			}
+			var decrypted bytes.Buffer
+			err := tt.decrypter.Decrypt(&decrypted, bytes.NewReader(encrypted.Bytes()), "file")
+			if err != tt.want {
+				t.Fatalf("Decrypt: %v, want %v", err, tt.want)
+			}
+			if err == nil && !bytes.Equal(decrypted.Bytes(), plaintext) {
+				t.Errorf("decrypted %d bytes, want the %d encrypted", decrypted.Len(), len(plaintext))
+			}
+		})
+	}
+}
+
+func TestRecipientWrappedKeyTampered(t *testing.T) {
+	owner, id := testIdentity(t)
+	sender, err := NewManager("", []string{id.Recipient().String()}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var encrypted bytes.Buffer
+	if err := sender.Encrypt(&encrypted, bytes.NewReader([]byte("data")), "file"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The last byte of the header is the tag of the wrapped key
+	start, end, ok := wrappedKeys(encrypted.Bytes())
+	if !ok || end <= start {
+		t.Fatal("no wrapped keys in the header")
+	}
+	tampered := bytes.Clone(encrypted.Bytes())
+	tampered[end-1] ^= 1
+	if err := owner.Decrypt(&bytes.Buffer{}, bytes.NewReader(tampered), "file"); err != ErrAuthentication {
+		t.Errorf("Decrypt with a modified wrapped key: %v, want ErrAuthentication", err)
+	}
+}
+
+func TestParseRecipientInvalid(t *testing.T) {
+	_, id := testIdentity(t)
+	valid := id.Recipient().String()
+	for _, s := range []string{
+		"",
+		valid[len(recipientPrefix):],
+		valid[:len(valid)-2],
+		recipientPrefix + "!!!!",
+		id.String(),
+	} {
+		if _, err := ParseRecipient(s); err == nil {
+			t.Errorf("ParseRecipient(%q) succeeded", s)
+		}
+	}
+}
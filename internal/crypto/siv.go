@@ -0,0 +1,139 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"fmt"
+)
+
+// siv implements deterministic authenticated encryption with AES-SIV
+// (RFC 5297). Equal inputs give equal outputs, which is what makes
+// encrypted names stable between runs.
+type siv struct {
+	mac cipher.Block
+	ctr cipher.Block
+}
+
+// newSIV creates an AES-SIV cipher from a key twice the size of an AES key,
+// the first half for the MAC and the second for encryption
+func newSIV(key []byte) (*siv, error) {
+	half := len(key) / 2
+	mac, err := aes.NewCipher(key[:half])
+	if err != nil {
+		return nil, fmt.Errorf("error creating cipher: %w", err)
+	}
+	ctr, err := aes.NewCipher(key[half:])
+	if err != nil {
+		return nil, fmt.Errorf("error creating cipher: %w", err)
+	}
+	return &siv{mac: mac, ctr: ctr}, nil
+}
+
+// seal returns the synthetic IV followed by the ciphertext
+func (s *siv) seal(plaintext []byte, ad ...[]byte) []byte {
+	v := s.s2v(plaintext, ad)
+	out := make([]byte, aes.BlockSize+len(plaintext))
+	copy(out, v[:])
+	s.xorStream(out[aes.BlockSize:], plaintext, v)
+	return out
+}
+
+// open authenticates and decrypts the output of seal
+func (s *siv) open(ciphertext []byte, ad ...[]byte) ([]byte, error) {
+	if len(ciphertext) < aes.BlockSize {
+		return nil, ErrAuthentication
+	}
+	var v [aes.BlockSize]byte
+	copy(v[:], ciphertext)
+	plaintext := make([]byte, len(ciphertext)-aes.BlockSize)
+	s.xorStream(plaintext, ciphertext[aes.BlockSize:], v)
+
+	expected := s.s2v(plaintext, ad)
+	if subtle.ConstantTimeCompare(expected[:], v[:]) != 1 {
+		return nil, ErrAuthentication
+	}
+	return plaintext, nil
+}
+
+// xorStream encrypts or decrypts with AES-CTR, using the synthetic IV with
+// two bits cleared as the counter
+func (s *siv) xorStream(dst, src []byte, v [aes.BlockSize]byte) {
+	v[8] &= 0x7f
+	v[12] &= 0x7f
+	cipher.NewCTR(s.ctr, v[:]).XORKeyStream(dst, src)
+}
+
+// s2v derives the synthetic IV from the associated data and the plaintext
+func (s *siv) s2v(plaintext []byte, ad [][]byte) [aes.BlockSize]byte {
+	var zero [aes.BlockSize]byte
+	d := s.cmac(zero[:])
+	for _, data := range ad {
+		d = dbl(d)
+		xorBlock(&d, s.cmac(data))
+	}
+
+	var t []byte
+	if len(plaintext) >= aes.BlockSize {
+		t = append([]byte{}, plaintext...)
+		end := t[len(t)-aes.BlockSize:]
+		for i := range end {
+			end[i] ^= d[i]
+		}
+	} else {
+		padded := dbl(d)
+		for i := range plaintext {
+			padded[i] ^= plaintext[i]
+		}
+		padded[len(plaintext)] ^= 0x80
+		t = padded[:]
+	}
+	return s.cmac(t)
+}
+
+// cmac computes AES-CMAC (RFC 4493) of a message
+func (s *siv) cmac(msg []byte) [aes.BlockSize]byte {
+	var l [aes.BlockSize]byte
+	s.mac.Encrypt(l[:], l[:])
+	k1 := dbl(l)
+	k2 := dbl(k1)
+
+	var x [aes.BlockSize]byte
+	for len(msg) > aes.BlockSize {
+		for i := range x {
+			x[i] ^= msg[i]
+		}
+		s.mac.Encrypt(x[:], x[:])
+		msg = msg[aes.BlockSize:]
+	}
+
+	var last [aes.BlockSize]byte
+	copy(last[:], msg)
+	if len(msg) == aes.BlockSize {
+		xorBlock(&last, k1)
+	} else {
+		last[len(msg)] = 0x80
+		xorBlock(&last, k2)
+	}
+	xorBlock(&x, last)
+	s.mac.Encrypt(x[:], x[:])
+	return x
+}
+
+// dbl multiplies a block by x in GF(2^128)
+func dbl(b [aes.BlockSize]byte) [aes.BlockSize]byte {
+	var out [aes.BlockSize]byte
+	carry := b[0] >> 7
+	for i := 0; i < aes.BlockSize-1; i++ {
+		out[i] = b[i]<<1 | b[i+1]>>7
+	}
+	out[aes.BlockSize-1] = b[aes.BlockSize-1] << 1
+	out[aes.BlockSize-1] ^= 0x87 & -carry
+	return out
+}
+
+func xorBlock(dst *[aes.BlockSize]byte, src [aes.BlockSize]byte) {
+	for i := range dst {
+		dst[i] ^= src[i]
+	}
+}
@@ -0,0 +1,81 @@
+package crypto
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// Test vectors of RFC 5297, appendix A
+func TestSIVVectors(t *testing.T) {
+	tests := []struct {
+		name       string
+		key        string
+		ad         []string
+		plaintext  string
+		ciphertext string
+	}{
+		{
+			name:       "A.1 deterministic",
+			key:        "fffefdfcfbfaf9f8f7f6f5f4f3f2f1f0f0f1f2f3f4f5f6f7f8f9fafbfcfdfeff",
+			ad:         []string{"101112131415161718191a1b1c1d1e1f2021222324252627"},
+			plaintext:  "112233445566778899aabbccddee",
+			ciphertext: "85632d07c6e8f37f950acd320a2ecc9340c02b9690c4dc04daef7f6afe5c",
+		},
+		{
+			name: "A.2 nonce-based",
+			key:  "7f7e7d7c7b7a79787776757473727170404142434445464748494a4b4c4d4e4f",
+			ad: []string{
+				"00112233445566778899aabbccddeeffdeaddadadeaddadaffeeddccbbaa99887766554433221100",
+				"102030405060708090a0",
+				"09f911029d74e35bd84156c5635688c0",
+			},
+			plaintext: "7468697320697320736f6d6520706c61696e7465787420746f20656e6372797074207573696e67205349562d414553",
+			ciphertext: "7bdb6e3b432667eb06f4d14bff2fbd0fcb900f2fddbe404326601965c889bf17" +
+				"dba77ceb094fa663b7a3f748ba8af829ea64ad544a272e9c485b62a3fd5c0d",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := newSIV(unhex(t, tt.key))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ad [][]byte
+			for _, data := range tt.ad {
+				ad = append(ad, unhex(t, data))
+			}
+			plaintext, want := unhex(t, tt.plaintext), unhex(t, tt.ciphertext)
+
+			if got := s.seal(plaintext, ad...); !bytes.Equal(got, want) {
+				t.Fatalf("seal = %x, want %x", got, want)
+			}
+			got, err := s.open(want, ad...)
+			if err != nil {
+				t.Fatalf("open: %v", err)
+			}
+			if !bytes.Equal(got, plaintext) {
+				t.Fatalf("open = %x, want %x", got, plaintext)
+			}
+
+			tampered := bytes.Clone(want)
+			tampered[len(tampered)-1] ^= 1
+			if _, err := s.open(tampered, ad...); err != ErrAuthentication {
+				t.Errorf("open of tampered ciphertext: %v, want ErrAuthentication", err)
+			}
+			if _, err := s.open(want, ad[:len(ad)-1]...); err != ErrAuthentication {
+				t.Errorf("open without the last associated data: %v, want ErrAuthentication", err)
+			}
+		})
+	}
+}
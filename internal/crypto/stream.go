@@ -0,0 +1,678 @@
+package crypto
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Encrypted files start with a header followed by a sequence of segments,
+// each sealed with AES-256-GCM following the STREAM construction: the nonce
+// is the segment counter plus a flag marking the last segment, so segments
+// cannot be reordered, dropped or truncated without failing authentication.
+// Every file has its own random data key, which the header carries wrapped
+// with a key of the keyring. Rotating keys only rewrites the header.
+// Segments also authenticate the path of the file relative to the
+// destination root, so files cannot be swapped with each other.
+//
+// Header layout:
+//
+//	magic        6 bytes  "GOSYNC"
+//	version      1 byte   4
+//	segment size 4 bytes  big endian, plaintext bytes per segment
+//	salt         32 bytes
+//	count        1 byte   number of wrapped data keys
+//
+// followed by the wrapped data keys:
+//
+//	type         1 byte   1 for keys of the keyring, 2 for X25519 recipients
+//	key ID       8 bytes  ID of the key or recipient the data key is
+//	                      wrapped for
+//	length       2 bytes  big endian
+//	wrapped key  length bytes
+//
+// Only the part up to the salt is authenticated with the segments, so the
+// wrapped keys can be replaced.
+const (
+	streamMagic = "GOSYNC"
+	// streamVersion is the version written by Encrypt
+	streamVersion = 4
+
+	// SegmentSize is the plaintext size of every segment but the last
+	SegmentSize = 64 << 10
+
+	saltSize    = 32
+	prefixSize  = len(streamMagic) + 1 + 4 + saltSize
+	dataKeySize = 32
+	keyIDSize   = 8
+	// maxSegmentSize bounds the segment size accepted from headers
+	maxSegmentSize = 16 << 20
+	// maxWrappedKeys and maxWrappedSize bound the wrapped keys accepted
+	// from headers
+	maxWrappedKeys = 64
+	maxWrappedSize = 1024
+
+	// wrapKeyring marks data keys wrapped with a key of the keyring
+	wrapKeyring = 1
+)
+
+// ErrAuthentication is returned when encrypted data was modified, truncated
+// or encrypted with another key
+var ErrAuthentication = errors.New("message authentication failed")
+
+// ErrUnknownKey is returned for files encrypted with none of the available
+// keys
+var ErrUnknownKey = errors.New("encrypted with a key that is not available")
+
+// streamHeader is the header of an encrypted file
+type streamHeader struct {
+	version     byte
+	segmentSize uint32
+	salt        [saltSize]byte
+	wrapped     []wrappedKey
+}
+
+// wrappedKey is the data key of a file, wrapped for one key
+type wrappedKey struct {
+	kind byte
+	id   [keyIDSize]byte
+	body []byte
+}
+
+// prefix returns the part of the header authenticated with every segment
+func (h *streamHeader) prefix() []byte {
+	buf := make([]byte, 0, prefixSize)
+	buf = append(buf, streamMagic...)
+	buf = append(buf, h.version)
+	buf = binary.BigEndian.AppendUint32(buf, h.segmentSize)
+	return append(buf, h.salt[:]...)
+}
+
+func (h *streamHeader) marshal() []byte {
+	buf := h.prefix()
+	buf = append(buf, byte(len(h.wrapped)))
+	for _, w := range h.wrapped {
+		buf = append(buf, w.kind)
+		buf = append(buf, w.id[:]...)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(w.body)))
+		buf = append(buf, w.body...)
+	}
+	return buf
+}
+
+// isStream reports whether in starts with the header of the segmented
+// format rather than a file of the single-shot format
+func isStream(in *bufio.Reader) (bool, error) {
+	buf, err := in.Peek(len(streamMagic))
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	return bytes.Equal(buf, []byte(streamMagic)), nil
+}
+
+// readStreamHeader reads the header from the start of in
+func readStreamHeader(in *bufio.Reader) (*streamHeader, error) {
+	buf := make([]byte, prefixSize)
+	if _, err := io.ReadFull(in, buf); err != nil {
+		return nil, ErrAuthentication
+	}
+	if string(buf[:len(streamMagic)]) != streamMagic {
+		return nil, fmt.Errorf("not an encrypted file")
+	}
+	h := &streamHeader{
+		version:     buf[len(streamMagic)],
+		segmentSize: binary.BigEndian.Uint32(buf[len(streamMagic)+1:]),
+	}
+	copy(h.salt[:], buf[len(streamMagic)+5:])
+	if h.version != streamVersion {
+		return nil, fmt.Errorf("unsupported encryption format version %d", h.version)
+	}
+	if h.segmentSize == 0 || h.segmentSize > maxSegmentSize {
+		return nil, fmt.Errorf("invalid segment size %d", h.segmentSize)
+	}
+
+	count, err := in.ReadByte()
+	if err != nil {
+		return nil, ErrAuthentication
+	}
+	if count == 0 || count > maxWrappedKeys {
+		return nil, fmt.Errorf("invalid number of wrapped keys %d", count)
+	}
+	for i := 0; i < int(count); i++ {
+		var w wrappedKey
+		fixed := make([]byte, 1+keyIDSize+2)
+		if _, err := io.ReadFull(in, fixed); err != nil {
+			return nil, ErrAuthentication
+		}
+		w.kind = fixed[0]
+		copy(w.id[:], fixed[1:])
+		size := binary.BigEndian.Uint16(fixed[1+keyIDSize:])
+		if size > maxWrappedSize {
+			return nil, fmt.Errorf("invalid wrapped key size %d", size)
+		}
+		w.body = make([]byte, size)
+		if _, err := io.ReadFull(in, w.body); err != nil {
+			return nil, ErrAuthentication
+		}
+		h.wrapped = append(h.wrapped, w)
+	}
+	return h, nil
+}
+
+// newAEAD creates an AES-GCM cipher with a key derived from secret
+func newAEAD(secret, salt []byte, info string) (cipher.AEAD, error) {
+	key := make([]byte, 32)
+	kdf := hkdf.New(sha256.New, secret, salt, []byte(info))
+	if _, err := io.ReadFull(kdf, key); err != nil {
+		return nil, fmt.Errorf("error deriving key: %w", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("error creating cipher: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("error creating GCM: %w", err)
+	}
+	return aead, nil
+}
+
+// wrapKey wraps a data key with a key of the keyring. The wrapped key is
+// bound to the header prefix of its file.
+func wrapKey(key []byte, h *streamHeader, dataKey []byte) (wrappedKey, error) {
+	aead, err := newAEAD(key, nil, "gosync wrap v3")
+	if err != nil {
+		return wrappedKey{}, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return wrappedKey{}, fmt.Errorf("error generating nonce: %w", err)
+	}
+	w := wrappedKey{kind: wrapKeyring, body: aead.Seal(nonce, nonce, dataKey, h.prefix())}
+	if _, err := hex.Decode(w.id[:], []byte(keyID(key))); err != nil {
+		return wrappedKey{}, fmt.Errorf("error encoding key ID: %w", err)
+	}
+	return w, nil
+}
+
+// unwrapKey reverses wrapKey
+func unwrapKey(key []byte, h *streamHeader, w wrappedKey) ([]byte, error) {
+	aead, err := newAEAD(key, nil, "gosync wrap v3")
+	if err != nil {
+		return nil, err
+	}
+	if len(w.body) < aead.NonceSize() {
+		return nil, ErrAuthentication
+	}
+	dataKey, err := aead.Open(nil, w.body[:aead.NonceSize()], w.body[aead.NonceSize():], h.prefix())
+	if err != nil || len(dataKey) != dataKeySize {
+		return nil, ErrAuthentication
+	}
+	return dataKey, nil
+}
+
+// dataKey unwraps the data key of a file with a key of the keyring or, if
+// identities is set, an identity
+func (m *Manager) dataKey(h *streamHeader, identities bool) ([]byte, error) {
+	for _, w := range h.wrapped {
+		switch w.kind {
+		case wrapKeyring:
+			if key := m.key(hex.EncodeToString(w.id[:])); key != nil {
+				return unwrapKey(key, h, w)
+			}
+		case wrapRecipient:
+			if !identities {
+				continue
+			}
+			for _, id := range m.identities {
+				if id.recipient.id() == w.id {
+					return id.unwrap(h, w)
+				}
+			}
+		}
+	}
+	return nil, ErrUnknownKey
+}
+
+// key returns the key of the keyring with the given ID, or nil
+func (m *Manager) key(id string) []byte {
+	if m.keyring == nil {
+		return nil
+	}
+	return m.keyring.key(id)
+}
+
+// keys returns every key of the keyring
+func (m *Manager) keys() []KeyringKey {
+	if m.keyring == nil {
+		return nil
+	}
+	return m.keyring.Keys
+}
+
+// wrapDataKey wraps the data key of a new file for the active key and, if
+// recipients is set, every recipient
+func (m *Manager) wrapDataKey(h *streamHeader, dataKey []byte, recipients bool) error {
+	if m.keyring != nil {
+		w, err := wrapKey(m.keyring.key(m.keyring.Active), h, dataKey)
+		if err != nil {
+			return err
+		}
+		h.wrapped = append(h.wrapped, w)
+	}
+	targets := m.recipients
+	if !recipients {
+		targets = nil
+	}
+	for _, r := range targets {
+		w, err := wrapForRecipient(r, h, dataKey)
+		if err != nil {
+			return err
+		}
+		h.wrapped = append(h.wrapped, w)
+	}
+	if len(h.wrapped) == 0 {
+		return fmt.Errorf("no key or recipient to encrypt to")
+	}
+	if len(h.wrapped) > maxWrappedKeys {
+		return fmt.Errorf("too many recipients")
+	}
+	return nil
+}
+
+// streamCipher seals and opens the segments of one file
+type streamCipher struct {
+	aead    cipher.AEAD
+	header  []byte
+	counter uint64
+}
+
+// newStreamCipher creates the cipher of the file at path from its data key
+func newStreamCipher(dataKey []byte, h *streamHeader, path string) (*streamCipher, error) {
+	aead, err := newAEAD(dataKey, h.salt[:], "gosync stream v3")
+	if err != nil {
+		return nil, err
+	}
+	return &streamCipher{aead: aead, header: append(h.prefix(), path...)}, nil
+}
+
+// nonce returns the nonce of the next segment: the segment counter and a
+// final flag in the last byte
+func (c *streamCipher) nonce(last bool) ([]byte, error) {
+	if c.counter == 1<<64-1 {
+		return nil, fmt.Errorf("too many segments")
+	}
+	nonce := make([]byte, c.aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-9:], c.counter)
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	c.counter++
+	return nonce, nil
+}
+
+// seal encrypts the next segment. The header prefix and the path are
+// authenticated along with every segment.
+func (c *streamCipher) seal(dst, plaintext []byte, last bool) ([]byte, error) {
+	nonce, err := c.nonce(last)
+	if err != nil {
+		return nil, err
+	}
+	return c.aead.Seal(dst, nonce, plaintext, c.header), nil
+}
+
+// open decrypts the next segment
+func (c *streamCipher) open(dst, ciphertext []byte, last bool) ([]byte, error) {
+	nonce, err := c.nonce(last)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := c.aead.Open(dst, nonce, ciphertext, c.header)
+	if err != nil {
+		return nil, ErrAuthentication
+	}
+	return plaintext, nil
+}
+
+// Encrypt reads plaintext from src until EOF and writes it to dst in the
+// segmented format, holding only one segment in memory. path is the
+// slash-separated path the file is stored under, relative to the
+// destination root; decrypting requires the same path.
+func (m *Manager) Encrypt(dst io.Writer, src io.Reader, path string) error {
+	return m.encrypt(dst, src, path, true)
+}
+
+// EncryptMetadata encrypts data only holders of the keyring can produce,
+// such as the manifest of a destination. Unlike files, its data key is
+// wrapped for the active key alone, never for recipients.
+func (m *Manager) EncryptMetadata(dst io.Writer, src io.Reader, path string) error {
+	return m.encrypt(dst, src, path, false)
+}
+
+// encrypt encrypts src for the active key and, if recipients is set, every
+// recipient
+func (m *Manager) encrypt(dst io.Writer, src io.Reader, path string, recipients bool) error {
+	h := &streamHeader{version: streamVersion, segmentSize: SegmentSize}
+	if _, err := io.ReadFull(rand.Reader, h.salt[:]); err != nil {
+		return fmt.Errorf("error generating salt: %w", err)
+	}
+	dataKey := make([]byte, dataKeySize)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return fmt.Errorf("error generating data key: %w", err)
+	}
+	if err := m.wrapDataKey(h, dataKey, recipients); err != nil {
+		return err
+	}
+
+	c, err := newStreamCipher(dataKey, h, path)
+	if err != nil {
+		return err
+	}
+	if _, err := dst.Write(h.marshal()); err != nil {
+		return err
+	}
+
+	in := bufio.NewReaderSize(src, int(h.segmentSize)+1)
+	plaintext := make([]byte, h.segmentSize)
+	ciphertext := make([]byte, 0, int(h.segmentSize)+c.aead.Overhead())
+	for {
+		n, err := io.ReadFull(in, plaintext)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		// A full segment is the last one if nothing follows it
+		last := err != nil
+		if !last {
+			if _, err := in.Peek(1); err == io.EOF {
+				last = true
+			} else if err != nil {
+				return err
+			}
+		}
+
+		sealed, err := c.seal(ciphertext[:0], plaintext[:n], last)
+		if err != nil {
+			return err
+		}
+		if _, err := dst.Write(sealed); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+// Decrypt reads an encrypted file from src and writes the plaintext to dst.
+// Each segment is authenticated before it is written, but a stream that
+// fails later leaves the segments before it in dst, so callers must discard
+// the output on error. path must be the one the file was encrypted for.
+// Files in the single-shot format of earlier versions are not bound to a
+// path and are decrypted as a whole.
+func (m *Manager) Decrypt(dst io.Writer, src io.Reader, path string) error {
+	in := bufio.NewReaderSize(src, SegmentSize+64)
+	stream, err := isStream(in)
+	if err != nil {
+		return err
+	}
+	if !stream {
+		return m.decryptLegacy(dst, in)
+	}
+	h, err := readStreamHeader(in)
+	if err != nil {
+		return err
+	}
+
+	dataKey, err := m.dataKey(h, true)
+	if err != nil {
+		return err
+	}
+	c, err := newStreamCipher(dataKey, h, path)
+	if err != nil {
+		return err
+	}
+	return openSegments(dst, in, h, c)
+}
+
+// DecryptMetadata decrypts what EncryptMetadata wrote. Only data keys
+// wrapped with a key of the keyring are accepted, since anyone knowing a
+// recipient can wrap keys for it.
+func (m *Manager) DecryptMetadata(dst io.Writer, src io.Reader, path string) error {
+	in := bufio.NewReaderSize(src, SegmentSize+64)
+	h, err := readStreamHeader(in)
+	if err != nil {
+		return err
+	}
+	dataKey, err := m.dataKey(h, false)
+	if err != nil {
+		return err
+	}
+	c, err := newStreamCipher(dataKey, h, path)
+	if err != nil {
+		return err
+	}
+	return openSegments(dst, in, h, c)
+}
+
+// openSegments decrypts the segments following the header
+func openSegments(dst io.Writer, in *bufio.Reader, h *streamHeader, c *streamCipher) error {
+	segment := make([]byte, int(h.segmentSize)+c.aead.Overhead())
+	plaintext := make([]byte, 0, h.segmentSize)
+	for {
+		n, err := io.ReadFull(in, segment)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		last := err != nil
+		if !last {
+			if _, err := in.Peek(1); err == io.EOF {
+				last = true
+			} else if err != nil {
+				return err
+			}
+		}
+		if n < c.aead.Overhead() {
+			// Cut off inside a segment or right after a full one
+			return ErrAuthentication
+		}
+
+		opened, err := c.open(plaintext[:0], segment[:n], last)
+		if err != nil {
+			return err
+		}
+		if _, err := dst.Write(opened); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+// decryptLegacy decrypts the single-shot format of earlier versions: a
+// random nonce followed by the whole file sealed with the master key
+func (m *Manager) decryptLegacy(dst io.Writer, src io.Reader) error {
+	ciphertext, err := io.ReadAll(src)
+	if err != nil {
+		return err
+	}
+
+	if len(m.keys()) == 0 {
+		return ErrUnknownKey
+	}
+	for _, key := range m.keys() {
+		block, err := aes.NewCipher(key.Key)
+		if err != nil {
+			return fmt.Errorf("error creating cipher: %w", err)
+		}
+		gcm, err := cipher.NewGCM(block)
+		if err != nil {
+			return fmt.Errorf("error creating GCM: %w", err)
+		}
+
+		nonceSize := gcm.NonceSize()
+		if len(ciphertext) < nonceSize {
+			return fmt.Errorf("ciphertext too short")
+		}
+		nonce, sealed := ciphertext[:nonceSize], ciphertext[nonceSize:]
+		if plaintext, err := gcm.Open(nil, nonce, sealed, nil); err == nil {
+			_, err = dst.Write(plaintext)
+			return err
+		}
+	}
+	return ErrAuthentication
+}
+
+// Current reports whether an encrypted file starting at src has its data
+// key wrapped with the active key, reading only its header
+func (m *Manager) Current(src io.Reader) (bool, error) {
+	in := bufio.NewReader(src)
+	stream, err := isStream(in)
+	if err != nil || !stream {
+		return false, err
+	}
+	h, err := readStreamHeader(in)
+	if err != nil {
+		return false, err
+	}
+	for _, w := range h.wrapped {
+		if w.kind == wrapKeyring && hex.EncodeToString(w.id[:]) == m.ActiveKey() {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Rewrap copies the encrypted file at path from src to dst with its data
+// key wrapped with the active key instead of the one it was encrypted with.
+// Files of the single-shot format are encrypted again, binding them to
+// path.
+func (m *Manager) Rewrap(dst io.Writer, src io.Reader, path string) error {
+	if m.keyring == nil {
+		return fmt.Errorf("rewrapping requires a keyring")
+	}
+	in := bufio.NewReaderSize(src, SegmentSize+64)
+	stream, err := isStream(in)
+	if err != nil {
+		return err
+	}
+	if stream {
+		// Files with a data key keep their segments
+		return m.rewrapHeader(dst, in)
+	}
+
+	// Re-encrypt, failing if the decrypted stream does not authenticate
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(m.Decrypt(w, in, path))
+	}()
+	defer r.Close()
+	return m.Encrypt(dst, r, path)
+}
+
+// rewrapHeader replaces the wrapped data key in the header and copies the
+// segments unchanged
+func (m *Manager) rewrapHeader(dst io.Writer, in *bufio.Reader) error {
+	h, err := readStreamHeader(in)
+	if err != nil {
+		return err
+	}
+	dataKey, err := m.dataKey(h, true)
+	if err != nil {
+		return err
+	}
+	w, err := wrapKey(m.keyring.key(m.keyring.Active), h, dataKey)
+	if err != nil {
+		return err
+	}
+
+	// Keys wrapped otherwise are kept
+	wrapped := []wrappedKey{w}
+	for _, other := range h.wrapped {
+		if other.kind != wrapKeyring {
+			wrapped = append(wrapped, other)
+		}
+	}
+	h.wrapped = wrapped
+
+	if _, err := dst.Write(h.marshal()); err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, in)
+	return err
+}
+
+// ContentHash hashes an encrypted file written to it, leaving out the
+// wrapped keys, which change when keys are rotated. The segments
+// authenticate the rest of the header, so the hash still identifies the
+// contents.
+type ContentHash struct {
+	hash   hash.Hash
+	header []byte
+	done   bool
+}
+
+// NewContentHash creates an empty content hash
+func NewContentHash() *ContentHash {
+	return &ContentHash{hash: sha256.New()}
+}
+
+// Write adds the next part of the encrypted file to the hash
+func (c *ContentHash) Write(p []byte) (int, error) {
+	if c.done {
+		return c.hash.Write(p)
+	}
+	c.header = append(c.header, p...)
+	start, end, ok := wrappedKeys(c.header)
+	if !ok {
+		return len(p), nil
+	}
+	c.hash.Write(c.header[:start])
+	c.hash.Write(c.header[end:])
+	c.header, c.done = nil, true
+	return len(p), nil
+}
+
+// Sum returns the hash of everything written so far
+func (c *ContentHash) Sum() []byte {
+	if !c.done {
+		// Too short to hold a header
+		sum := sha256.Sum256(c.header)
+		return sum[:]
+	}
+	return c.hash.Sum(nil)
+}
+
+// wrappedKeys returns where the wrapped keys of the header at the start of
+// buf begin and end, or false if buf does not hold the whole header yet.
+// Files of the single-shot format report an empty range.
+func wrappedKeys(buf []byte) (start, end int, ok bool) {
+	if len(buf) >= len(streamMagic) && string(buf[:len(streamMagic)]) != streamMagic {
+		return 0, 0, true
+	}
+	if len(buf) <= prefixSize {
+		return 0, 0, false
+	}
+	end = prefixSize + 1
+	for i := 0; i < int(buf[prefixSize]); i++ {
+		if len(buf) < end+1+keyIDSize+2 {
+			return 0, 0, false
+		}
+		end += 1 + keyIDSize + 2 + int(binary.BigEndian.Uint16(buf[end+1+keyIDSize:]))
+	}
+	if len(buf) < end {
+		return 0, 0, false
+	}
+	return prefixSize, end, true
+}
@@ -0,0 +1,77 @@
+package crypto
+
+import (
+	"bufio"
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestStreamRoundTrip(t *testing.T) {
+	m := testManager(t)
+	// overhead is the size of the GCM tag of every segment
+	const overhead = 16
+
+	tests := []struct {
+		name string
+		size int
+	}{
+		{"empty", 0},
+		{"one byte", 1},
+		{"one short of a segment", SegmentSize - 1},
+		{"one segment", SegmentSize},
+		{"one past a segment", SegmentSize + 1},
+		{"two segments", 2 * SegmentSize},
+		{"partial third segment", 2*SegmentSize + 100},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plaintext := make([]byte, tt.size)
+			rand.New(rand.NewSource(int64(tt.size))).Read(plaintext)
+
+			var encrypted bytes.Buffer
+			if err := m.Encrypt(&encrypted, bytes.NewReader(plaintext), "dir/file"); err != nil {
+				t.Fatal(err)
+			}
+			var decrypted bytes.Buffer
+			if err := m.Decrypt(&decrypted, bytes.NewReader(encrypted.Bytes()), "dir/file"); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(decrypted.Bytes(), plaintext) {
+				t.Fatalf("decrypted %d bytes, want the %d encrypted", decrypted.Len(), len(plaintext))
+			}
+
+			if err := m.Decrypt(&bytes.Buffer{}, bytes.NewReader(encrypted.Bytes()), "dir/other"); err != ErrAuthentication {
+				t.Errorf("decrypting for another path: %v, want ErrAuthentication", err)
+			}
+
+			// Cut the stream after every segment but the last, which must
+			// not pass for a complete file
+			segments := (tt.size + SegmentSize - 1) / SegmentSize
+			if segments == 0 {
+				segments = 1
+			}
+			headerSize := encrypted.Len() - tt.size - segments*overhead
+			h, err := readStreamHeader(bufio.NewReader(bytes.NewReader(encrypted.Bytes())))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(h.marshal()) != headerSize {
+				t.Fatalf("%d segments after a %d byte header, want %d", segments, len(h.marshal()), headerSize)
+			}
+			for i := 0; i < segments; i++ {
+				truncated := encrypted.Bytes()[:headerSize+i*(SegmentSize+overhead)]
+				if err := m.Decrypt(&bytes.Buffer{}, bytes.NewReader(truncated), "dir/file"); err != ErrAuthentication {
+					t.Errorf("decrypting the first %d segments: %v, want ErrAuthentication", i, err)
+				}
+			}
+
+			tampered := bytes.Clone(encrypted.Bytes())
+			tampered[len(tampered)-1] ^= 1
+			if err := m.Decrypt(&bytes.Buffer{}, bytes.NewReader(tampered), "dir/file"); err != ErrAuthentication {
+				t.Errorf("decrypting a modified stream: %v, want ErrAuthentication", err)
+			}
+		})
+	}
+}
@@ -1,14 +1,19 @@
 package network
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
+
+	"gosync/pkg/utils"
 )
 
 // RemoteConfig holds the configuration for remote connection
@@ -25,6 +30,8 @@ type RemoteSync struct {
 	client     *sftp.Client
 	sshClient  *ssh.Client
 	remoteBase string
+	host       string
+	username   string
 }
 
 // NewRemoteSync creates a new remote sync handler
@@ -77,6 +84,8 @@ func NewRemoteSync(config RemoteConfig, remoteBase string) (*RemoteSync, error)
 		client:     sftpClient,
 		sshClient:  sshClient,
 		remoteBase: remoteBase,
+		host:       config.Host,
+		username:   config.Username,
 	}, nil
 }
 
@@ -88,108 +97,189 @@ func (r *RemoteSync) Close() error {
 	return r.sshClient.Close()
 }
 
-// CopyToRemote copies a file to the remote host
-func (r *RemoteSync) CopyToRemote(localPath, remotePath string) error {
-	// Open local file
-	local, err := os.Open(localPath)
-	if err != nil {
-		return fmt.Errorf("failed to open local file: %w", err)
-	}
-	defer local.Close()
+// remotePath converts a path relative to the remote base into a remote path
+func (r *RemoteSync) remotePath(rel string) string {
+	return path.Join(r.remoteBase, filepath.ToSlash(rel))
+}
 
-	// Ensure remote directory exists
-	remoteDir := filepath.Dir(remotePath)
-	if err := r.mkdirAll(remoteDir); err != nil {
-		return fmt.Errorf("failed to create remote directory: %w", err)
-	}
+// Lstat returns information about a remote entry without following symlinks
+func (r *RemoteSync) Lstat(rel string) (os.FileInfo, error) {
+	return r.client.Lstat(r.remotePath(rel))
+}
 
-	// Create remote file
-	remote, err := r.client.Create(remotePath)
-	if err != nil {
-		return fmt.Errorf("failed to create remote file: %w", err)
-	}
-	defer remote.Close()
+// Walk visits every remote entry below the remote base
+func (r *RemoteSync) Walk(fn func(rel string, info os.FileInfo) error) error {
+	root := path.Clean(r.remoteBase)
+	walker := r.client.Walk(root)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			if walker.Path() == root && errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if walker.Path() == root {
+			continue
+		}
 
-	// Copy file contents
-	if _, err := io.Copy(remote, local); err != nil {
-		return fmt.Errorf("failed to copy file contents: %w", err)
+		rel := strings.TrimPrefix(walker.Path(), strings.TrimSuffix(root, "/")+"/")
+		err := fn(filepath.FromSlash(rel), walker.Stat())
+		if err == filepath.SkipDir {
+			walker.SkipDir()
+		} else if err != nil {
+			return err
+		}
 	}
+	return nil
+}
+
+// MkdirAll creates a remote directory and all missing parents
+func (r *RemoteSync) MkdirAll(rel string, perm os.FileMode) error {
+	return r.client.MkdirAll(r.remotePath(rel))
+}
 
-	// Copy file mode
-	info, err := local.Stat()
+// WriteFile writes a remote file under a hidden temporary name and renames
+// it over the destination once it is complete
+func (r *RemoteSync) WriteFile(rel string, src io.Reader, perm os.FileMode) error {
+	dest := r.remotePath(rel)
+	tmp := path.Join(path.Dir(dest), utils.TempName(path.Base(dest)))
+
+	file, err := r.client.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
 	if err != nil {
-		return fmt.Errorf("failed to get local file info: %w", err)
+		return err
 	}
-
-	if err := r.client.Chmod(remotePath, info.Mode()); err != nil {
-		return fmt.Errorf("failed to set remote file permissions: %w", err)
+	if err := r.writeTemp(file, src, perm); err != nil {
+		file.Close()
+		r.client.Remove(tmp)
+		return err
+	}
+	if err := file.Close(); err != nil {
+		r.client.Remove(tmp)
+		return err
 	}
 
+	if err := r.replace(tmp, dest); err != nil {
+		r.client.Remove(tmp)
+		return err
+	}
 	return nil
 }
 
-// mkdirAll creates a directory and all parent directories on the remote host
-func (r *RemoteSync) mkdirAll(path string) error {
-	if path == "" {
-		return nil
+// writeTemp fills a temporary remote file and flushes it to disk if the
+// server supports it
+func (r *RemoteSync) writeTemp(file *sftp.File, src io.Reader, perm os.FileMode) error {
+	if _, err := io.Copy(file, src); err != nil {
+		return err
+	}
+	if perm != 0 {
+		if err := file.Chmod(perm); err != nil {
+			return err
+		}
+	}
+	if _, ok := r.client.HasExtension("fsync@openssh.com"); ok {
+		return file.Sync()
 	}
+	return nil
+}
 
-	// Split path into components
-	components := strings.Split(filepath.Clean(path), string(filepath.Separator))
-	current := ""
+// replace renames a file over an existing one. Without the POSIX rename
+// extension SFTP refuses to overwrite, so the old file is removed first.
+func (r *RemoteSync) replace(from, to string) error {
+	if _, ok := r.client.HasExtension("posix-rename@openssh.com"); ok {
+		return r.client.PosixRename(from, to)
+	}
+	if err := r.client.Remove(to); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return r.client.Rename(from, to)
+}
 
-	// Create each component
-	for _, component := range components {
-		if component == "" {
-			continue
-		}
-		current = filepath.Join(current, component)
-		r.client.Mkdir(current) // Ignore errors as directory might already exist
+// Append opens a remote file for writing at offset, creating it if needed
+// and discarding anything beyond offset. The file can be synced if the
+// server supports the fsync extension.
+func (r *RemoteSync) Append(rel string, offset int64) (io.WriteCloser, error) {
+	file, err := r.client.OpenFile(r.remotePath(rel), os.O_WRONLY|os.O_CREATE)
+	if err != nil {
+		return nil, err
 	}
+	if err := file.Truncate(offset); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if _, ok := r.client.HasExtension("fsync@openssh.com"); !ok {
+		// Hide Sync, which the server would reject
+		return struct{ io.WriteCloser }{file}, nil
+	}
+	return file, nil
+}
 
-	return nil
+// Open opens a remote file for reading
+func (r *RemoteSync) Open(rel string) (io.ReadCloser, error) {
+	return r.client.Open(r.remotePath(rel))
 }
 
-// SyncToRemote synchronizes a local directory to a remote directory
-func (r *RemoteSync) SyncToRemote(localPath string) error {
-	return filepath.Walk(localPath, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
+// Symlink creates a remote symlink pointing to link
+func (r *RemoteSync) Symlink(link, rel string) error {
+	return r.client.Symlink(link, r.remotePath(rel))
+}
 
-		// Get relative path
-		relPath, err := filepath.Rel(localPath, path)
-		if err != nil {
-			return fmt.Errorf("failed to get relative path: %w", err)
-		}
+// Readlink returns the target of a remote symlink
+func (r *RemoteSync) Readlink(rel string) (string, error) {
+	return r.client.ReadLink(r.remotePath(rel))
+}
 
-		// Construct remote path
-		remotePath := filepath.Join(r.remoteBase, relPath)
-
-		if info.IsDir() {
-			// Create directory on remote
-			return r.mkdirAll(remotePath)
-		} else if info.Mode()&os.ModeSymlink != 0 {
-			// Handle symlinks
-			link, err := os.Readlink(path)
-			if err != nil {
-				return fmt.Errorf("failed to read symlink: %w", err)
-			}
+// Remove removes a remote file or empty directory
+func (r *RemoteSync) Remove(rel string) error {
+	return r.client.Remove(r.remotePath(rel))
+}
 
-			// Remove existing symlink if it exists
-			r.client.Remove(remotePath)
+// RemoveAll removes a remote entry and everything below it
+func (r *RemoteSync) RemoveAll(rel string) error {
+	return r.client.RemoveAll(r.remotePath(rel))
+}
 
-			// Create new symlink
-			if err := r.client.Symlink(link, remotePath); err != nil {
-				return fmt.Errorf("failed to create remote symlink: %w", err)
-			}
-		} else {
-			// Copy regular file
-			if err := r.CopyToRemote(path, remotePath); err != nil {
-				return err
-			}
-		}
+// Rename renames a remote entry, replacing an existing file at the new name
+func (r *RemoteSync) Rename(from, to string) error {
+	return r.replace(r.remotePath(from), r.remotePath(to))
+}
+
+// Chmod changes the mode of a remote entry
+func (r *RemoteSync) Chmod(rel string, mode os.FileMode) error {
+	return r.client.Chmod(r.remotePath(rel), mode)
+}
+
+// Chtimes changes the access and modification times of a remote entry
+func (r *RemoteSync) Chtimes(rel string, atime, mtime time.Time) error {
+	return r.client.Chtimes(r.remotePath(rel), atime, mtime)
+}
 
+// Lchown changes the numeric owner and group of a remote entry. SFTP has
+// no way to change the owner of a symlink itself, so symlinks are skipped.
+func (r *RemoteSync) Lchown(rel string, uid, gid int) error {
+	info, err := r.client.Lstat(r.remotePath(rel))
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
 		return nil
-	})
+	}
+	return r.client.Chown(r.remotePath(rel), uid, gid)
+}
+
+// Owner returns the numeric owner and group reported by the server
+func (r *RemoteSync) Owner(info os.FileInfo) (uid, gid int, ok bool) {
+	stat, ok := info.Sys().(*sftp.FileStat)
+	if !ok {
+		return 0, 0, false
+	}
+	return int(stat.UID), int(stat.GID), true
+}
+
+// String describes the remote destination
+func (r *RemoteSync) String() string {
+	return fmt.Sprintf("%s@%s:%s", r.username, r.host, r.remoteBase)
 }
@@ -0,0 +1,15 @@
+package platform
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// AccessTime returns the last access time of a file
+func AccessTime(info os.FileInfo) time.Time {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return time.Unix(int64(stat.Atimespec.Sec), int64(stat.Atimespec.Nsec))
+	}
+	return info.ModTime()
+}
@@ -0,0 +1,14 @@
+//go:build !linux && !darwin
+
+package platform
+
+import (
+	"os"
+	"time"
+)
+
+// AccessTime returns the last access time of a file. The modification time
+// stands in where the access time is not available.
+func AccessTime(info os.FileInfo) time.Time {
+	return info.ModTime()
+}
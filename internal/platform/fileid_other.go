@@ -0,0 +1,11 @@
+//go:build !unix
+
+package platform
+
+import "os"
+
+// FileID returns the device and inode number identifying a file. They are
+// not available on this platform.
+func FileID(info os.FileInfo) (dev, ino uint64, ok bool) {
+	return 0, 0, false
+}
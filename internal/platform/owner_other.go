@@ -0,0 +1,11 @@
+//go:build !unix
+
+package platform
+
+import "os"
+
+// FileOwner returns the numeric owner and group of a file. Ownership is
+// not available on this platform.
+func FileOwner(info os.FileInfo) (uid, gid int, ok bool) {
+	return 0, 0, false
+}
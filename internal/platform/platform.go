@@ -30,3 +30,11 @@ func GetDefaultConfigPath() string {
 	}
 	return os.Getenv("HOME") + GetPathSeparator() + ".config" + GetPathSeparator() + "gosync" + GetPathSeparator() + "config.yaml"
 }
+
+// GetDefaultStateDir returns the platform-specific directory for sync state
+func GetDefaultStateDir() string {
+	if IsWindows() {
+		return os.Getenv("APPDATA") + GetPathSeparator() + "gosync" + GetPathSeparator() + "state"
+	}
+	return os.Getenv("HOME") + GetPathSeparator() + ".local" + GetPathSeparator() + "state" + GetPathSeparator() + "gosync"
+}
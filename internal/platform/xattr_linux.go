@@ -0,0 +1,101 @@
+package platform
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Xattrs returns the extended attributes of a file without following
+// symlinks. POSIX ACLs are included as system.posix_acl_* attributes.
+func Xattrs(path string) (map[string][]byte, error) {
+	size, err := unix.Llistxattr(path, nil)
+	if err != nil {
+		if errors.Is(err, unix.ENOTSUP) {
+			return nil, nil
+		}
+		return nil, &os.PathError{Op: "listxattr", Path: path, Err: err}
+	}
+	if size == 0 {
+		return nil, nil
+	}
+
+	buf := make([]byte, size)
+	size, err = unix.Llistxattr(path, buf)
+	if err != nil {
+		return nil, &os.PathError{Op: "listxattr", Path: path, Err: err}
+	}
+
+	attrs := make(map[string][]byte)
+	for _, name := range splitNames(buf[:size]) {
+		value, err := getXattr(path, name)
+		if errors.Is(err, unix.ENODATA) {
+			// Removed while listing
+			continue
+		}
+		if err != nil {
+			return nil, &os.PathError{Op: "getxattr", Path: path, Err: err}
+		}
+		attrs[name] = value
+	}
+	return attrs, nil
+}
+
+// SetXattrs makes the extended attributes of a file match attrs, removing
+// attributes that are not listed
+func SetXattrs(path string, attrs map[string][]byte) error {
+	current, err := Xattrs(path)
+	if err != nil {
+		return err
+	}
+	for name := range current {
+		if _, ok := attrs[name]; ok {
+			continue
+		}
+		if err := unix.Lremovexattr(path, name); err != nil && !errors.Is(err, unix.ENODATA) {
+			return &os.PathError{Op: "removexattr", Path: path, Err: err}
+		}
+	}
+	for name, value := range attrs {
+		if err := unix.Lsetxattr(path, name, value, 0); err != nil {
+			return &os.PathError{Op: "setxattr", Path: path, Err: err}
+		}
+	}
+	return nil
+}
+
+// getXattr reads a single attribute, growing the buffer as needed
+func getXattr(path, name string) ([]byte, error) {
+	for {
+		size, err := unix.Lgetxattr(path, name, nil)
+		if err != nil {
+			return nil, err
+		}
+		value := make([]byte, size)
+		n, err := unix.Lgetxattr(path, name, value)
+		if errors.Is(err, unix.ERANGE) {
+			// Grew between the two calls
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return value[:n], nil
+	}
+}
+
+// splitNames splits a NUL separated list of attribute names
+func splitNames(buf []byte) []string {
+	var names []string
+	start := 0
+	for i, b := range buf {
+		if b == 0 {
+			if i > start {
+				names = append(names, string(buf[start:i]))
+			}
+			start = i + 1
+		}
+	}
+	return names
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package platform
+
+// Xattrs returns the extended attributes of a file. Extended attributes are
+// only supported on Linux; elsewhere files appear to have none.
+func Xattrs(path string) (map[string][]byte, error) {
+	return nil, nil
+}
+
+// SetXattrs makes the extended attributes of a file match attrs
+func SetXattrs(path string, attrs map[string][]byte) error {
+	return nil
+}
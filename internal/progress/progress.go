@@ -6,7 +6,8 @@ import (
 	"time"
 )
 
-// Tracker handles progress tracking for file operations
+// Tracker handles progress tracking for file operations. It is safe for
+// concurrent use by multiple transfer workers.
 type Tracker struct {
 	total     int64
 	current   int64
@@ -30,6 +31,9 @@ func (t *Tracker) Update(n int64) {
 // GetProgress returns the current progress percentage
 func (t *Tracker) GetProgress() float64 {
 	current := atomic.LoadInt64(&t.current)
+	if t.total == 0 {
+		return 100
+	}
 	return float64(current) / float64(t.total) * 100
 }
 
@@ -0,0 +1,466 @@
+package sync
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"gosync/internal/progress"
+	"gosync/pkg/utils"
+)
+
+// BiActionType identifies what a bidirectional sync does with a path
+type BiActionType string
+
+const (
+	BiCopyAToB BiActionType = "a->b"
+	BiCopyBToA BiActionType = "b->a"
+	BiDeleteA  BiActionType = "delete-a"
+	BiDeleteB  BiActionType = "delete-b"
+	BiRenameB  BiActionType = "rename-b"
+	BiConflict BiActionType = "conflict"
+)
+
+// BiAction is a single change planned by a bidirectional sync. Path is
+// slash-separated and relative to both roots.
+type BiAction struct {
+	Type   BiActionType
+	Path   string
+	Entry  EntryState
+	Reason string
+	// To is the new name for BiRenameB
+	To string
+}
+
+// String formats the action for dry-run output
+func (a BiAction) String() string {
+	if a.Type == BiRenameB {
+		return fmt.Sprintf("%-8s %s => %s", a.Type, a.Path, a.To)
+	}
+	if a.Reason != "" {
+		return fmt.Sprintf("%-8s %s (%s)", a.Type, a.Path, a.Reason)
+	}
+	return fmt.Sprintf("%-8s %s", a.Type, a.Path)
+}
+
+// BiPlan is the outcome of comparing two trees against their saved state
+type BiPlan struct {
+	Actions   []BiAction
+	Conflicts []Conflict
+	// unchanged holds the state entries of paths that need no action
+	unchanged map[string]EntryState
+}
+
+// PlanBidirectional compares the local tree dirA and the target with the
+// state of the last sync and decides which side each change comes from
+func (m *Manager) PlanBidirectional(dirA string, target Target, state *State) (*BiPlan, error) {
+	sideA, err := m.scanLocal(dirA)
+	if err != nil {
+		return nil, fmt.Errorf("error scanning %s: %w", dirA, err)
+	}
+	sideB, err := m.scanTarget(target)
+	if err != nil {
+		return nil, fmt.Errorf("error scanning %s: %w", target, err)
+	}
+
+	paths := make(map[string]bool, len(sideA)+len(sideB))
+	for p := range sideA {
+		paths[p] = true
+	}
+	for p := range sideB {
+		paths[p] = true
+	}
+	for p := range state.Entries {
+		paths[p] = true
+	}
+	sorted := make([]string, 0, len(paths))
+	for p := range paths {
+		sorted = append(sorted, p)
+	}
+	sort.Strings(sorted)
+
+	plan := &BiPlan{unchanged: make(map[string]EntryState)}
+	for _, p := range sorted {
+		a, inA := sideA[p]
+		b, inB := sideB[p]
+		old, inState := state.Entries[p]
+
+		switch {
+		case inA && inB:
+			changedA := !inState || !a.sameAs(old)
+			changedB := !inState || !b.sameAs(old.sideB())
+			switch {
+			case !changedA && !changedB:
+				a.Hash = old.Hash
+				plan.unchanged[p] = withSideB(a, b)
+			case changedA && !changedB:
+				plan.Actions = append(plan.Actions, BiAction{Type: BiCopyAToB, Path: p, Entry: a})
+			case !changedA && changedB:
+				plan.Actions = append(plan.Actions, BiAction{Type: BiCopyBToA, Path: p, Entry: b})
+			default:
+				same, hash, err := m.sameContent(dirA, target, p, a, b)
+				if err != nil {
+					return nil, err
+				}
+				if same {
+					a.Hash = hash
+					plan.unchanged[p] = withSideB(a, b)
+					continue
+				}
+				reason := "changed on both sides"
+				if !inState {
+					reason = "created on both sides"
+				}
+				if err := m.planBiConflict(plan, p, reason, a, b, old); err != nil {
+					return nil, err
+				}
+			}
+
+		case inA:
+			if inState && a.sameAs(old) {
+				plan.Actions = append(plan.Actions, BiAction{Type: BiDeleteA, Path: p, Entry: a, Reason: "deleted on b"})
+			} else {
+				// New on A, or modified on A after B deleted it: keep the data
+				plan.Actions = append(plan.Actions, BiAction{Type: BiCopyAToB, Path: p, Entry: a})
+			}
+
+		case inB:
+			if inState && b.sameAs(old.sideB()) {
+				plan.Actions = append(plan.Actions, BiAction{Type: BiDeleteB, Path: p, Entry: b, Reason: "deleted on a"})
+			} else {
+				plan.Actions = append(plan.Actions, BiAction{Type: BiCopyBToA, Path: p, Entry: b})
+			}
+		}
+		// Deleted on both sides: simply forgotten
+	}
+
+	return plan, nil
+}
+
+// planBiConflict applies the conflict policy to a path changed on both
+// sides, treating A as the source and B as the destination
+func (m *Manager) planBiConflict(plan *BiPlan, p, reason string, a, b, old EntryState) error {
+	conflict := Conflict{Path: p, Reason: reason}
+	resolution, err := m.resolve(conflict, a, b)
+	if err != nil {
+		return err
+	}
+	conflict.Resolution = resolution
+
+	switch resolution {
+	case ResolvedSource:
+		plan.Actions = append(plan.Actions, BiAction{Type: BiCopyAToB, Path: p, Entry: a, Reason: reason})
+	case ResolvedDest:
+		plan.Actions = append(plan.Actions, BiAction{Type: BiCopyBToA, Path: p, Entry: b, Reason: reason})
+	case ResolvedBoth:
+		// B's version moves aside on B and is then copied to A as well
+		conflict.KeptAs = conflictName(p, time.Now())
+		plan.Actions = append(plan.Actions,
+			BiAction{Type: BiRenameB, Path: p, To: conflict.KeptAs},
+			BiAction{Type: BiCopyAToB, Path: p, Entry: a, Reason: reason},
+			BiAction{Type: BiCopyBToA, Path: conflict.KeptAs, Entry: b, Reason: reason})
+	default:
+		plan.Actions = append(plan.Actions, BiAction{Type: BiConflict, Path: p, Entry: old, Reason: reason})
+	}
+	plan.Conflicts = append(plan.Conflicts, conflict)
+	return nil
+}
+
+// ExecuteBidirectional applies a bidirectional plan and updates the state
+// with the result. Conflicting paths are left untouched on both sides.
+func (m *Manager) ExecuteBidirectional(plan *BiPlan, dirA string, target Target, state *State) error {
+	// The state records mode and times only, so nothing else is carried
+	// across in either direction
+	m.preserve &= PreserveMode | PreserveTimes
+
+	local := NewLocalTarget(dirA)
+	for _, side := range []Target{local, target} {
+		if err := m.removeTempFiles(side); err != nil {
+			return err
+		}
+	}
+
+	tracker := progress.NewTracker(0)
+	m.stats = Stats{Skipped: len(plan.unchanged), Conflicts: len(plan.Conflicts)}
+	m.conflicts = plan.Conflicts
+
+	next := make(map[string]EntryState, len(plan.unchanged)+len(plan.Actions))
+	for p, entry := range plan.unchanged {
+		next[p] = entry
+	}
+
+	// Copies run parents first, deletions children first. Directory modes
+	// are applied last, so read-only directories still take their contents.
+	var deletes, dirs []BiAction
+	for _, action := range plan.Actions {
+		rel := filepath.FromSlash(action.Path)
+		entry := action.Entry
+
+		switch action.Type {
+		case BiCopyAToB:
+			if err := m.execute(entryOperation(action.Path, entry), dirA, target, nil, tracker); err != nil {
+				return err
+			}
+			if entry.Type == EntryFile {
+				info, err := target.Lstat(rel)
+				if err != nil {
+					return fmt.Errorf("error checking %s on %s: %w", action.Path, target, err)
+				}
+				entry = withSideB(entry, entryFromInfo(info))
+			}
+		case BiCopyBToA:
+			if err := m.fetch(target, rel, entry, local); err != nil {
+				return err
+			}
+		case BiRenameB:
+			if err := target.Rename(rel, filepath.FromSlash(action.To)); err != nil {
+				return fmt.Errorf("error renaming %s to %s: %w", action.Path, action.To, err)
+			}
+			continue
+		case BiDeleteA, BiDeleteB:
+			deletes = append(deletes, action)
+			continue
+		case BiConflict:
+			if entry.Type != "" {
+				next[action.Path] = entry
+			}
+			continue
+		}
+
+		if entry.Type == EntryDir {
+			dirs = append(dirs, action)
+		}
+		if entry.Type == EntryFile {
+			sum, err := m.checksumCalc.CalculateFileChecksum(local.Path(rel))
+			if err != nil {
+				return fmt.Errorf("error calculating checksum of %s: %w", rel, err)
+			}
+			entry.Hash = hex.EncodeToString(sum)
+			if action.Type == BiCopyBToA {
+				m.countTransfer(entry.Size)
+			}
+		}
+		next[action.Path] = entry
+	}
+
+	for i := len(deletes) - 1; i >= 0; i-- {
+		action := deletes[i]
+		var side Target = local
+		if action.Type == BiDeleteB {
+			side = target
+		}
+		if err := side.Remove(filepath.FromSlash(action.Path)); err != nil && !os.IsNotExist(err) {
+			if action.Entry.Type == EntryDir {
+				// The directory gained new entries on this side; keep it
+				next[action.Path] = action.Entry
+				continue
+			}
+			return fmt.Errorf("error deleting %s from %s: %w", action.Path, side, err)
+		}
+		m.countDelete()
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		action := dirs[i]
+		rel := filepath.FromSlash(action.Path)
+		if action.Type == BiCopyAToB {
+			if err := m.applyMode(rel, entryOperation(action.Path, action.Entry), target); err != nil {
+				return err
+			}
+		} else if err := os.Chmod(local.Path(rel), action.Entry.Mode.Perm()); err != nil {
+			return fmt.Errorf("error setting permissions on %s: %w", local.Path(rel), err)
+		}
+	}
+
+	state.Entries = next
+	state.Synced = time.Now()
+	return nil
+}
+
+// withSideB records the modification time of side B in an entry of side A
+// if the two differ
+func withSideB(a, b EntryState) EntryState {
+	if !b.ModTime.Equal(a.ModTime) {
+		a.ModTimeB = b.ModTime
+	}
+	return a
+}
+
+// Conflicts returns the conflicts found by the last sync run
+func (m *Manager) Conflicts() []Conflict {
+	return m.conflicts
+}
+
+// fetch copies an entry from the target into the local tree
+func (m *Manager) fetch(target Target, rel string, entry EntryState, local *LocalTarget) error {
+	dest := local.Path(rel)
+
+	// Replace whatever is in the way when the type changed
+	if destInfo, err := os.Lstat(dest); err == nil && entryType(destInfo) != entry.Type {
+		if err := os.RemoveAll(dest); err != nil {
+			return fmt.Errorf("error replacing %s: %w", dest, err)
+		}
+	}
+
+	switch entry.Type {
+	case EntryDir:
+		// The mode is applied once the contents are in place
+		if err := os.MkdirAll(dest, 0777); err != nil {
+			return fmt.Errorf("error creating directory %s: %w", dest, err)
+		}
+		return nil
+
+	case EntrySymlink:
+		_ = os.Remove(dest)
+		if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+			return fmt.Errorf("error creating parent directory for symlink: %w", err)
+		}
+		if err := os.Symlink(entry.Link, dest); err != nil {
+			return fmt.Errorf("error creating symlink %s: %w", dest, err)
+		}
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return fmt.Errorf("error creating destination directory: %w", err)
+	}
+
+	in, err := target.Open(rel)
+	if err != nil {
+		return fmt.Errorf("error opening %s on %s: %w", rel, target, err)
+	}
+	defer in.Close()
+
+	out, err := utils.CreateAtomic(dest, entry.Mode.Perm())
+	if err != nil {
+		return err
+	}
+	defer out.Abort()
+
+	if _, err := io.Copy(out, in); err != nil {
+		return fmt.Errorf("error copying %s from %s: %w", rel, target, err)
+	}
+	if err := out.Commit(); err != nil {
+		return err
+	}
+
+	if err := os.Chmod(dest, entry.Mode.Perm()); err != nil {
+		return err
+	}
+	return os.Chtimes(dest, entry.ModTime, entry.ModTime)
+}
+
+// sameContent checks whether both sides hold identical content for a path
+// that changed on both, returning the content hash for files
+func (m *Manager) sameContent(dirA string, target Target, p string, a, b EntryState) (bool, string, error) {
+	if a.Type != b.Type {
+		return false, "", nil
+	}
+	switch a.Type {
+	case EntryDir:
+		return true, "", nil
+	case EntrySymlink:
+		return a.Link == b.Link, "", nil
+	}
+	if a.Size != b.Size {
+		return false, "", nil
+	}
+
+	rel := filepath.FromSlash(p)
+	sumA, err := m.checksumCalc.CalculateFileChecksum(filepath.Join(dirA, rel))
+	if err != nil {
+		return false, "", fmt.Errorf("error calculating checksum of %s: %w", p, err)
+	}
+	sumB, err := m.targetChecksum(target, rel)
+	if err != nil {
+		return false, "", fmt.Errorf("error calculating checksum of %s: %w", p, err)
+	}
+	hashA := hex.EncodeToString(sumA)
+	return hashA == hex.EncodeToString(sumB), hashA, nil
+}
+
+// scanLocal records the current state of every entry in a local tree
+func (m *Manager) scanLocal(dir string) (map[string]EntryState, error) {
+	entries := make(map[string]EntryState)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return entries, nil
+	}
+	err := m.walkSource(dir, func(path, rel string, info os.FileInfo) error {
+		if rel == "." {
+			return nil
+		}
+		entry := entryFromInfo(info)
+		if entry.Type == EntrySymlink {
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			entry.Link = link
+		}
+		entries[filepath.ToSlash(rel)] = entry
+		return nil
+	})
+	return entries, err
+}
+
+// scanTarget records the current state of every entry in a target
+func (m *Manager) scanTarget(target Target) (map[string]EntryState, error) {
+	entries := make(map[string]EntryState)
+	err := target.Walk(func(rel string, info os.FileInfo) error {
+		if m.isIgnored(rel) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		entry := entryFromInfo(info)
+		if entry.Type == EntrySymlink {
+			link, err := target.Readlink(rel)
+			if err != nil {
+				return err
+			}
+			entry.Link = link
+		}
+		entries[filepath.ToSlash(rel)] = entry
+		return nil
+	})
+	return entries, err
+}
+
+// entryFromInfo converts file information into a state entry
+func entryFromInfo(info os.FileInfo) EntryState {
+	entry := EntryState{Type: entryType(info), Mode: info.Mode()}
+	if entry.Type == EntryFile {
+		entry.Size = info.Size()
+		entry.ModTime = info.ModTime()
+	}
+	return entry
+}
+
+// entryType classifies file information as file, directory or symlink
+func entryType(info os.FileInfo) string {
+	switch {
+	case info.IsDir():
+		return EntryDir
+	case isSymlink(info.Mode()):
+		return EntrySymlink
+	default:
+		return EntryFile
+	}
+}
+
+// entryOperation converts a state entry into the operation that recreates it
+func entryOperation(p string, entry EntryState) Operation {
+	switch entry.Type {
+	case EntryDir:
+		return Operation{Type: OpMkdir, Path: p, Mode: entry.Mode}
+	case EntrySymlink:
+		return Operation{Type: OpSymlink, Path: p, Link: entry.Link}
+	default:
+		return Operation{Type: OpUpdate, Path: p, Mode: entry.Mode, Size: entry.Size, ModTime: entry.ModTime}
+	}
+}
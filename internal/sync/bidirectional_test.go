@@ -0,0 +1,109 @@
+package sync
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// syncedPair creates two trees holding x, synchronizes them and returns the
+// recorded state along with the time x was given on both sides
+func syncedPair(t *testing.T) (dirA, dirB string, state *State, synced time.Time) {
+	t.Helper()
+	dirA, dirB = t.TempDir(), t.TempDir()
+	synced = time.Unix(1700000000, 100000000)
+	writeFile(t, filepath.Join(dirA, "x"), "x\n", synced)
+
+	m := NewManager(Options{})
+	state = NewState(dirA, dirB)
+	plan, err := m.PlanBidirectional(dirA, NewLocalTarget(dirB), state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.ExecuteBidirectional(plan, dirA, NewLocalTarget(dirB), state); err != nil {
+		t.Fatal(err)
+	}
+	return dirA, dirB, state, synced
+}
+
+func writeFile(t *testing.T, path, contents string, modTime time.Time) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPlanBidirectionalSameSecondEdits(t *testing.T) {
+	// Every edit keeps the size and lands in the second of the last sync
+	later := 500 * time.Millisecond
+	tests := []struct {
+		name      string
+		editA     string
+		editB     string
+		want      []BiActionType
+		conflicts int
+	}{
+		{name: "unchanged"},
+		{name: "edited on a", editA: "a\n", want: []BiActionType{BiCopyAToB}},
+		{name: "edited on b", editB: "b\n", want: []BiActionType{BiCopyBToA}},
+		{name: "edited on both", editA: "a\n", editB: "b\n", want: []BiActionType{BiConflict}, conflicts: 1},
+		{name: "same edit on both", editA: "a\n", editB: "a\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dirA, dirB, state, synced := syncedPair(t)
+			if tt.editA != "" {
+				writeFile(t, filepath.Join(dirA, "x"), tt.editA, synced.Add(later))
+			}
+			if tt.editB != "" {
+				writeFile(t, filepath.Join(dirB, "x"), tt.editB, synced.Add(later))
+			}
+
+			m := NewManager(Options{Conflict: ConflictSkip})
+			plan, err := m.PlanBidirectional(dirA, NewLocalTarget(dirB), state)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []BiActionType
+			for _, action := range plan.Actions {
+				got = append(got, action.Type)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("actions = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("actions = %v, want %v", got, tt.want)
+				}
+			}
+			if len(plan.Conflicts) != tt.conflicts {
+				t.Errorf("conflicts = %v, want %d", plan.Conflicts, tt.conflicts)
+			}
+		})
+	}
+}
+
+func TestPlanBidirectionalCoarseSideB(t *testing.T) {
+	// Side B stores whole seconds, so its time differs from A's after a sync
+	dirA, dirB, state, synced := syncedPair(t)
+	coarse := synced.Truncate(time.Second)
+	if err := os.Chtimes(filepath.Join(dirB, "x"), coarse, coarse); err != nil {
+		t.Fatal(err)
+	}
+	entry := state.Entries["x"]
+	entry.ModTimeB = coarse
+	state.Entries["x"] = entry
+
+	plan, err := NewManager(Options{}).PlanBidirectional(dirA, NewLocalTarget(dirB), state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Actions) != 0 {
+		t.Errorf("actions = %v, want none", plan.Actions)
+	}
+}
@@ -0,0 +1,133 @@
+package sync
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// conflictNamePattern matches the names given to versions kept by keep-both
+var conflictNamePattern = regexp.MustCompile(`\.conflict-[^/]+-\d{8}-\d{6}(\.[^/.]*)?$`)
+
+// ConflictPolicy decides which version wins when the destination changed
+// since the last sync and the source changed as well
+type ConflictPolicy string
+
+const (
+	// ConflictSourceWins overwrites the destination with the source version
+	ConflictSourceWins ConflictPolicy = "source-wins"
+	// ConflictDestWins keeps the destination version
+	ConflictDestWins ConflictPolicy = "dest-wins"
+	// ConflictNewerWins keeps whichever version was modified last
+	ConflictNewerWins ConflictPolicy = "newer-wins"
+	// ConflictKeepBoth moves the destination version aside under a
+	// conflict name and then writes the source version
+	ConflictKeepBoth ConflictPolicy = "keep-both"
+	// ConflictAsk asks the user for every conflict
+	ConflictAsk ConflictPolicy = "ask"
+	// ConflictSkip leaves both versions untouched
+	ConflictSkip ConflictPolicy = "skip"
+)
+
+// ParseConflictPolicy parses a conflict policy name as used on the command line
+func ParseConflictPolicy(name string) (ConflictPolicy, error) {
+	switch policy := ConflictPolicy(name); policy {
+	case ConflictSourceWins, ConflictDestWins, ConflictNewerWins, ConflictKeepBoth, ConflictAsk, ConflictSkip:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown conflict policy %q (want newer-wins, source-wins, dest-wins, keep-both, ask or skip)", name)
+	}
+}
+
+// Resolution records how a conflict was settled
+type Resolution string
+
+const (
+	ResolvedSource Resolution = "source"
+	ResolvedDest   Resolution = "dest"
+	ResolvedBoth   Resolution = "both"
+	Unresolved     Resolution = "skipped"
+)
+
+// Conflict describes a path that changed on both sides since the last sync
+type Conflict struct {
+	Path       string     `json:"path"`
+	Reason     string     `json:"reason"`
+	Resolution Resolution `json:"resolution"`
+	// KeptAs is where the destination version was moved for keep-both
+	KeptAs string `json:"kept_as,omitempty"`
+}
+
+// String formats the conflict for the end-of-run summary
+func (c Conflict) String() string {
+	switch c.Resolution {
+	case ResolvedSource:
+		return fmt.Sprintf("%s (%s): source version kept", c.Path, c.Reason)
+	case ResolvedDest:
+		return fmt.Sprintf("%s (%s): destination version kept", c.Path, c.Reason)
+	case ResolvedBoth:
+		return fmt.Sprintf("%s (%s): both kept, destination version moved to %s", c.Path, c.Reason, c.KeptAs)
+	default:
+		return fmt.Sprintf("%s (%s): left untouched", c.Path, c.Reason)
+	}
+}
+
+// AskFunc asks the user how to resolve a conflict between the source and
+// destination versions of a path
+type AskFunc func(conflict Conflict, source, dest EntryState) (Resolution, error)
+
+// resolve applies the conflict policy to a conflict
+func (m *Manager) resolve(conflict Conflict, source, dest EntryState) (Resolution, error) {
+	// Directories cannot be merged or renamed file by file
+	if source.Type == EntryDir || dest.Type == EntryDir {
+		return Unresolved, nil
+	}
+
+	switch m.conflictPolicy {
+	case ConflictSourceWins:
+		return ResolvedSource, nil
+	case ConflictDestWins:
+		return ResolvedDest, nil
+	case ConflictNewerWins:
+		if source.ModTime.After(dest.ModTime) {
+			return ResolvedSource, nil
+		}
+		return ResolvedDest, nil
+	case ConflictKeepBoth:
+		return ResolvedBoth, nil
+	case ConflictAsk:
+		if m.ask == nil {
+			return Unresolved, nil
+		}
+		return m.ask(conflict, source, dest)
+	default:
+		return Unresolved, nil
+	}
+}
+
+// conflictName returns the name a conflicting version is kept under, in
+// the form file.conflict-<host>-<timestamp>.ext
+func conflictName(p string, now time.Time) string {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "unknown"
+	}
+	host = strings.ReplaceAll(host, "/", "_")
+
+	ext := path.Ext(p)
+	base := strings.TrimSuffix(p, ext)
+	if ext == p || strings.HasSuffix(base, "/") {
+		// Dotfiles such as ".bashrc" have no extension
+		base, ext = p, ""
+	}
+	return fmt.Sprintf("%s.conflict-%s-%s%s", base, host, now.Format("20060102-150405"), ext)
+}
+
+// isConflictName reports whether a path is a version kept by keep-both
+func isConflictName(rel string) bool {
+	return conflictNamePattern.MatchString(filepath.ToSlash(rel))
+}
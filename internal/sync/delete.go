@@ -0,0 +1,64 @@
+package sync
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"gosync/pkg/utils"
+)
+
+// DeleteMode controls whether and when destination entries that no longer
+// exist in the source are removed
+type DeleteMode int
+
+const (
+	// DeleteNone never removes anything from the destination
+	DeleteNone DeleteMode = iota
+	// DeleteBefore removes extraneous entries before transferring files
+	DeleteBefore
+	// DeleteAfter removes extraneous entries once all transfers succeeded
+	DeleteAfter
+)
+
+// findExtraneous lists the destination entries that have no counterpart in
+// the source. Directories are reported once, without their contents.
+// Entries matching the ignore patterns are kept unless deleteExcluded is set.
+func (m *Manager) findExtraneous(target Target, sourceEntries map[string]os.FileMode) ([]string, error) {
+	var extraneous []string
+	err := target.Walk(func(rel string, info os.FileInfo) error {
+		if mode, ok := sourceEntries[rel]; ok {
+			// Entries of another type are replaced by the transfer, along
+			// with anything inside them
+			if info.IsDir() && !mode.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		// Versions moved aside by keep-both and the manifest are never
+		// mirrored away, and leftovers of interrupted transfers are cleaned
+		// up separately
+		if !info.IsDir() && (isConflictName(rel) || rel == manifestName || utils.IsTempFile(rel) || utils.IsPartialFile(rel)) {
+			return nil
+		}
+
+		if !m.deleteExcluded && m.isIgnored(rel) {
+			// Excluded entries at the destination are protected
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		extraneous = append(extraneous, rel)
+		if info.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error scanning destination %s: %w", target, err)
+	}
+	return extraneous, nil
+}
@@ -0,0 +1,300 @@
+package sync
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+
+	"gosync/pkg/checksum"
+	"gosync/pkg/utils"
+)
+
+// maxLiteralSize bounds the amount of unmatched source data held in memory
+// before it is emitted as a literal operation
+const maxLiteralSize = 64 * 1024
+
+// DeltaOpKind identifies the type of a delta operation
+type DeltaOpKind int
+
+const (
+	// DeltaCopy reuses a byte range from the basis file
+	DeltaCopy DeltaOpKind = iota
+	// DeltaLiteral writes data taken from the source file
+	DeltaLiteral
+)
+
+// DeltaOp is a single instruction in a patch stream. Applying all operations
+// of a stream in order to the basis file reproduces the source file.
+type DeltaOp struct {
+	Kind   DeltaOpKind
+	Offset int64  // Offset in the basis file, for DeltaCopy
+	Length int64  // Number of bytes produced by the operation
+	Data   []byte // Literal bytes, for DeltaLiteral
+}
+
+// GenerateDelta slides a window over source looking for blocks present in
+// the basis signature and emits the resulting copy/literal operations.
+// Literal data passed to emit is only valid until emit returns.
+func GenerateDelta(sig *checksum.Signature, source io.Reader, emit func(DeltaOp) error) error {
+	e := &deltaEmitter{emit: emit}
+	blockSize := int(sig.BlockSize)
+
+	reader := bufio.NewReader(source)
+
+	// Nothing to match against; the whole source is literal data
+	if len(sig.Blocks) == 0 || blockSize <= 0 {
+		chunk := make([]byte, maxLiteralSize)
+		for {
+			n, err := io.ReadFull(reader, chunk)
+			if n > 0 {
+				if err := e.literal(chunk[:n]); err != nil {
+					return err
+				}
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return e.flush()
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	index := make(map[uint32][]int, len(sig.Blocks))
+	for i, block := range sig.Blocks {
+		index[block.Weak] = append(index[block.Weak], i)
+	}
+
+	buf := make([]byte, 0, maxLiteralSize+blockSize)
+	start := 0 // buf[:start] is pending literal data, buf[start:] the window
+	var rolling *checksum.Rolling
+
+	for {
+		if rolling == nil {
+			// Fill a fresh window after a match or at the start of the file
+			eof := false
+			for len(buf)-start < blockSize {
+				c, err := reader.ReadByte()
+				if err == io.EOF {
+					eof = true
+					break
+				}
+				if err != nil {
+					return err
+				}
+				buf = append(buf, c)
+			}
+			if eof {
+				break
+			}
+			rolling = checksum.NewRolling(buf[start:])
+		}
+
+		if block, ok := matchBlock(sig, index, rolling.Sum(), buf[start:]); ok {
+			if err := e.literal(buf[:start]); err != nil {
+				return err
+			}
+			if err := e.copy(block.Offset, block.Size); err != nil {
+				return err
+			}
+			buf, start, rolling = buf[:0], 0, nil
+			continue
+		}
+
+		c, err := reader.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		out := buf[start]
+		buf = append(buf, c)
+		start++
+		rolling.Roll(out, c)
+
+		if start >= maxLiteralSize {
+			if err := e.literal(buf[:start]); err != nil {
+				return err
+			}
+			n := copy(buf, buf[start:])
+			buf, start = buf[:n], 0
+		}
+	}
+
+	// The last basis block may be shorter than the window; try it against
+	// the tail of the source before giving up on the remaining bytes.
+	last := sig.Blocks[len(sig.Blocks)-1]
+	if tail := buf[start:]; last.Size < int64(blockSize) && int64(len(tail)) >= last.Size {
+		candidate := tail[len(tail)-int(last.Size):]
+		if checksum.WeakChecksum(candidate) == last.Weak &&
+			bytes.Equal(checksum.StrongChecksum(candidate), last.Strong) {
+			if err := e.literal(buf[:len(buf)-len(candidate)]); err != nil {
+				return err
+			}
+			if err := e.copy(last.Offset, last.Size); err != nil {
+				return err
+			}
+			return e.flush()
+		}
+	}
+
+	if err := e.literal(buf); err != nil {
+		return err
+	}
+	return e.flush()
+}
+
+// matchBlock looks up a window in the signature, confirming weak checksum
+// hits with the strong checksum
+func matchBlock(sig *checksum.Signature, index map[uint32][]int, weak uint32, window []byte) (checksum.BlockSignature, bool) {
+	candidates := index[weak]
+	if len(candidates) == 0 {
+		return checksum.BlockSignature{}, false
+	}
+
+	var strong []byte
+	for _, i := range candidates {
+		block := sig.Blocks[i]
+		if block.Size != int64(len(window)) {
+			continue
+		}
+		if strong == nil {
+			strong = checksum.StrongChecksum(window)
+		}
+		if bytes.Equal(strong, block.Strong) {
+			return block, true
+		}
+	}
+	return checksum.BlockSignature{}, false
+}
+
+// deltaEmitter merges adjacent copy operations before passing them on
+type deltaEmitter struct {
+	emit       func(DeltaOp) error
+	pending    DeltaOp
+	hasPending bool
+}
+
+func (e *deltaEmitter) copy(offset, length int64) error {
+	if e.hasPending && e.pending.Offset+e.pending.Length == offset {
+		e.pending.Length += length
+		return nil
+	}
+	if err := e.flush(); err != nil {
+		return err
+	}
+	e.pending = DeltaOp{Kind: DeltaCopy, Offset: offset, Length: length}
+	e.hasPending = true
+	return nil
+}
+
+func (e *deltaEmitter) literal(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	if err := e.flush(); err != nil {
+		return err
+	}
+	return e.emit(DeltaOp{Kind: DeltaLiteral, Length: int64(len(data)), Data: data})
+}
+
+func (e *deltaEmitter) flush() error {
+	if !e.hasPending {
+		return nil
+	}
+	e.hasPending = false
+	return e.emit(e.pending)
+}
+
+// Patcher rebuilds a file by applying delta operations against a basis
+type Patcher struct {
+	basis io.ReaderAt
+	out   io.Writer
+	buf   []byte
+
+	// Matched and Literal count the bytes reused from the basis and the
+	// bytes that had to be taken from the source
+	Matched int64
+	Literal int64
+}
+
+// NewPatcher creates a patcher that reads from basis and writes to out
+func NewPatcher(basis io.ReaderAt, out io.Writer) *Patcher {
+	return &Patcher{
+		basis: basis,
+		out:   out,
+		buf:   make([]byte, 32*1024),
+	}
+}
+
+// Apply executes a single delta operation
+func (p *Patcher) Apply(op DeltaOp) error {
+	switch op.Kind {
+	case DeltaCopy:
+		n, err := io.CopyBuffer(p.out, io.NewSectionReader(p.basis, op.Offset, op.Length), p.buf)
+		if err != nil {
+			return err
+		}
+		if n != op.Length {
+			return fmt.Errorf("short copy from basis at offset %d: got %d of %d bytes", op.Offset, n, op.Length)
+		}
+		p.Matched += n
+	case DeltaLiteral:
+		if _, err := p.out.Write(op.Data); err != nil {
+			return err
+		}
+		p.Literal += op.Length
+	default:
+		return fmt.Errorf("unknown delta operation %d", op.Kind)
+	}
+	return nil
+}
+
+// deltaCopy updates an existing destination file in place of a full copy,
+// reusing every block of the old contents that still appears in source
+func (m *Manager) deltaCopy(source, dest string) error {
+	sig, err := m.checksumCalc.CalculateSignature(dest)
+	if err != nil {
+		return fmt.Errorf("error calculating signature: %w", err)
+	}
+
+	destInfo, err := os.Stat(dest)
+	if err != nil {
+		return err
+	}
+
+	sourceFile, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer sourceFile.Close()
+
+	basis, err := os.Open(dest)
+	if err != nil {
+		return err
+	}
+	defer basis.Close()
+
+	// The basis is read while the new contents are written, so the result
+	// goes to a temporary file that replaces the destination at the end
+	tmp, err := utils.CreateAtomic(dest, destInfo.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	defer tmp.Abort()
+
+	out := bufio.NewWriter(tmp)
+	patcher := NewPatcher(basis, out)
+	if err := GenerateDelta(sig, bufio.NewReader(sourceFile), patcher.Apply); err != nil {
+		return fmt.Errorf("error applying delta: %w", err)
+	}
+	if err := out.Flush(); err != nil {
+		return err
+	}
+
+	basis.Close()
+	return tmp.Commit()
+}
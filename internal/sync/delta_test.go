@@ -0,0 +1,82 @@
+package sync
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gosync/pkg/checksum"
+)
+
+func TestDeltaRoundTrip(t *testing.T) {
+	const blockSize = 1024
+	random := rand.New(rand.NewSource(1))
+	basis := make([]byte, 8*blockSize+300)
+	random.Read(basis)
+	other := make([]byte, 3*blockSize)
+	random.Read(other)
+
+	concat := func(parts ...[]byte) []byte {
+		return bytes.Join(parts, nil)
+	}
+	modified := bytes.Clone(basis)
+	modified[3*blockSize+10] ^= 0xff
+
+	tests := []struct {
+		name   string
+		basis  []byte
+		source []byte
+		// matched is the least number of bytes to reuse from the basis
+		matched int64
+	}{
+		{name: "identical", basis: basis, source: basis, matched: int64(len(basis))},
+		{name: "empty basis", basis: nil, source: basis},
+		{name: "empty source", basis: basis, source: nil},
+		{name: "unrelated", basis: basis, source: other},
+		{name: "byte modified", basis: basis, source: modified, matched: int64(len(basis)) - blockSize},
+		{name: "prefix inserted", basis: basis, source: concat([]byte("x"), basis), matched: int64(len(basis))},
+		// The short last block of the basis only matches at the end
+		{name: "appended", basis: basis, source: concat(basis, other), matched: 8 * blockSize},
+		{name: "middle removed", basis: basis, source: concat(basis[:2*blockSize], basis[5*blockSize:]), matched: int64(len(basis)) - 3*blockSize},
+		{name: "block moved", basis: basis, source: concat(basis[4*blockSize:5*blockSize], basis[:4*blockSize], basis[5*blockSize:]), matched: int64(len(basis))},
+		{name: "basis shorter than a block", basis: basis[:100], source: concat(other, basis[:100]), matched: 100},
+		{name: "source shorter than a block", basis: basis, source: basis[:blockSize-1]},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			basisFile := filepath.Join(t.TempDir(), "basis")
+			if err := os.WriteFile(basisFile, tt.basis, 0644); err != nil {
+				t.Fatal(err)
+			}
+			sig, err := checksum.NewCalculator(blockSize).CalculateSignature(basisFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var out bytes.Buffer
+			patcher := NewPatcher(bytes.NewReader(tt.basis), &out)
+			if err := GenerateDelta(sig, bytes.NewReader(tt.source), patcher.Apply); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(out.Bytes(), tt.source) {
+				t.Fatalf("patched %d bytes, differing from the %d byte source", out.Len(), len(tt.source))
+			}
+			if patcher.Matched+patcher.Literal != int64(len(tt.source)) {
+				t.Errorf("%d bytes matched and %d literal for a %d byte source", patcher.Matched, patcher.Literal, len(tt.source))
+			}
+			if patcher.Matched < tt.matched {
+				t.Errorf("%d bytes matched, want at least %d", patcher.Matched, tt.matched)
+			}
+		})
+	}
+}
+
+func TestPatcherShortBasis(t *testing.T) {
+	patcher := NewPatcher(bytes.NewReader(make([]byte, 10)), &bytes.Buffer{})
+	if err := patcher.Apply(DeltaOp{Kind: DeltaCopy, Offset: 5, Length: 10}); err == nil {
+		t.Error("copy past the end of the basis succeeded")
+	}
+}
@@ -0,0 +1,349 @@
+package sync
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gosync/internal/crypto"
+	"gosync/internal/progress"
+)
+
+// Execute applies the operations of a plan to the target. Directories are
+// created and conflicting versions moved aside in plan order, while file
+// operations are spread over the worker pool. Errors of independent file
+// operations are collected and returned together. Encrypted targets get
+// their manifest rewritten once, with whatever was written, even if some
+// operations failed.
+func (m *Manager) Execute(plan *Plan, target Target, cryptoManager *crypto.Manager) error {
+	if plan.Encrypt && cryptoManager == nil {
+		return fmt.Errorf("plan requires encryption but no key was provided")
+	}
+	if encryptsNames(target) != plan.EncryptNames {
+		return fmt.Errorf("plan and target disagree on encrypting names")
+	}
+
+	// The plan decides what is preserved, so applying it later matches
+	// what was reviewed
+	m.preserve = plan.Preserve
+	if m.preserve == 0 {
+		m.preserve = DefaultPreserve
+	}
+	if err := m.checkPreserve(target, plan.Encrypt); err != nil {
+		return err
+	}
+
+	// Get total size for progress tracking
+	var totalSize int64
+	for _, op := range plan.Operations {
+		if op.Type == OpCreate || op.Type == OpUpdate {
+			totalSize += op.Size
+		}
+	}
+
+	// Incremental plans run often and must not scan the whole target
+	if !plan.incremental {
+		if err := m.removeTempFiles(target); err != nil {
+			return err
+		}
+	}
+	if m.manifest == nil {
+		if err := m.LoadManifest(target, cryptoManager); err != nil {
+			return err
+		}
+	}
+
+	tracker := progress.NewTracker(totalSize)
+	m.stats = Stats{Skipped: plan.Unchanged, Conflicts: len(plan.Conflicts)}
+	m.conflicts = plan.Conflicts
+
+	err := m.executeOperations(plan, target, cryptoManager, tracker)
+	if m.manifest != nil && m.manifest.changed && cryptoManager != nil {
+		manifestErr := writeManifest(m.manifest, target, cryptoManager)
+		if manifestErr == nil {
+			m.manifest.changed = false
+		} else if err == nil {
+			err = manifestErr
+		}
+	}
+	return err
+}
+
+// executeOperations runs the operations of a plan in order
+func (m *Manager) executeOperations(plan *Plan, target Target, cryptoManager *crypto.Manager, tracker *progress.Tracker) error {
+	pool := newWorkerPool(m.workers)
+	defer pool.close()
+
+	// Directory modes wait until nothing is created or deleted inside
+	// anymore, since a read-only directory would refuse its contents
+	var dirModes []Operation
+
+	phase := phaseTransfer
+	for _, op := range plan.Operations {
+		op := op
+
+		// Deletions before transfers free space first, deletions after
+		// them only run once every transfer succeeded, and directory times
+		// are set once nothing changes inside anymore
+		if next := opPhase(op); next != phase {
+			if err := pool.wait(); err != nil {
+				return err
+			}
+			phase = next
+			if phase == phaseDirTimes {
+				if err := m.applyDirModes(dirModes, target); err != nil {
+					return err
+				}
+				dirModes = nil
+			}
+		}
+
+		switch {
+		case op.Type == OpChmod && op.Mode.IsDir():
+			dirModes = append(dirModes, op)
+		case op.Type == OpMkdir || op.Type == OpRename:
+			// Later operations rely on these having completed
+			if err := m.execute(op, plan.Source, target, cryptoManager, tracker); err != nil {
+				pool.fail(err)
+				return pool.wait()
+			}
+			if op.Type == OpMkdir {
+				dirModes = append(dirModes, op)
+			}
+		default:
+			if op.Type == OpChown && op.Mode.IsDir() {
+				dirModes = append(dirModes, op)
+			}
+			pool.submit(func() error {
+				return m.execute(op, plan.Source, target, cryptoManager, tracker)
+			})
+		}
+	}
+	if err := pool.wait(); err != nil {
+		return err
+	}
+	return m.applyDirModes(dirModes, target)
+}
+
+// applyDirModes sets the modes of directories, children first, so a
+// directory that cannot be searched anymore does not hide its children
+func (m *Manager) applyDirModes(ops []Operation, target Target) error {
+	for i := len(ops) - 1; i >= 0; i-- {
+		op := ops[i]
+		rel := filepath.FromSlash(op.Path)
+		if op.Type != OpChmod {
+			if err := m.applyMode(rel, op, target); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := target.Chmod(rel, modeBits(op.Mode)); err != nil {
+			return fmt.Errorf("error setting permissions on %s: %w", rel, err)
+		}
+		m.recordOperation(op)
+	}
+	return nil
+}
+
+// Phases of a plan that must not overlap
+const (
+	phaseTransfer = iota
+	phaseDelete
+	phaseDirTimes
+)
+
+// opPhase returns the phase an operation belongs to
+func opPhase(op Operation) int {
+	switch {
+	case op.Type == OpDelete:
+		return phaseDelete
+	case op.Type == OpTouch && op.Mode.IsDir():
+		return phaseDirTimes
+	default:
+		return phaseTransfer
+	}
+}
+
+// execute applies a single operation and records it in the manifest
+func (m *Manager) execute(op Operation, source string, target Target, cryptoManager *crypto.Manager, tracker *progress.Tracker) error {
+	if err := m.apply(op, source, target, cryptoManager, tracker); err != nil {
+		return err
+	}
+	m.recordOperation(op)
+	return nil
+}
+
+// apply applies a single operation
+func (m *Manager) apply(op Operation, source string, target Target, cryptoManager *crypto.Manager, tracker *progress.Tracker) error {
+	rel := filepath.FromSlash(op.Path)
+
+	switch op.Type {
+	case OpMkdir:
+		// Replace whatever non-directory is in the way
+		if destInfo, err := target.Lstat(rel); err == nil && !destInfo.IsDir() {
+			if err := target.RemoveAll(rel); err != nil {
+				return fmt.Errorf("error replacing %s: %w", rel, err)
+			}
+		}
+		if err := target.MkdirAll(rel, 0777); err != nil {
+			return fmt.Errorf("error creating directory %s: %w", rel, err)
+		}
+		// The mode is applied once the contents are in place
+		return m.applyAttributes(filepath.Join(source, rel), rel, op, target)
+
+	case OpCreate, OpUpdate:
+		return m.syncFile(filepath.Join(source, rel), rel, op, target, cryptoManager, tracker)
+
+	case OpSymlink:
+		// Remove existing entry if it exists
+		if _, err := target.Lstat(rel); err == nil {
+			if err := target.RemoveAll(rel); err != nil {
+				return fmt.Errorf("error replacing %s: %w", rel, err)
+			}
+		}
+
+		// Create parent directory
+		if err := target.MkdirAll(filepath.Dir(rel), 0755); err != nil {
+			return fmt.Errorf("error creating parent directory for symlink: %w", err)
+		}
+
+		// Create new symlink
+		if err := target.Symlink(op.Link, rel); err != nil {
+			return fmt.Errorf("error creating symlink %s: %w", rel, err)
+		}
+		return m.applyAttributes(filepath.Join(source, rel), rel, op, target)
+
+	case OpChmod:
+		if err := target.Chmod(rel, modeBits(op.Mode)); err != nil {
+			return fmt.Errorf("error setting permissions on %s: %w", rel, err)
+		}
+		return nil
+
+	case OpTouch:
+		return m.applyTimes(rel, op, target)
+
+	case OpChown:
+		// Changing the owner clears setuid and setgid bits
+		if err := m.applyAttributes(filepath.Join(source, rel), rel, op, target); err != nil {
+			return err
+		}
+		if isSymlink(op.Mode) || op.Mode.IsDir() {
+			return nil
+		}
+		return m.applyMode(rel, op, target)
+
+	case OpXattrs:
+		return m.applyAttributes(filepath.Join(source, rel), rel, op, target)
+
+	case OpRename:
+		if err := target.Rename(rel, filepath.FromSlash(op.To)); err != nil {
+			return fmt.Errorf("error renaming %s to %s: %w", rel, op.To, err)
+		}
+		return nil
+
+	case OpDelete:
+		if err := target.RemoveAll(rel); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("error deleting %s: %w", rel, err)
+		}
+		m.countDelete()
+		return nil
+
+	default:
+		return fmt.Errorf("unknown operation %q for %s", op.Type, op.Path)
+	}
+}
+
+// syncFile writes a single regular file to the target
+func (m *Manager) syncFile(source, rel string, op Operation, target Target, cryptoManager *crypto.Manager, tracker *progress.Tracker) error {
+	defer tracker.Update(op.Size)
+
+	// Ensure destination directory exists
+	if err := target.MkdirAll(filepath.Dir(rel), 0755); err != nil {
+		return fmt.Errorf("error creating destination directory: %w", err)
+	}
+
+	// Without preserving the mode, existing files keep theirs and new
+	// ones get the target's default
+	var perm os.FileMode
+	if m.preserve.Has(PreserveMode) {
+		perm = op.Mode.Perm()
+	}
+
+	// Never write through a symlink or into a directory left in the way
+	if destInfo, err := target.Lstat(rel); err == nil {
+		if !destInfo.Mode().IsRegular() {
+			if err := target.RemoveAll(rel); err != nil {
+				return fmt.Errorf("error replacing %s: %w", rel, err)
+			}
+		} else if perm == 0 {
+			perm = destInfo.Mode().Perm()
+		}
+	}
+
+	if err := m.transferFile(source, rel, target, perm, cryptoManager); err != nil {
+		return err
+	}
+
+	m.countTransfer(op.Size)
+
+	// The owner goes first since changing it clears setuid and setgid bits
+	if err := m.applyAttributes(source, rel, op, target); err != nil {
+		return err
+	}
+	if err := m.applyMode(rel, op, target); err != nil {
+		return err
+	}
+
+	// Preserve modification time so unchanged files are skipped next run
+	if m.preserve.Has(PreserveTimes) {
+		return m.applyTimes(rel, op, target)
+	}
+	return nil
+}
+
+// applyMode sets the permissions of an entry if the mode is preserved
+func (m *Manager) applyMode(rel string, op Operation, target Target) error {
+	if !m.preserve.Has(PreserveMode) {
+		return nil
+	}
+	if err := target.Chmod(rel, modeBits(op.Mode)); err != nil {
+		return fmt.Errorf("error setting permissions on %s: %w", rel, err)
+	}
+	return nil
+}
+
+// applyTimes sets the access and modification times of an entry
+func (m *Manager) applyTimes(rel string, op Operation, target Target) error {
+	atime := op.ATime
+	if atime.IsZero() {
+		atime = op.ModTime
+	}
+	if err := target.Chtimes(rel, atime, op.ModTime); err != nil {
+		return fmt.Errorf("error setting times on %s: %w", rel, err)
+	}
+	return nil
+}
+
+// RecordState updates the state with the destination as it is after a
+// one-way sync. Destination versions that won a conflict keep their old
+// record, so they are reported again instead of being overwritten later.
+func (m *Manager) RecordState(plan *Plan, target Target, state *State) error {
+	entries, err := m.scanTarget(target)
+	if err != nil {
+		return fmt.Errorf("error scanning %s: %w", target, err)
+	}
+
+	for _, conflict := range plan.Conflicts {
+		if conflict.Resolution == ResolvedSource || conflict.Resolution == ResolvedBoth {
+			continue
+		}
+		if old, ok := state.Entries[conflict.Path]; ok {
+			entries[conflict.Path] = old
+		}
+	}
+
+	state.Entries = entries
+	state.Synced = time.Now()
+	return nil
+}
@@ -0,0 +1,83 @@
+package sync
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// readOnlyTree creates a tree whose directory only becomes read-only once
+// its file is written, and restores the permissions when the test ends
+func readOnlyTree(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	sub := filepath.Join(dir, "ro")
+	if err := os.Mkdir(sub, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(sub, "file"), "file\n", time.Now().Add(-time.Hour))
+	if err := os.Chmod(sub, 0555); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chmod(sub, 0755) })
+	return dir
+}
+
+// checkReadOnlyTree checks that dir holds the tree of readOnlyTree
+func checkReadOnlyTree(t *testing.T, dir string) {
+	t.Helper()
+	sub := filepath.Join(dir, "ro")
+	t.Cleanup(func() { os.Chmod(sub, 0755) })
+	info, err := os.Stat(sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0555 {
+		t.Errorf("directory mode %o, want 555", perm)
+	}
+	if data, err := os.ReadFile(filepath.Join(sub, "file")); err != nil || string(data) != "file\n" {
+		t.Errorf("file holds %q, %v", data, err)
+	}
+}
+
+func TestSyncReadOnlyDirectory(t *testing.T) {
+	source, dest := readOnlyTree(t), t.TempDir()
+	if err := NewManager(Options{}).Sync(source, NewLocalTarget(dest), nil); err != nil {
+		t.Fatal(err)
+	}
+	checkReadOnlyTree(t, dest)
+}
+
+func TestBidirectionalReadOnlyDirectory(t *testing.T) {
+	tests := []struct {
+		name string
+		aToB bool
+	}{
+		{name: "a to b", aToB: true},
+		{name: "b to a"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dirA, dirB := readOnlyTree(t), t.TempDir()
+			if !tt.aToB {
+				dirA, dirB = dirB, dirA
+			}
+			m := NewManager(Options{})
+			state := NewState(dirA, dirB)
+			plan, err := m.PlanBidirectional(dirA, NewLocalTarget(dirB), state)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := m.ExecuteBidirectional(plan, dirA, NewLocalTarget(dirB), state); err != nil {
+				t.Fatal(err)
+			}
+			if tt.aToB {
+				checkReadOnlyTree(t, dirB)
+			} else {
+				checkReadOnlyTree(t, dirA)
+			}
+		})
+	}
+}
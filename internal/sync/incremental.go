@@ -0,0 +1,197 @@
+package sync
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gosync/internal/platform"
+	"gosync/pkg/utils"
+)
+
+// PlanPaths plans the synchronization of just the given paths, relative to
+// the source, as reported by a watcher. Directories are planned with
+// everything inside them, and paths that no longer exist in the source are
+// deleted from the target. Moved entries are renamed on the target where
+// possible instead of being transferred again.
+func (m *Manager) PlanPaths(source string, target Target, paths []string, moves []Move, encrypt bool) (*Plan, error) {
+	plan := &Plan{
+		Version:        planVersion,
+		Created:        time.Now(),
+		Source:         source,
+		Encrypt:        encrypt,
+		EncryptNames:   encryptsNames(target),
+		Preserve:       m.preserve,
+		IgnorePatterns: m.ignorePatterns,
+		Operations:     []Operation{},
+		incremental:    true,
+	}
+	if err := m.checkPreserve(target, encrypt); err != nil {
+		return nil, err
+	}
+
+	// Renames go first so later operations find entries at their new paths
+	parents := make(map[string]bool)
+	moved := make(map[string]bool)
+	for _, move := range moves {
+		ok, err := m.planMove(plan, source, move, target, parents)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			// Synchronize both paths as if they were unrelated
+			paths = append(paths, move.From, move.To)
+			continue
+		}
+		moved[filepath.Clean(move.From)] = false
+		moved[filepath.Clean(move.To)] = true
+	}
+
+	var deletes []Operation
+	for _, rel := range m.coverPaths(source, paths, moved) {
+		if err := m.planParent(plan, source, rel, parents); err != nil {
+			return nil, err
+		}
+
+		if !exists(filepath.Join(source, rel)) {
+			op, err := m.planRemoval(rel, target)
+			if err != nil {
+				return nil, err
+			}
+			if op != nil {
+				deletes = append(deletes, *op)
+			}
+			continue
+		}
+
+		if err := m.planTree(plan, source, rel, target); err != nil {
+			return nil, err
+		}
+	}
+	plan.Operations = append(plan.Operations, deletes...)
+
+	plan.restoreDirTimes()
+	return plan, nil
+}
+
+// planTree plans a source entry and, for directories, everything inside it
+func (m *Manager) planTree(plan *Plan, source, rel string, target Target) error {
+	return m.walkTree(source, filepath.Join(source, rel), func(path, rel string, info os.FileInfo) error {
+		link, err := readLink(path, info)
+		if err != nil {
+			return err
+		}
+		return m.planEntry(plan, path, rel, link, info, target)
+	})
+}
+
+// coverPaths cleans a list of changed paths, dropping ignored ones and
+// those covered by another listed path: existing entries inside a listed
+// directory are planned along with it, and removed entries inside a removed
+// directory are deleted with it. A removed entry inside a directory that
+// exists again is kept, as the directory may have been replaced. Paths of
+// moves, mapped to whether they exist, cover paths the same way without
+// being listed themselves. The result is sorted.
+func (m *Manager) coverPaths(source string, paths []string, moved map[string]bool) []string {
+	present := make(map[string]bool)
+	for rel, exists := range moved {
+		present[rel] = exists
+	}
+	var cleaned []string
+	for _, rel := range paths {
+		rel, ok := cleanRel(rel)
+		if !ok {
+			continue
+		}
+		if _, seen := present[rel]; seen || m.isIgnoredPath(rel) {
+			continue
+		}
+		present[rel] = exists(filepath.Join(source, rel))
+		cleaned = append(cleaned, rel)
+	}
+	sort.Strings(cleaned)
+
+	var covered []string
+	for _, rel := range cleaned {
+		inside := false
+		for dir := rel; dir != "." && !inside; {
+			dir = filepath.Dir(dir)
+			parent, listed := present[dir]
+			inside = listed && parent == present[rel]
+		}
+		if !inside {
+			covered = append(covered, rel)
+		}
+	}
+	return covered
+}
+
+// cleanRel cleans a path relative to the source, rejecting paths outside it
+func cleanRel(rel string) (string, bool) {
+	rel = filepath.Clean(rel)
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) || filepath.IsAbs(rel) {
+		return "", false
+	}
+	return rel, true
+}
+
+// exists reports whether a source entry exists, without following symlinks
+func exists(path string) bool {
+	_, err := os.Lstat(path)
+	return !os.IsNotExist(err)
+}
+
+// isIgnoredPath checks a path and all its parent directories against the
+// ignore patterns
+func (m *Manager) isIgnoredPath(rel string) bool {
+	for ; rel != "." && rel != string(filepath.Separator); rel = filepath.Dir(rel) {
+		if m.isIgnored(rel) {
+			return true
+		}
+	}
+	return false
+}
+
+// planRemoval plans deleting a path that disappeared from the source
+func (m *Manager) planRemoval(rel string, target Target) (*Operation, error) {
+	destInfo, err := target.Lstat(rel)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error checking %s: %w", rel, err)
+	}
+	if !destInfo.IsDir() && (isConflictName(rel) || utils.IsTempFile(rel) || utils.IsPartialFile(rel)) {
+		return nil, nil
+	}
+	return &Operation{Type: OpDelete, Path: filepath.ToSlash(rel)}, nil
+}
+
+// planParent registers the parent directory of a changed path for having
+// its times restored, as creating or removing entries changes them
+func (m *Manager) planParent(plan *Plan, source, rel string, parents map[string]bool) error {
+	if !m.preserve.Has(PreserveTimes) || rel == "." {
+		return nil
+	}
+	dir := filepath.Dir(rel)
+	if parents[dir] {
+		return nil
+	}
+	parents[dir] = true
+
+	info, err := os.Lstat(filepath.Join(source, dir))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error checking %s: %w", dir, err)
+	}
+	plan.dirTimes = append(plan.dirTimes, dirTime{
+		op:      Operation{Type: OpTouch, Path: filepath.ToSlash(dir), Mode: info.Mode(), ModTime: info.ModTime(), ATime: platform.AccessTime(info)},
+		current: true,
+	})
+	return nil
+}
@@ -0,0 +1,282 @@
+package sync
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"gosync/internal/crypto"
+)
+
+// manifestName is the file at the root of an encrypted destination that
+// records every entry as it was in the source. Its name is not encrypted,
+// so it is found without decrypting the tree.
+const manifestName = ".gosync-manifest"
+
+// manifestVersion is bumped whenever the manifest format changes
+const manifestVersion = 1
+
+// ManifestEntry records a synchronized entry as it was in the source. Hash
+// is the SHA-256 of the plaintext and CipherHash the content hash of the
+// encrypted file, as computed by crypto.ContentHash.
+type ManifestEntry struct {
+	Type       string      `json:"type"`
+	Size       int64       `json:"size,omitempty"`
+	Mode       os.FileMode `json:"mode"`
+	ModTime    time.Time   `json:"mtime,omitempty"`
+	Link       string      `json:"link,omitempty"`
+	Hash       string      `json:"hash,omitempty"`
+	CipherHash string      `json:"cipher_hash,omitempty"`
+	// SealedAs is the path the file was encrypted for if it was renamed
+	// since, as versions kept by keep-both are
+	SealedAs string `json:"sealed_as,omitempty"`
+}
+
+// Manifest lists the entries of an encrypted destination, keyed by
+// slash-separated plaintext path. It is stored encrypted with the keyring,
+// which authenticates it, so files that were swapped, replaced or deleted
+// at the destination are detected when restoring.
+type Manifest struct {
+	Version int                      `json:"version"`
+	Updated time.Time                `json:"updated"`
+	Entries map[string]ManifestEntry `json:"entries"`
+
+	// children indexes the entries by parent directory, so subtrees are
+	// found without scanning every entry
+	children map[string]map[string]bool
+	// changed is set once the manifest differs from the stored one
+	changed bool
+}
+
+// NewManifest creates an empty manifest
+func NewManifest() *Manifest {
+	return &Manifest{
+		Version: manifestVersion,
+		Entries: make(map[string]ManifestEntry),
+	}
+}
+
+// set records an entry
+func (m *Manifest) set(p string, entry ManifestEntry) {
+	if _, ok := m.Entries[p]; !ok {
+		m.index()
+		parent := path.Dir(p)
+		if m.children[parent] == nil {
+			m.children[parent] = make(map[string]bool)
+		}
+		m.children[parent][p] = true
+	}
+	m.Entries[p] = entry
+	m.changed = true
+}
+
+// removeTree removes an entry along with everything below it and returns
+// the removed entries
+func (m *Manifest) removeTree(p string) map[string]ManifestEntry {
+	m.index()
+	removed := make(map[string]ManifestEntry)
+	var remove func(p string)
+	remove = func(p string) {
+		if entry, ok := m.Entries[p]; ok {
+			removed[p] = entry
+			delete(m.Entries, p)
+		}
+		for child := range m.children[p] {
+			remove(child)
+		}
+		delete(m.children, p)
+	}
+	remove(p)
+	delete(m.children[path.Dir(p)], p)
+
+	if len(removed) > 0 {
+		m.changed = true
+	}
+	return removed
+}
+
+// index builds the index of children if it does not exist yet
+func (m *Manifest) index() {
+	if m.children != nil {
+		return
+	}
+	m.children = make(map[string]map[string]bool)
+	for p := range m.Entries {
+		parent := path.Dir(p)
+		if m.children[parent] == nil {
+			m.children[parent] = make(map[string]bool)
+		}
+		m.children[parent][p] = true
+	}
+}
+
+// ReadManifest reads the manifest of an encrypted target, returning nil if
+// it has none
+func ReadManifest(target Target, cryptoManager *crypto.Manager) (*Manifest, error) {
+	in, err := unwrapNames(target).Open(manifestName)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error opening manifest: %w", err)
+	}
+	defer in.Close()
+
+	var data bytes.Buffer
+	if err := cryptoManager.DecryptMetadata(&data, in, manifestName); err != nil {
+		return nil, fmt.Errorf("error decrypting manifest: %w", err)
+	}
+	manifest := &Manifest{}
+	if err := json.Unmarshal(data.Bytes(), manifest); err != nil {
+		return nil, fmt.Errorf("error parsing manifest: %w", err)
+	}
+	if manifest.Version != manifestVersion {
+		return nil, fmt.Errorf("unsupported manifest version %d", manifest.Version)
+	}
+	if manifest.Entries == nil {
+		manifest.Entries = make(map[string]ManifestEntry)
+	}
+	return manifest, nil
+}
+
+// writeManifest encrypts the manifest and replaces the one of the target
+func writeManifest(manifest *Manifest, target Target, cryptoManager *crypto.Manager) error {
+	manifest.Updated = time.Now()
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return fmt.Errorf("error marshaling manifest: %w", err)
+	}
+	var encrypted bytes.Buffer
+	if err := cryptoManager.EncryptMetadata(&encrypted, bytes.NewReader(data), manifestName); err != nil {
+		return fmt.Errorf("error encrypting manifest: %w", err)
+	}
+
+	// Replacing the manifest must not change the times of the root, which
+	// were set to those of the source
+	raw := unwrapNames(target)
+	root, rootErr := raw.Lstat(".")
+	if err := raw.WriteFile(manifestName, &encrypted, 0600); err != nil {
+		return fmt.Errorf("error writing manifest: %w", err)
+	}
+	if rootErr == nil {
+		if err := raw.Chtimes(".", root.ModTime(), root.ModTime()); err != nil {
+			return fmt.Errorf("error setting times on %s: %w", target, err)
+		}
+	}
+	return nil
+}
+
+// LoadManifest reads the manifest of an encrypted target for the next sync.
+// Planning then also transfers files the manifest does not record, and
+// Execute keeps it up to date. Managers without a keyring have no manifest,
+// since they cannot authenticate it.
+func (m *Manager) LoadManifest(target Target, cryptoManager *crypto.Manager) error {
+	if cryptoManager == nil || !cryptoManager.HasKeyring() {
+		return nil
+	}
+	manifest, err := ReadManifest(target, cryptoManager)
+	if err != nil {
+		return err
+	}
+	if manifest == nil {
+		manifest = NewManifest()
+		manifest.changed = true
+	}
+	m.manifest = manifest
+	return nil
+}
+
+// unrecorded reports whether an encrypted plan has to rewrite an entry
+// that is up to date but missing from the manifest
+func (m *Manager) unrecorded(plan *Plan, slashRel, typ, link string) bool {
+	if !plan.Encrypt || m.manifest == nil {
+		return false
+	}
+	entry, ok := m.manifest.Entries[slashRel]
+	return !ok || entry.Type != typ || entry.Link != link
+}
+
+// recordsFile reports whether the manifest records the current version of
+// a source file
+func (m *Manager) recordsFile(slashRel string, info os.FileInfo) bool {
+	entry, ok := m.manifest.Entries[slashRel]
+	return ok && entry.Type == EntryFile && entry.CipherHash != "" &&
+		entry.Size == info.Size() && sameModTime(entry.ModTime, info.ModTime())
+}
+
+// recordContents records the hashes of a file just written to the target
+func (m *Manager) recordContents(rel string, size int64, hash, cipherHash []byte) {
+	if m.manifest == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.manifest.set(filepath.ToSlash(rel), ManifestEntry{
+		Type:       EntryFile,
+		Size:       size,
+		Hash:       hex.EncodeToString(hash),
+		CipherHash: hex.EncodeToString(cipherHash),
+	})
+}
+
+// recordOperation updates the manifest after an operation succeeded
+func (m *Manager) recordOperation(op Operation) {
+	if m.manifest == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	manifest := m.manifest
+	entry, ok := manifest.Entries[op.Path]
+	switch op.Type {
+	case OpMkdir:
+		manifest.set(op.Path, ManifestEntry{Type: EntryDir, Mode: op.Mode})
+	case OpCreate, OpUpdate:
+		// The contents were recorded when the file was written
+		entry.Mode = op.Mode
+		entry.ModTime = op.ModTime
+		manifest.set(op.Path, entry)
+	case OpSymlink:
+		manifest.set(op.Path, ManifestEntry{Type: EntrySymlink, Mode: op.Mode, Link: op.Link})
+	case OpChmod:
+		if ok {
+			entry.Mode = op.Mode
+			manifest.set(op.Path, entry)
+		}
+	case OpTouch:
+		if ok {
+			entry.ModTime = op.ModTime
+			manifest.set(op.Path, entry)
+		}
+	case OpRename:
+		// Files stay encrypted for the path they were written to
+		for p, entry := range manifest.removeTree(op.Path) {
+			if entry.Type == EntryFile && entry.SealedAs == "" {
+				entry.SealedAs = p
+			}
+			manifest.set(op.To+p[len(op.Path):], entry)
+		}
+	case OpDelete:
+		manifest.removeTree(op.Path)
+	}
+}
+
+// matches reports whether a decrypted file is the one the entry records
+func (e *ManifestEntry) matches(size int64, hash, cipherHash []byte) bool {
+	return e.Type == EntryFile && e.Size == size &&
+		e.Hash == hex.EncodeToString(hash) && e.CipherHash == hex.EncodeToString(cipherHash)
+}
+
+// sealedPath returns the path a file was encrypted for
+func sealedPath(rel string, entry *ManifestEntry) string {
+	if entry != nil && entry.SealedAs != "" {
+		return entry.SealedAs
+	}
+	return filepath.ToSlash(rel)
+}
@@ -0,0 +1,79 @@
+package sync
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestRecordOperation(t *testing.T) {
+	tests := []struct {
+		name string
+		op   Operation
+		want []string
+	}{
+		{
+			name: "rename directory",
+			op:   Operation{Type: OpRename, Path: "docs", To: "papers"},
+			want: []string{"docs2", "docs2/c", "papers", "papers/a", "papers/old", "papers/old/b", "top"},
+		},
+		{
+			name: "rename file",
+			op:   Operation{Type: OpRename, Path: "docs/a", To: "docs/z"},
+			want: []string{"docs", "docs/old", "docs/old/b", "docs/z", "docs2", "docs2/c", "top"},
+		},
+		{
+			name: "delete directory",
+			op:   Operation{Type: OpDelete, Path: "docs"},
+			want: []string{"docs2", "docs2/c", "top"},
+		},
+		{
+			name: "delete missing",
+			op:   Operation{Type: OpDelete, Path: "doc"},
+			want: []string{"docs", "docs/a", "docs/old", "docs/old/b", "docs2", "docs2/c", "top"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewManager(Options{})
+			m.manifest = NewManifest()
+			for _, dir := range []string{"docs", "docs/old", "docs2"} {
+				m.recordOperation(Operation{Type: OpMkdir, Path: dir, Mode: 0755})
+			}
+			for _, file := range []string{"docs/a", "docs/old/b", "docs2/c", "top"} {
+				m.recordContents(file, 1, []byte{1}, []byte{2})
+			}
+			m.manifest.changed = false
+
+			m.recordOperation(tt.op)
+
+			var got []string
+			for p := range m.manifest.Entries {
+				got = append(got, p)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("entries = %v, want %v", got, tt.want)
+			}
+			if changed := !reflect.DeepEqual(got, []string{"docs", "docs/a", "docs/old", "docs/old/b", "docs2", "docs2/c", "top"}); m.manifest.changed != changed {
+				t.Errorf("changed = %v, want %v", m.manifest.changed, changed)
+			}
+			if tt.op.Type == OpRename {
+				moved := m.manifest.Entries[tt.op.To]
+				if moved.Type == EntryFile && moved.SealedAs != tt.op.Path {
+					t.Errorf("%s sealed as %q, want %q", tt.op.To, moved.SealedAs, tt.op.Path)
+				}
+			}
+
+			// The index must follow the changes
+			m.recordOperation(Operation{Type: OpDelete, Path: "docs2"})
+			m.recordOperation(Operation{Type: OpDelete, Path: "papers"})
+			m.recordOperation(Operation{Type: OpDelete, Path: "docs"})
+			m.recordOperation(Operation{Type: OpDelete, Path: "top"})
+			if len(m.manifest.Entries) != 0 {
+				t.Errorf("entries left after deleting everything: %v", m.manifest.Entries)
+			}
+		})
+	}
+}
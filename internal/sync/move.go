@@ -0,0 +1,154 @@
+package sync
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Move is an entry renamed within the source, with paths relative to it.
+// Verify asks for the contents to be compared before the destination copy
+// is renamed, for moves that were detected by size rather than by identity.
+type Move struct {
+	From   string
+	To     string
+	Verify bool
+}
+
+// planMove plans renaming the destination copy of a moved entry, followed
+// by whatever else changed about it. It reports false if the destination
+// copy cannot simply be renamed, so the paths have to be planned
+// separately.
+func (m *Manager) planMove(plan *Plan, source string, move Move, target Target, parents map[string]bool) (bool, error) {
+	// Encrypted files are bound to their path
+	if plan.Encrypt {
+		return false, nil
+	}
+	from, ok := cleanRel(move.From)
+	if !ok {
+		return false, nil
+	}
+	to, ok := cleanRel(move.To)
+	if !ok || from == to || from == "." || to == "." || m.isIgnoredPath(from) || m.isIgnoredPath(to) {
+		return false, nil
+	}
+	// Moves into the moved entry itself are not renames
+	if strings.HasPrefix(to, from+string(filepath.Separator)) {
+		return false, nil
+	}
+
+	if exists(filepath.Join(source, from)) {
+		return false, nil
+	}
+	info, err := os.Lstat(filepath.Join(source, to))
+	if err != nil {
+		return false, nil
+	}
+
+	destInfo, err := target.Lstat(from)
+	if err != nil || entryType(destInfo) != entryType(info) {
+		return false, nil
+	}
+	if !info.IsDir() && (isConflictName(from) || isConflictName(to)) {
+		return false, nil
+	}
+	if toInfo, err := target.Lstat(to); err == nil && (toInfo.IsDir() || info.IsDir()) {
+		// Only files replace existing entries when renamed
+		return false, nil
+	}
+	if dir := filepath.Dir(to); dir != "." {
+		if dirInfo, err := target.Lstat(dir); err != nil || !dirInfo.IsDir() {
+			return false, nil
+		}
+	}
+
+	if move.Verify && info.Mode().IsRegular() {
+		same, err := m.sameContents(filepath.Join(source, to), from, info, destInfo, target, plan.Encrypt)
+		if err != nil {
+			return false, err
+		}
+		if !same {
+			return false, nil
+		}
+	}
+
+	for _, rel := range []string{from, to} {
+		if err := m.planParent(plan, source, rel, parents); err != nil {
+			return false, err
+		}
+	}
+	plan.add(Operation{Type: OpRename, Path: filepath.ToSlash(from), To: filepath.ToSlash(to)})
+
+	// Plan the new path as if the rename had already happened
+	view := &movedTarget{Target: target, from: from, to: to}
+	if err := m.planTree(plan, source, to, view); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// sameContents compares a source file with a destination file by checksum.
+// Encrypted destinations cannot be compared and never match.
+func (m *Manager) sameContents(path, rel string, info, destInfo os.FileInfo, target Target, encrypted bool) (bool, error) {
+	if encrypted || info.Size() != destInfo.Size() {
+		return false, nil
+	}
+	sourceSum, err := m.checksumCalc.CalculateFileChecksum(path)
+	if err != nil {
+		return false, fmt.Errorf("error calculating checksum of %s: %w", path, err)
+	}
+	destSum, err := m.targetChecksum(target, rel)
+	if err != nil {
+		return false, fmt.Errorf("error calculating checksum of %s: %w", rel, err)
+	}
+	return bytes.Equal(sourceSum, destSum), nil
+}
+
+// movedTarget shows a target as it will be once an entry was renamed, for
+// planning the entry at its new path
+type movedTarget struct {
+	Target
+	from, to string
+}
+
+// path maps a path below the new name to where the entry still is
+func (t *movedTarget) path(rel string) string {
+	if rel == t.to {
+		return t.from
+	}
+	if inside := strings.TrimPrefix(rel, t.to+string(filepath.Separator)); inside != rel {
+		return filepath.Join(t.from, inside)
+	}
+	return rel
+}
+
+func (t *movedTarget) Lstat(rel string) (os.FileInfo, error) {
+	return t.Target.Lstat(t.path(rel))
+}
+
+func (t *movedTarget) Open(rel string) (io.ReadCloser, error) {
+	return t.Target.Open(t.path(rel))
+}
+
+func (t *movedTarget) Readlink(rel string) (string, error) {
+	return t.Target.Readlink(t.path(rel))
+}
+
+func (t *movedTarget) Xattrs(rel string) (map[string][]byte, error) {
+	xattrs, ok := t.Target.(xattrTarget)
+	if !ok {
+		return nil, fmt.Errorf("target %s does not support extended attributes", t.Target)
+	}
+	return xattrs.Xattrs(t.path(rel))
+}
+
+func (t *movedTarget) SetXattrs(rel string, attrs map[string][]byte) error {
+	xattrs, ok := t.Target.(xattrTarget)
+	if !ok {
+		return fmt.Errorf("target %s does not support extended attributes", t.Target)
+	}
+	return xattrs.SetXattrs(t.path(rel), attrs)
+}
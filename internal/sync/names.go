@@ -0,0 +1,261 @@
+package sync
+
+import (
+	"crypto/sha256"
+	"encoding/base32"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gosync/internal/crypto"
+	"gosync/pkg/utils"
+)
+
+// maxNameLength is the longest encrypted name stored as is. It leaves room
+// for the prefix and suffixes of temporary and partial files within the
+// usual limit of 255 bytes.
+const maxNameLength = 200
+
+// Encrypted names longer than maxNameLength are stored under a hash with
+// this prefix, next to a file holding the full name
+const (
+	longNamePrefix = "gosync-long-"
+	longNameSuffix = ".name"
+)
+
+var longNameEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+// nameTarget stores entries of a target under encrypted names, so the
+// destination reveals nothing but the shape of the tree. Paths passed to
+// it are the plaintext ones, and symlink targets are encrypted as well.
+type nameTarget struct {
+	target        Target
+	cryptoManager *crypto.Manager
+}
+
+// EncryptNames wraps a target so that every path component and symlink
+// target is stored encrypted
+func EncryptNames(target Target, cryptoManager *crypto.Manager) (Target, error) {
+	if !cryptoManager.HasNameKey() {
+		return nil, fmt.Errorf("encrypting names requires a symmetric key in the key file")
+	}
+	return &nameTarget{target: target, cryptoManager: cryptoManager}, nil
+}
+
+// encryptsNames reports whether a target stores entries under encrypted
+// names
+func encryptsNames(target Target) bool {
+	_, ok := target.(*nameTarget)
+	return ok
+}
+
+// unwrapNames returns the target a name target stores its entries in, or
+// the target itself
+func unwrapNames(target Target) Target {
+	if names, ok := target.(*nameTarget); ok {
+		return names.target
+	}
+	return target
+}
+
+// storedName returns the name a path component of the plaintext directory
+// parent is stored under, and the full encrypted name if that is too long
+// to be used directly. Leftovers of interrupted writes keep their names, so
+// they can be cleaned up.
+func (t *nameTarget) storedName(parent, name string) (stored, long string) {
+	if name == "." || utils.IsTempFile(name) || utils.IsPartialFile(name) {
+		return name, ""
+	}
+	encrypted := t.cryptoManager.EncryptName(filepath.ToSlash(parent), name)
+	if len(encrypted) <= maxNameLength {
+		return encrypted, ""
+	}
+	sum := sha256.Sum256([]byte(encrypted))
+	return longNamePrefix + longNameEncoding.EncodeToString(sum[:]), encrypted
+}
+
+// path maps a plaintext path to the path it is stored under
+func (t *nameTarget) path(rel string) string {
+	parts := strings.Split(filepath.Clean(rel), string(filepath.Separator))
+	parent := "."
+	for i, part := range parts {
+		parts[i], _ = t.storedName(parent, part)
+		parent = filepath.Join(parent, part)
+	}
+	return filepath.Join(parts...)
+}
+
+// storeLongNames writes the full encrypted names of the long components of
+// a path, once their parent directories exist
+func (t *nameTarget) storeLongNames(rel string) error {
+	dir, parent := "", "."
+	for _, part := range strings.Split(filepath.Clean(rel), string(filepath.Separator)) {
+		stored, long := t.storedName(parent, part)
+		parent = filepath.Join(parent, part)
+		if long != "" {
+			name := filepath.Join(dir, stored+longNameSuffix)
+			if _, err := t.target.Lstat(name); os.IsNotExist(err) {
+				if err := t.target.WriteFile(name, strings.NewReader(long), 0); err != nil {
+					return fmt.Errorf("error storing long name of %s: %w", rel, err)
+				}
+			}
+		}
+		dir = filepath.Join(dir, stored)
+	}
+	return nil
+}
+
+// removeLongName removes the full encrypted name of a removed entry
+func (t *nameTarget) removeLongName(rel string) error {
+	if stored, long := t.storedName(filepath.Dir(rel), filepath.Base(rel)); long != "" {
+		name := filepath.Join(filepath.Dir(t.path(rel)), stored+longNameSuffix)
+		if err := t.target.Remove(name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// plainName decrypts the stored name of an entry in the stored directory
+// dir, whose plaintext path is parent
+func (t *nameTarget) plainName(dir, parent, stored string) (string, error) {
+	if utils.IsTempFile(stored) || utils.IsPartialFile(stored) {
+		return stored, nil
+	}
+	encrypted := stored
+	if strings.HasPrefix(stored, longNamePrefix) {
+		file, err := t.target.Open(filepath.Join(dir, stored+longNameSuffix))
+		if err != nil {
+			return "", fmt.Errorf("error reading long name: %w", err)
+		}
+		data, err := io.ReadAll(io.LimitReader(file, 64<<10))
+		file.Close()
+		if err != nil {
+			return "", fmt.Errorf("error reading long name: %w", err)
+		}
+		encrypted = string(data)
+	}
+	return t.cryptoManager.DecryptName(filepath.ToSlash(parent), encrypted)
+}
+
+func (t *nameTarget) Lstat(rel string) (os.FileInfo, error) {
+	return t.target.Lstat(t.path(rel))
+}
+
+// Walk decrypts the names of the entries it visits. Names that do not
+// decrypt with the key fail the walk, as they belong to another key or
+// were never encrypted.
+func (t *nameTarget) Walk(fn func(rel string, info os.FileInfo) error) error {
+	plainDirs := map[string]string{".": "."}
+	return t.target.Walk(func(stored string, info os.FileInfo) error {
+		if isLongNameFile(stored) || stored == manifestName {
+			return nil
+		}
+		dir := filepath.Dir(stored)
+		name, err := t.plainName(dir, plainDirs[dir], filepath.Base(stored))
+		if err != nil {
+			return fmt.Errorf("error decrypting name of %s: %w", stored, err)
+		}
+		rel := filepath.Join(plainDirs[dir], name)
+		if info.IsDir() {
+			plainDirs[stored] = rel
+		}
+		return fn(rel, info)
+	})
+}
+
+func (t *nameTarget) MkdirAll(rel string, perm os.FileMode) error {
+	if err := t.target.MkdirAll(t.path(rel), perm); err != nil {
+		return err
+	}
+	return t.storeLongNames(rel)
+}
+
+func (t *nameTarget) WriteFile(rel string, r io.Reader, perm os.FileMode) error {
+	if err := t.storeLongNames(rel); err != nil {
+		return err
+	}
+	return t.target.WriteFile(t.path(rel), r, perm)
+}
+
+func (t *nameTarget) Append(rel string, offset int64) (io.WriteCloser, error) {
+	if err := t.storeLongNames(rel); err != nil {
+		return nil, err
+	}
+	return t.target.Append(t.path(rel), offset)
+}
+
+func (t *nameTarget) Open(rel string) (io.ReadCloser, error) {
+	return t.target.Open(t.path(rel))
+}
+
+func (t *nameTarget) Symlink(link, rel string) error {
+	if err := t.storeLongNames(rel); err != nil {
+		return err
+	}
+	return t.target.Symlink(t.cryptoManager.EncryptLink(link), t.path(rel))
+}
+
+func (t *nameTarget) Readlink(rel string) (string, error) {
+	link, err := t.target.Readlink(t.path(rel))
+	if err != nil {
+		return "", err
+	}
+	plain, err := t.cryptoManager.DecryptLink(link)
+	if err != nil {
+		return "", fmt.Errorf("error decrypting symlink %s: %w", rel, err)
+	}
+	return plain, nil
+}
+
+func (t *nameTarget) Remove(rel string) error {
+	if err := t.target.Remove(t.path(rel)); err != nil {
+		return err
+	}
+	return t.removeLongName(rel)
+}
+
+func (t *nameTarget) RemoveAll(rel string) error {
+	if err := t.target.RemoveAll(t.path(rel)); err != nil {
+		return err
+	}
+	return t.removeLongName(rel)
+}
+
+// Rename renames files and symlinks. Directories cannot be renamed, since
+// the names of their contents are encrypted for their path.
+func (t *nameTarget) Rename(from, to string) error {
+	if info, err := t.Lstat(from); err == nil && info.IsDir() {
+		return fmt.Errorf("cannot rename directory %s with encrypted names", from)
+	}
+	if err := t.storeLongNames(to); err != nil {
+		return err
+	}
+	if err := t.target.Rename(t.path(from), t.path(to)); err != nil {
+		return err
+	}
+	return t.removeLongName(from)
+}
+
+func (t *nameTarget) Chmod(rel string, mode os.FileMode) error {
+	return t.target.Chmod(t.path(rel), mode)
+}
+
+func (t *nameTarget) Chtimes(rel string, atime, mtime time.Time) error {
+	return t.target.Chtimes(t.path(rel), atime, mtime)
+}
+
+func (t *nameTarget) Lchown(rel string, uid, gid int) error {
+	return t.target.Lchown(t.path(rel), uid, gid)
+}
+
+func (t *nameTarget) Owner(info os.FileInfo) (uid, gid int, ok bool) {
+	return t.target.Owner(info)
+}
+
+func (t *nameTarget) String() string {
+	return t.target.String()
+}
@@ -0,0 +1,433 @@
+package sync
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"gosync/internal/platform"
+)
+
+// planVersion is bumped whenever the plan file format changes
+const planVersion = 1
+
+// OpType identifies the kind of a planned operation
+type OpType string
+
+const (
+	OpMkdir   OpType = "mkdir"
+	OpCreate  OpType = "create"
+	OpUpdate  OpType = "update"
+	OpDelete  OpType = "delete"
+	OpChmod   OpType = "chmod"
+	OpTouch   OpType = "touch"
+	OpSymlink OpType = "relink"
+	OpRename  OpType = "rename"
+	OpChown   OpType = "chown"
+	OpXattrs  OpType = "xattrs"
+)
+
+// Operation is a single change to the destination. Path is relative to the
+// destination root and always uses forward slashes.
+type Operation struct {
+	Type    OpType      `json:"type"`
+	Path    string      `json:"path"`
+	Mode    os.FileMode `json:"mode,omitempty"`
+	Size    int64       `json:"size,omitempty"`
+	ModTime time.Time   `json:"mtime,omitempty"`
+	ATime   time.Time   `json:"atime,omitempty"`
+	Owner   *Owner      `json:"owner,omitempty"`
+	Link    string      `json:"link,omitempty"`
+	To      string      `json:"to,omitempty"`
+}
+
+// Owner is the numeric owner and group of an entry
+type Owner struct {
+	UID int `json:"uid"`
+	GID int `json:"gid"`
+}
+
+// String formats the operation for dry-run output
+func (op Operation) String() string {
+	switch op.Type {
+	case OpCreate, OpUpdate:
+		return fmt.Sprintf("%-7s %s (%d bytes)", op.Type, op.Path, op.Size)
+	case OpMkdir:
+		return fmt.Sprintf("%-7s %s/", op.Type, op.Path)
+	case OpChmod:
+		return fmt.Sprintf("%-7s %s %04o", op.Type, op.Path, op.Mode.Perm())
+	case OpChown:
+		return fmt.Sprintf("%-7s %s %d:%d", op.Type, op.Path, op.Owner.UID, op.Owner.GID)
+	case OpSymlink:
+		return fmt.Sprintf("%-7s %s -> %s", op.Type, op.Path, op.Link)
+	case OpRename:
+		return fmt.Sprintf("%-7s %s => %s", op.Type, op.Path, op.To)
+	default:
+		return fmt.Sprintf("%-7s %s", op.Type, op.Path)
+	}
+}
+
+// Plan is the ordered list of operations that brings a destination in line
+// with a source. Dest and Remote identify the destination for a later apply,
+// State the state file it records the result in if not the default, and
+// are filled in by the caller.
+type Plan struct {
+	Version        int           `json:"version"`
+	Created        time.Time     `json:"created"`
+	Source         string        `json:"source"`
+	Dest           string        `json:"dest"`
+	Remote         bool          `json:"remote,omitempty"`
+	State          string        `json:"state,omitempty"`
+	Encrypt        bool          `json:"encrypt,omitempty"`
+	EncryptNames   bool          `json:"encrypt_names,omitempty"`
+	Preserve       PreserveFlags `json:"preserve"`
+	IgnorePatterns []string      `json:"ignore_patterns,omitempty"`
+	Fingerprint    string        `json:"fingerprint"`
+	Unchanged      int           `json:"unchanged"`
+	Operations     []Operation   `json:"operations"`
+	Conflicts      []Conflict    `json:"conflicts,omitempty"`
+
+	// incremental is set for plans that only cover some paths
+	incremental bool
+
+	// dirTimes holds the directory times to restore once their contents
+	// are in place
+	dirTimes []dirTime
+}
+
+// dirTime is a candidate for restoring the times of a directory
+type dirTime struct {
+	op Operation
+	// current is set when the destination directory already had the
+	// right modification time while planning
+	current bool
+}
+
+// Plan compares the source directory with the target and returns the
+// operations needed to synchronize them, without changing anything
+func (m *Manager) Plan(source string, target Target, encrypt bool) (*Plan, error) {
+	plan := &Plan{
+		Version:        planVersion,
+		Created:        time.Now(),
+		Source:         source,
+		Encrypt:        encrypt,
+		EncryptNames:   encryptsNames(target),
+		Preserve:       m.preserve,
+		IgnorePatterns: m.ignorePatterns,
+		Operations:     []Operation{},
+	}
+	if err := m.checkPreserve(target, encrypt); err != nil {
+		return nil, err
+	}
+
+	fingerprint := sha256.New()
+	sourceEntries := make(map[string]os.FileMode)
+
+	err := m.walkSource(source, func(path, rel string, info os.FileInfo) error {
+		link, err := addFingerprint(fingerprint, path, rel, info)
+		if err != nil {
+			return err
+		}
+		if rel != "." {
+			sourceEntries[rel] = info.Mode()
+		}
+
+		return m.planEntry(plan, path, rel, link, info, target)
+	})
+	if err != nil {
+		return nil, err
+	}
+	plan.Fingerprint = hex.EncodeToString(fingerprint.Sum(nil))
+
+	if m.deleteMode != DeleteNone {
+		extraneous, err := m.findExtraneous(target, sourceEntries)
+		if err != nil {
+			return nil, err
+		}
+		deletes := make([]Operation, 0, len(extraneous))
+		for _, rel := range extraneous {
+			deletes = append(deletes, Operation{Type: OpDelete, Path: filepath.ToSlash(rel)})
+		}
+		if m.deleteMode == DeleteBefore {
+			plan.Operations = append(deletes, plan.Operations...)
+		} else {
+			plan.Operations = append(plan.Operations, deletes...)
+		}
+	}
+
+	plan.restoreDirTimes()
+	return plan, nil
+}
+
+// planEntry decides what has to happen to a single source entry and adds
+// the resulting operations to the plan
+func (m *Manager) planEntry(plan *Plan, path, rel, link string, info os.FileInfo, target Target) error {
+	slashRel := filepath.ToSlash(rel)
+	mode := info.Mode()
+
+	destInfo, err := target.Lstat(rel)
+	exists := err == nil
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error checking %s: %w", rel, err)
+	}
+
+	owner := m.sourceOwner(info)
+
+	switch {
+	case mode.IsDir():
+		if m.preserve.Has(PreserveTimes) {
+			plan.dirTimes = append(plan.dirTimes, dirTime{
+				op:      Operation{Type: OpTouch, Path: slashRel, Mode: mode, ModTime: info.ModTime(), ATime: platform.AccessTime(info)},
+				current: exists && destInfo.IsDir() && sameModTime(destInfo.ModTime(), info.ModTime()),
+			})
+		}
+		if !exists || !destInfo.IsDir() || m.unrecorded(plan, slashRel, EntryDir, "") {
+			plan.add(Operation{Type: OpMkdir, Path: slashRel, Mode: mode, Owner: owner})
+			return nil
+		}
+		if m.preserve.Has(PreserveMode) && modeBits(destInfo.Mode()) != modeBits(mode) {
+			plan.add(Operation{Type: OpChmod, Path: slashRel, Mode: mode})
+		}
+		return m.planAttributes(plan, path, slashRel, mode, owner, destInfo, target)
+
+	case isSymlink(mode):
+		if exists && isSymlink(destInfo.Mode()) && !m.unrecorded(plan, slashRel, EntrySymlink, link) {
+			if current, err := target.Readlink(rel); err == nil && current == link {
+				plan.Unchanged++
+				return m.planAttributes(plan, path, slashRel, mode, owner, destInfo, target)
+			}
+		}
+		plan.add(Operation{Type: OpSymlink, Path: slashRel, Mode: mode, Link: link, Owner: owner})
+		return nil
+
+	default:
+		changed, err := m.needsUpdate(path, rel, info, target, plan.Encrypt)
+		if err != nil {
+			return err
+		}
+		if changed {
+			op := Operation{
+				Type:    OpCreate,
+				Path:    slashRel,
+				Mode:    mode,
+				Size:    info.Size(),
+				ModTime: info.ModTime(),
+				ATime:   platform.AccessTime(info),
+				Owner:   owner,
+			}
+			if !exists {
+				plan.add(op)
+				return nil
+			}
+			op.Type = OpUpdate
+			return m.planUpdate(plan, op, info, destInfo, target)
+		}
+
+		plan.Unchanged++
+		if m.preserve.Has(PreserveMode) && modeBits(destInfo.Mode()) != modeBits(mode) {
+			plan.add(Operation{Type: OpChmod, Path: slashRel, Mode: mode})
+		}
+		if m.preserve.Has(PreserveTimes) && !sameModTime(destInfo.ModTime(), info.ModTime()) {
+			// Content matched by checksum; align the timestamp
+			plan.add(Operation{Type: OpTouch, Path: slashRel, ModTime: info.ModTime(), ATime: platform.AccessTime(info)})
+		}
+		return m.planAttributes(plan, path, slashRel, mode, owner, destInfo, target)
+	}
+}
+
+// sourceOwner returns the owner to give a destination entry, or nil if
+// ownership is not preserved
+func (m *Manager) sourceOwner(info os.FileInfo) *Owner {
+	if !m.preserve.Has(PreserveOwner) {
+		return nil
+	}
+	uid, gid, ok := platform.FileOwner(info)
+	if !ok {
+		return nil
+	}
+	return &Owner{UID: uid, GID: gid}
+}
+
+// planAttributes plans fixing the owner and extended attributes of an
+// existing destination entry that is otherwise left alone
+func (m *Manager) planAttributes(plan *Plan, path, slashRel string, mode os.FileMode, owner *Owner, destInfo os.FileInfo, target Target) error {
+	if owner != nil {
+		uid, gid, ok := target.Owner(destInfo)
+		if ok && (uid != owner.UID || gid != owner.GID) {
+			plan.add(Operation{Type: OpChown, Path: slashRel, Mode: mode, Owner: owner})
+		}
+	}
+
+	if m.preserve.Has(PreserveXattrs) && !isSymlink(mode) {
+		sourceAttrs, err := platform.Xattrs(path)
+		if err != nil {
+			return fmt.Errorf("error reading extended attributes: %w", err)
+		}
+		destAttrs, err := target.(xattrTarget).Xattrs(filepath.FromSlash(slashRel))
+		if err != nil {
+			return fmt.Errorf("error reading extended attributes: %w", err)
+		}
+		if !sameXattrs(sourceAttrs, destAttrs) {
+			plan.add(Operation{Type: OpXattrs, Path: slashRel, Mode: mode})
+		}
+	}
+	return nil
+}
+
+// restoreDirTimes appends the operations that set directory times. Any
+// change inside a directory updates its modification time, so they run
+// last, for every directory whose contents change.
+func (p *Plan) restoreDirTimes() {
+	changed := make(map[string]bool)
+	for _, op := range p.Operations {
+		switch op.Type {
+		case OpChmod, OpTouch, OpChown, OpXattrs:
+			continue
+		case OpRename:
+			changed[path.Dir(op.To)] = true
+		}
+		changed[path.Dir(op.Path)] = true
+	}
+
+	for _, dir := range p.dirTimes {
+		if !dir.current || changed[dir.op.Path] {
+			p.add(dir.op)
+		}
+	}
+	p.dirTimes = nil
+}
+
+// planUpdate plans overwriting an existing destination file. If the
+// destination changed since the last recorded sync, the conflict policy
+// decides what happens to it.
+func (m *Manager) planUpdate(plan *Plan, op Operation, info, destInfo os.FileInfo, target Target) error {
+	old, known := EntryState{}, false
+	if m.state != nil {
+		old, known = m.state.Entries[op.Path]
+	}
+	destEntry := entryFromInfo(destInfo)
+	if destEntry.Type == EntrySymlink {
+		link, err := target.Readlink(filepath.FromSlash(op.Path))
+		if err != nil {
+			return fmt.Errorf("error reading symlink %s: %w", op.Path, err)
+		}
+		destEntry.Link = link
+	}
+	if !known || destEntry.sameAs(old) {
+		plan.add(op)
+		return nil
+	}
+
+	conflict := Conflict{Path: op.Path, Reason: "destination changed since last sync"}
+	resolution, err := m.resolve(conflict, entryFromInfo(info), destEntry)
+	if err != nil {
+		return err
+	}
+	conflict.Resolution = resolution
+
+	switch resolution {
+	case ResolvedSource:
+		plan.add(op)
+	case ResolvedBoth:
+		conflict.KeptAs = conflictName(op.Path, time.Now())
+		plan.add(Operation{Type: OpRename, Path: op.Path, To: conflict.KeptAs})
+		op.Type = OpCreate
+		plan.add(op)
+	}
+	plan.Conflicts = append(plan.Conflicts, conflict)
+	return nil
+}
+
+// add appends an operation to the plan
+func (p *Plan) add(op Operation) {
+	p.Operations = append(p.Operations, op)
+}
+
+// addFingerprint mixes the state of a source entry into the tree fingerprint
+// and returns the symlink target for symlinks
+func addFingerprint(h hash.Hash, path, rel string, info os.FileInfo) (string, error) {
+	link, err := readLink(path, info)
+	if err != nil {
+		return "", err
+	}
+	fmt.Fprintf(h, "%s\x00%o\x00%d\x00%d\x00%s\n",
+		filepath.ToSlash(rel), uint32(info.Mode()), info.Size(), info.ModTime().UnixNano(), link)
+	return link, nil
+}
+
+// readLink returns the target of a source symlink, or "" for other entries
+func readLink(path string, info os.FileInfo) (string, error) {
+	if !isSymlink(info.Mode()) {
+		return "", nil
+	}
+	link, err := os.Readlink(path)
+	if err != nil {
+		return "", fmt.Errorf("error reading symlink %s: %w", path, err)
+	}
+	return link, nil
+}
+
+// Fingerprint computes a digest of the source tree state (paths, modes,
+// sizes, modification times and symlink targets)
+func (m *Manager) Fingerprint(source string) (string, error) {
+	h := sha256.New()
+	err := m.walkSource(source, func(path, rel string, info os.FileInfo) error {
+		_, err := addFingerprint(h, path, rel, info)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// VerifySource checks that the source tree has not changed since the plan
+// was created
+func (m *Manager) VerifySource(plan *Plan) error {
+	fingerprint, err := m.Fingerprint(plan.Source)
+	if err != nil {
+		return fmt.Errorf("error scanning source: %w", err)
+	}
+	if fingerprint != plan.Fingerprint {
+		return fmt.Errorf("source %s changed since the plan was created", plan.Source)
+	}
+	return nil
+}
+
+// SavePlan writes a plan to the specified JSON file
+func SavePlan(plan *Plan, planPath string) error {
+	data, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error marshaling plan: %w", err)
+	}
+
+	if err := os.WriteFile(planPath, data, 0644); err != nil {
+		return fmt.Errorf("error writing plan file: %w", err)
+	}
+
+	return nil
+}
+
+// LoadPlan reads a plan from the specified JSON file
+func LoadPlan(planPath string) (*Plan, error) {
+	data, err := os.ReadFile(planPath)
+	if err != nil {
+		return nil, fmt.Errorf("error reading plan file: %w", err)
+	}
+
+	plan := &Plan{}
+	if err := json.Unmarshal(data, plan); err != nil {
+		return nil, fmt.Errorf("error parsing plan file: %w", err)
+	}
+	if plan.Version != planVersion {
+		return nil, fmt.Errorf("unsupported plan version %d", plan.Version)
+	}
+
+	return plan, nil
+}
@@ -0,0 +1,166 @@
+package sync
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+
+	"gosync/internal/platform"
+)
+
+// PreserveFlags selects which attributes of source entries are carried
+// over to the destination
+type PreserveFlags int
+
+const (
+	// PreserveMode keeps permission bits, including setuid, setgid and sticky
+	PreserveMode PreserveFlags = 1 << iota
+	// PreserveOwner keeps the numeric owner and group where permitted
+	PreserveOwner
+	// PreserveTimes keeps access and modification times of files and
+	// directories
+	PreserveTimes
+	// PreserveXattrs keeps extended attributes, which include POSIX ACLs
+	PreserveXattrs
+
+	// PreserveAll is what archive mode preserves
+	PreserveAll = PreserveMode | PreserveOwner | PreserveTimes | PreserveXattrs
+	// DefaultPreserve is used when nothing was selected. Times are needed
+	// for the mtime-size comparison to skip unchanged files.
+	DefaultPreserve = PreserveMode | PreserveTimes
+)
+
+var preserveNames = []struct {
+	flag PreserveFlags
+	name string
+}{
+	{PreserveMode, "mode"},
+	{PreserveOwner, "owner"},
+	{PreserveTimes, "times"},
+	{PreserveXattrs, "xattrs"},
+}
+
+// ParsePreserve parses a comma separated list of attributes such as
+// "mode,owner,times,xattrs". "all" selects everything and an empty list
+// selects the default.
+func ParsePreserve(list string) (PreserveFlags, error) {
+	if list == "" {
+		return DefaultPreserve, nil
+	}
+
+	var flags PreserveFlags
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "all" {
+			flags |= PreserveAll
+			continue
+		}
+		found := false
+		for _, p := range preserveNames {
+			if p.name == name {
+				flags |= p.flag
+				found = true
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("unknown attribute %q (want mode, owner, times, xattrs or all)", name)
+		}
+	}
+	return flags, nil
+}
+
+// Has reports whether all of the given flags are set
+func (f PreserveFlags) Has(flag PreserveFlags) bool {
+	return f&flag == flag
+}
+
+// String returns the flags in the form accepted by ParsePreserve
+func (f PreserveFlags) String() string {
+	var names []string
+	for _, p := range preserveNames {
+		if f.Has(p.flag) {
+			names = append(names, p.name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// MarshalText stores the flags in plans by name
+func (f PreserveFlags) MarshalText() ([]byte, error) {
+	return []byte(f.String()), nil
+}
+
+// UnmarshalText reads flags stored by MarshalText
+func (f *PreserveFlags) UnmarshalText(text []byte) error {
+	flags, err := ParsePreserve(string(text))
+	if err != nil {
+		return err
+	}
+	*f = flags
+	return nil
+}
+
+// xattrTarget is implemented by targets that can store extended attributes
+type xattrTarget interface {
+	Xattrs(rel string) (map[string][]byte, error)
+	SetXattrs(rel string, attrs map[string][]byte) error
+}
+
+// checkPreserve rejects attributes that cannot be preserved on a target.
+// Ownership and extended attributes would be stored in plaintext next to
+// encrypted files, and restoring them is not supported.
+func (m *Manager) checkPreserve(target Target, encrypt bool) error {
+	if encrypt && m.preserve&(PreserveOwner|PreserveXattrs) != 0 {
+		return fmt.Errorf("ownership and extended attributes cannot be preserved on encrypted targets")
+	}
+	if _, ok := target.(xattrTarget); m.preserve.Has(PreserveXattrs) && !ok {
+		return fmt.Errorf("target %s does not support extended attributes", target)
+	}
+	return nil
+}
+
+// modeBits returns the part of a file mode that chmod can set
+func modeBits(mode os.FileMode) os.FileMode {
+	return mode & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+}
+
+// sameXattrs compares two sets of extended attributes
+func sameXattrs(a, b map[string][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, value := range a {
+		other, ok := b[name]
+		if !ok || !bytes.Equal(value, other) {
+			return false
+		}
+	}
+	return true
+}
+
+// applyAttributes sets the preserved attributes other than mode and times
+// on a destination entry: ownership and extended attributes
+func (m *Manager) applyAttributes(source, rel string, op Operation, target Target) error {
+	if m.preserve.Has(PreserveOwner) && op.Owner != nil {
+		err := target.Lchown(rel, op.Owner.UID, op.Owner.GID)
+		if err != nil && !os.IsPermission(err) {
+			return fmt.Errorf("error setting owner of %s: %w", rel, err)
+		}
+	}
+
+	if m.preserve.Has(PreserveXattrs) && !isSymlink(op.Mode) {
+		xattrs, ok := target.(xattrTarget)
+		if !ok {
+			return fmt.Errorf("target %s does not support extended attributes", target)
+		}
+		attrs, err := platform.Xattrs(source)
+		if err != nil {
+			return err
+		}
+		if err := xattrs.SetXattrs(rel, attrs); err != nil && !os.IsPermission(err) {
+			return fmt.Errorf("error setting extended attributes of %s: %w", rel, err)
+		}
+	}
+	return nil
+}
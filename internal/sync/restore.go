@@ -0,0 +1,332 @@
+package sync
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gosync/internal/crypto"
+	"gosync/pkg/utils"
+)
+
+// FileError records a file that could not be decrypted or verified
+type FileError struct {
+	Path string
+	Err  error
+}
+
+func (e FileError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Path, e.Err)
+}
+
+// ErrNoManifest is returned by Restore and Verify for a tree whose
+// manifest is missing, unless the Manager was created with NoManifest
+var ErrNoManifest = errors.New("no manifest")
+
+// Files the manifest does not vouch for
+var (
+	errNotInManifest    = errors.New("not recorded in the manifest")
+	errManifestMismatch = errors.New("does not match the manifest")
+)
+
+// RestoreStats summarizes a restore
+type RestoreStats struct {
+	Restored int
+	Bytes    int64
+	// Failed lists the files that were modified, truncated, encrypted
+	// with another key or do not match the manifest. They are not written
+	// to the destination.
+	Failed []FileError
+	// Missing lists the entries the manifest records that are not in the
+	// encrypted tree
+	Missing []string
+	// Manifest is when the manifest checked against was written, or zero
+	// if there was none
+	Manifest time.Time
+}
+
+// Restore decrypts the tree an encrypted sync wrote to source into dest,
+// restoring permissions and modification times. paths limits the restore
+// to the given files and directories, relative to source. Files failing
+// authentication are reported in the stats and do not stop the restore.
+// Every entry is checked against the manifest of the tree, and the
+// attributes it records are restored. A missing manifest is an error if
+// the key is a keyring, which can authenticate it.
+func (m *Manager) Restore(source Target, dest string, paths []string, cryptoManager *crypto.Manager) (*RestoreStats, error) {
+	return m.restore(source, dest, paths, cryptoManager)
+}
+
+// Verify decrypts every file of an encrypted tree without writing it
+// anywhere, checking it like Restore does
+func (m *Manager) Verify(source Target, cryptoManager *crypto.Manager) (*RestoreStats, error) {
+	return m.restore(source, "", nil, cryptoManager)
+}
+
+// restore implements Restore, only verifying files if dest is empty
+func (m *Manager) restore(source Target, dest string, paths []string, cryptoManager *crypto.Manager) (*RestoreStats, error) {
+	if cryptoManager == nil {
+		return nil, fmt.Errorf("restoring requires a key")
+	}
+	if info, err := source.Lstat("."); err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", source, err)
+	} else if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", source)
+	}
+
+	var selected []string
+	for _, path := range paths {
+		rel, ok := cleanRel(path)
+		if !ok {
+			return nil, fmt.Errorf("path %s is outside of %s", path, source)
+		}
+		if _, err := source.Lstat(rel); err != nil {
+			return nil, fmt.Errorf("%s not found in %s", path, source)
+		}
+		selected = append(selected, rel)
+	}
+
+	// Only the keyring authenticates the manifest
+	var manifest *Manifest
+	if cryptoManager.HasKeyring() {
+		var err error
+		if manifest, err = ReadManifest(source, cryptoManager); err != nil {
+			return nil, err
+		}
+		// Without it, deleting the manifest would hide deleted files
+		if manifest == nil && !m.noManifest {
+			return nil, fmt.Errorf("%s: %w", source, ErrNoManifest)
+		}
+	}
+
+	if dest != "" {
+		if err := os.MkdirAll(dest, 0700); err != nil {
+			return nil, fmt.Errorf("error creating directory %s: %w", dest, err)
+		}
+	}
+
+	stats := &RestoreStats{}
+	if manifest != nil {
+		stats.Manifest = manifest.Updated
+	}
+	pool := newWorkerPool(m.workers)
+	defer pool.close()
+
+	// Directory times are set last, once nothing changes inside anymore
+	dirs := []string{"."}
+	seen := map[string]bool{".": true}
+	err := source.Walk(func(rel string, info os.FileInfo) error {
+		if utils.IsTempFile(rel) || utils.IsPartialFile(rel) || rel == manifestName {
+			return nil
+		}
+
+		inside, parent := restoreSelection(rel, selected)
+		if !inside && !parent {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		seen[filepath.ToSlash(rel)] = true
+		entry, listed := manifestEntry(manifest, rel)
+		target := ""
+		if dest != "" {
+			target = filepath.Join(dest, rel)
+		}
+
+		switch {
+		case info.IsDir():
+			if target != "" {
+				if err := os.MkdirAll(target, 0700); err != nil {
+					return fmt.Errorf("error creating directory %s: %w", target, err)
+				}
+			}
+			dirs = append(dirs, rel)
+
+		case !inside:
+			// Only directories lead to the selected paths
+
+		case !listed:
+			m.restoreFailed(stats, rel, errNotInManifest)
+
+		case isSymlink(info.Mode()):
+			link, err := source.Readlink(rel)
+			if err != nil {
+				return fmt.Errorf("error reading symlink %s: %w", rel, err)
+			}
+			if entry != nil && (entry.Type != EntrySymlink || entry.Link != link) {
+				m.restoreFailed(stats, rel, errManifestMismatch)
+				return nil
+			}
+			if target == "" {
+				return nil
+			}
+			if err := os.RemoveAll(target); err != nil {
+				return fmt.Errorf("error replacing %s: %w", target, err)
+			}
+			if err := os.Symlink(link, target); err != nil {
+				return fmt.Errorf("error creating symlink %s: %w", target, err)
+			}
+
+		case info.Mode().IsRegular():
+			pool.submit(func() error {
+				return m.restoreFile(source, rel, target, info, entry, cryptoManager, stats)
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		pool.wait()
+		return stats, fmt.Errorf("error restoring %s: %w", source, err)
+	}
+	if err := pool.wait(); err != nil {
+		return stats, err
+	}
+
+	if manifest != nil {
+		for path := range manifest.Entries {
+			if inside, _ := restoreSelection(filepath.FromSlash(path), selected); inside && !seen[path] {
+				stats.Missing = append(stats.Missing, path)
+			}
+		}
+		sort.Strings(stats.Missing)
+	}
+	if dest == "" {
+		return stats, nil
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		info, err := source.Lstat(dirs[i])
+		if err != nil {
+			return stats, fmt.Errorf("error reading directory %s: %w", dirs[i], err)
+		}
+		entry, _ := manifestEntry(manifest, dirs[i])
+		if err := restoreAttributes(filepath.Join(dest, dirs[i]), info, entry); err != nil {
+			return stats, err
+		}
+	}
+	return stats, nil
+}
+
+// manifestEntry looks up an entry in the manifest. Without a manifest,
+// every entry counts as listed.
+func manifestEntry(manifest *Manifest, rel string) (*ManifestEntry, bool) {
+	if manifest == nil {
+		return nil, true
+	}
+	entry, ok := manifest.Entries[filepath.ToSlash(rel)]
+	if !ok {
+		return nil, false
+	}
+	return &entry, true
+}
+
+// restoreSelection reports whether rel is one of the selected paths or
+// inside one, and whether it is a parent directory of one
+func restoreSelection(rel string, selected []string) (inside, parent bool) {
+	if len(selected) == 0 {
+		return true, false
+	}
+	for _, path := range selected {
+		if path == "." || rel == path || strings.HasPrefix(rel, path+string(filepath.Separator)) {
+			return true, false
+		}
+		if rel == "." || strings.HasPrefix(path, rel+string(filepath.Separator)) {
+			parent = true
+		}
+	}
+	return false, parent
+}
+
+// restoreFile decrypts a single file, checks it against its manifest entry
+// and restores its attributes. Without dest, the file is only checked.
+func (m *Manager) restoreFile(source Target, rel, dest string, info os.FileInfo, entry *ManifestEntry, cryptoManager *crypto.Manager, stats *RestoreStats) error {
+	in, err := source.Open(rel)
+	if err != nil {
+		return fmt.Errorf("error opening %s: %w", rel, err)
+	}
+	defer in.Close()
+
+	out := bufio.NewWriter(io.Discard)
+	var file *utils.AtomicFile
+	if dest != "" {
+		if file, err = utils.CreateAtomic(dest, 0600); err != nil {
+			return fmt.Errorf("error creating %s: %w", dest, err)
+		}
+		defer file.Abort()
+		out.Reset(file)
+	}
+
+	plain := sha256.New()
+	counter := &countWriter{}
+	contents := crypto.NewContentHash()
+	err = cryptoManager.Decrypt(io.MultiWriter(out, plain, counter), io.TeeReader(in, contents), sealedPath(rel, entry))
+	if err == nil && entry != nil && !entry.matches(counter.n, plain.Sum(nil), contents.Sum()) {
+		err = errManifestMismatch
+	}
+	if err != nil {
+		if undecryptable(err) {
+			m.restoreFailed(stats, rel, err)
+			return nil
+		}
+		return fmt.Errorf("error restoring %s: %w", rel, err)
+	}
+
+	if file != nil {
+		if err := out.Flush(); err != nil {
+			return fmt.Errorf("error writing %s: %w", dest, err)
+		}
+		if err := file.Commit(); err != nil {
+			return fmt.Errorf("error writing %s: %w", dest, err)
+		}
+		if err := restoreAttributes(dest, info, entry); err != nil {
+			return err
+		}
+	}
+
+	m.mu.Lock()
+	stats.Restored++
+	stats.Bytes += counter.n
+	m.mu.Unlock()
+	return nil
+}
+
+// restoreFailed records a file that was not restored
+func (m *Manager) restoreFailed(stats *RestoreStats, rel string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stats.Failed = append(stats.Failed, FileError{Path: rel, Err: err})
+}
+
+// undecryptable reports whether an error means that a file was modified,
+// truncated, encrypted with another key or does not match the manifest
+func undecryptable(err error) bool {
+	return errors.Is(err, crypto.ErrAuthentication) || errors.Is(err, crypto.ErrUnknownKey) || errors.Is(err, errManifestMismatch)
+}
+
+// restoreAttributes gives a restored entry the permissions and times
+// recorded in the manifest, or those of its encrypted copy
+func restoreAttributes(path string, info os.FileInfo, entry *ManifestEntry) error {
+	mode, mtime := info.Mode(), info.ModTime()
+	if entry != nil {
+		if entry.Mode != 0 {
+			mode = entry.Mode
+		}
+		if !entry.ModTime.IsZero() {
+			mtime = entry.ModTime
+		}
+	}
+	if err := os.Chmod(path, modeBits(mode)); err != nil {
+		return fmt.Errorf("error setting permissions on %s: %w", path, err)
+	}
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		return fmt.Errorf("error setting times on %s: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package sync
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gosync/internal/crypto"
+)
+
+// encryptedTree syncs a small tree to an encrypted destination and returns
+// the destination along with its key file and key
+func encryptedTree(t *testing.T) (string, string, *crypto.Manager) {
+	t.Helper()
+	keyFile := filepath.Join(t.TempDir(), "master.key")
+	if err := crypto.WriteKeyFile(keyFile); err != nil {
+		t.Fatal(err)
+	}
+	cryptoManager, err := crypto.NewManager(keyFile, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	source, dest := t.TempDir(), t.TempDir()
+	if err := os.Mkdir(filepath.Join(source, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Now().Add(-time.Hour)
+	writeFile(t, filepath.Join(source, "a"), "a", modTime)
+	writeFile(t, filepath.Join(source, "dir", "b"), "b", modTime)
+	if err := NewManager(Options{}).Sync(source, NewLocalTarget(dest), cryptoManager); err != nil {
+		t.Fatal(err)
+	}
+	return dest, keyFile, cryptoManager
+}
+
+func TestVerify(t *testing.T) {
+	tests := []struct {
+		name       string
+		remove     []string
+		noManifest bool
+		wantErr    error
+		missing    int
+	}{
+		{name: "intact"},
+		{name: "file deleted", remove: []string{"dir/b"}, missing: 1},
+		{name: "manifest deleted", remove: []string{manifestName, "dir/b"}, wantErr: ErrNoManifest},
+		{name: "manifest deleted with override", remove: []string{manifestName, "dir/b"}, noManifest: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dest, _, cryptoManager := encryptedTree(t)
+			for _, rel := range tt.remove {
+				if err := os.Remove(filepath.Join(dest, rel)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			m := NewManager(Options{NoManifest: tt.noManifest})
+			stats, err := m.Verify(NewLocalTarget(dest), cryptoManager)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Verify: %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if len(stats.Missing) != tt.missing || len(stats.Failed) != 0 {
+				t.Errorf("%d missing and %d failed, want %d missing", len(stats.Missing), len(stats.Failed), tt.missing)
+			}
+
+			if _, err := m.Restore(NewLocalTarget(dest), t.TempDir(), nil, cryptoManager); err != nil {
+				t.Errorf("Restore: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,223 @@
+package sync
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gosync/pkg/checksum"
+	"gosync/pkg/utils"
+)
+
+const (
+	// resumeBlockSize is the unit partial transfers are checkpointed and
+	// verified in
+	resumeBlockSize = 16 << 20
+	// resumeThreshold is the size from which transfers can be resumed;
+	// smaller files are simply sent again
+	resumeThreshold = 4 * resumeBlockSize
+)
+
+// checkpoint records how much of a partial file was written. It is stored
+// next to the partial file and only ever covers data the target already
+// acknowledged.
+type checkpoint struct {
+	// Size and ModTime identify the version of the source being sent
+	Size      int64     `json:"size"`
+	ModTime   time.Time `json:"mtime"`
+	BlockSize int64     `json:"block_size"`
+	Offset    int64     `json:"offset"`
+	// Blocks holds the SHA-256 of every block up to Offset
+	Blocks []string `json:"blocks"`
+}
+
+// resumable reports whether a transfer of this size keeps a partial file
+// when interrupted
+func resumable(size int64) bool {
+	return size >= resumeThreshold
+}
+
+// resumableCopy sends a file to the target through a partial file that
+// survives interruptions. A later call for the same source version verifies
+// the written prefix and continues where the previous one stopped.
+func (m *Manager) resumableCopy(source, rel string, target Target, perm os.FileMode) error {
+	in, err := os.Open(source)
+	if err != nil {
+		return fmt.Errorf("error opening file %s: %w", source, err)
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return fmt.Errorf("error reading file %s: %w", source, err)
+	}
+
+	dir, base := filepath.Split(rel)
+	partial := filepath.Join(dir, utils.PartialName(base))
+	checkpointRel := filepath.Join(dir, utils.CheckpointName(base))
+
+	ckpt, err := m.resumePoint(in, info, partial, checkpointRel, target)
+	if err != nil {
+		return err
+	}
+	if _, err := in.Seek(ckpt.Offset, io.SeekStart); err != nil {
+		return fmt.Errorf("error reading file %s: %w", source, err)
+	}
+
+	out, err := target.Append(partial, ckpt.Offset)
+	if err != nil {
+		return fmt.Errorf("error opening %s on %s: %w", partial, target, err)
+	}
+
+	buf := make([]byte, ckpt.BlockSize)
+	for ckpt.Offset < ckpt.Size {
+		block := buf
+		if remaining := ckpt.Size - ckpt.Offset; remaining < int64(len(block)) {
+			block = block[:remaining]
+		}
+		n, err := io.ReadFull(in, block)
+		if err == io.ErrUnexpectedEOF || err == io.EOF {
+			err = fmt.Errorf("%s shrank during transfer", source)
+		}
+		if err != nil {
+			out.Close()
+			return fmt.Errorf("error reading file %s: %w", source, err)
+		}
+		if _, err := out.Write(block); err != nil {
+			out.Close()
+			return fmt.Errorf("error writing %s to %s: %w", rel, target, err)
+		}
+
+		ckpt.Offset += int64(n)
+		if ckpt.Offset < ckpt.Size {
+			// The checkpoint must not cover data that is not on disk yet
+			if syncer, ok := out.(interface{ Sync() error }); ok {
+				if err := syncer.Sync(); err != nil {
+					out.Close()
+					return fmt.Errorf("error writing %s to %s: %w", rel, target, err)
+				}
+			}
+			sum := checksum.StrongChecksum(block)
+			ckpt.Blocks = append(ckpt.Blocks, hex.EncodeToString(sum))
+			if err := saveCheckpoint(ckpt, checkpointRel, target); err != nil {
+				out.Close()
+				return err
+			}
+		}
+	}
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("error writing %s to %s: %w", rel, target, err)
+	}
+
+	if perm != 0 {
+		if err := target.Chmod(partial, perm); err != nil {
+			return fmt.Errorf("error setting permissions on %s: %w", rel, err)
+		}
+	}
+	if err := target.Rename(partial, rel); err != nil {
+		return fmt.Errorf("error moving %s into place: %w", rel, err)
+	}
+	if err := target.Remove(checkpointRel); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error removing checkpoint of %s: %w", rel, err)
+	}
+	return nil
+}
+
+// resumePoint decides where a transfer starts. A checkpoint for the same
+// source version is trusted as far as the source blocks still match it and
+// the partial file reads back the same.
+func (m *Manager) resumePoint(in *os.File, info os.FileInfo, partial, checkpointRel string, target Target) (*checkpoint, error) {
+	fresh := &checkpoint{Size: info.Size(), ModTime: info.ModTime(), BlockSize: resumeBlockSize}
+
+	old, err := loadCheckpoint(checkpointRel, target)
+	if err != nil || old.Size != info.Size() || !old.ModTime.Equal(info.ModTime()) || old.BlockSize != resumeBlockSize {
+		return fresh, nil
+	}
+	partialInfo, err := target.Lstat(partial)
+	if err != nil || !partialInfo.Mode().IsRegular() {
+		return fresh, nil
+	}
+
+	// Verify the source prefix the checkpoint covers
+	calc := checksum.NewCalculator(resumeBlockSize)
+	sums, err := calc.CalculateStreamBlockChecksum(io.LimitReader(in, old.Offset))
+	if err != nil {
+		return nil, fmt.Errorf("error verifying %s: %w", in.Name(), err)
+	}
+	valid := 0
+	for valid < len(old.Blocks) && valid < len(sums) && hex.EncodeToString(sums[int64(valid)]) == old.Blocks[valid] {
+		valid++
+	}
+	if int64(valid)*resumeBlockSize > partialInfo.Size() {
+		valid = int(partialInfo.Size() / resumeBlockSize)
+	}
+
+	// Make sure the partial file really holds the verified blocks
+	valid = partialBlocks(target, partial, old.Blocks[:valid])
+	if valid == 0 {
+		return fresh, nil
+	}
+
+	fresh.Offset = int64(valid) * resumeBlockSize
+	fresh.Blocks = old.Blocks[:valid]
+	return fresh, nil
+}
+
+// partialBlocks returns how many of the given blocks a partial file holds
+// intact, reading it back from the start in a single pass. On remote
+// targets this downloads the prefix, which is still cheaper than sending
+// it again.
+func partialBlocks(target Target, rel string, blocks []string) int {
+	if len(blocks) == 0 {
+		return 0
+	}
+	file, err := target.Open(rel)
+	if err != nil {
+		return 0
+	}
+	defer file.Close()
+
+	buf := make([]byte, resumeBlockSize)
+	for i, block := range blocks {
+		_, err := io.ReadFull(file, buf)
+		if err != nil || hex.EncodeToString(checksum.StrongChecksum(buf)) != block {
+			return i
+		}
+	}
+	return len(blocks)
+}
+
+// loadCheckpoint reads the checkpoint of a partial file
+func loadCheckpoint(rel string, target Target) (*checkpoint, error) {
+	file, err := target.Open(rel)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	ckpt := &checkpoint{}
+	if err := json.NewDecoder(file).Decode(ckpt); err != nil {
+		return nil, err
+	}
+	if int64(len(ckpt.Blocks))*ckpt.BlockSize != ckpt.Offset {
+		return nil, fmt.Errorf("inconsistent checkpoint %s", rel)
+	}
+	return ckpt, nil
+}
+
+// saveCheckpoint replaces the checkpoint of a partial file
+func saveCheckpoint(ckpt *checkpoint, rel string, target Target) error {
+	data, err := json.Marshal(ckpt)
+	if err != nil {
+		return fmt.Errorf("error marshaling checkpoint: %w", err)
+	}
+	if err := target.WriteFile(rel, bytes.NewReader(data), 0600); err != nil {
+		return fmt.Errorf("error writing checkpoint %s: %w", rel, err)
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package sync
+
+import (
+	"bytes"
+	"encoding/hex"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gosync/pkg/checksum"
+	"gosync/pkg/utils"
+)
+
+func TestResumePoint(t *testing.T) {
+	const blocks = 3
+	data := make([]byte, (blocks+1)*resumeBlockSize)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	tests := []struct {
+		name string
+		// corrupt is the block of the partial file that is damaged, or -1
+		corrupt int
+		want    int64
+	}{
+		{name: "intact", corrupt: -1, want: blocks * resumeBlockSize},
+		{name: "last block damaged", corrupt: 2, want: 2 * resumeBlockSize},
+		{name: "first block damaged", corrupt: 0, want: 0},
+		{name: "middle block damaged", corrupt: 1, want: resumeBlockSize},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			source := filepath.Join(dir, "source")
+			if err := os.WriteFile(source, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			in, err := os.Open(source)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer in.Close()
+			info, err := in.Stat()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			destDir := t.TempDir()
+			target := NewLocalTarget(destDir)
+			ckpt := &checkpoint{Size: info.Size(), ModTime: info.ModTime(), BlockSize: resumeBlockSize, Offset: blocks * resumeBlockSize}
+			for i := 0; i < blocks; i++ {
+				sum := checksum.StrongChecksum(data[i*resumeBlockSize : (i+1)*resumeBlockSize])
+				ckpt.Blocks = append(ckpt.Blocks, hex.EncodeToString(sum))
+			}
+			checkpointRel := utils.CheckpointName("file")
+			if err := saveCheckpoint(ckpt, checkpointRel, target); err != nil {
+				t.Fatal(err)
+			}
+
+			partial := utils.PartialName("file")
+			written := bytes.Clone(data[:blocks*resumeBlockSize])
+			if tt.corrupt >= 0 {
+				written[tt.corrupt*resumeBlockSize+7] ^= 0xff
+			}
+			if err := os.WriteFile(target.Path(partial), written, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := NewManager(Options{}).resumePoint(in, info, partial, checkpointRel, target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Offset != tt.want {
+				t.Errorf("offset = %d, want %d", got.Offset, tt.want)
+			}
+			if int64(len(got.Blocks))*resumeBlockSize != got.Offset {
+				t.Errorf("%d blocks recorded for offset %d", len(got.Blocks), got.Offset)
+			}
+		})
+	}
+}
@@ -0,0 +1,123 @@
+package sync
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gosync/internal/crypto"
+	"gosync/pkg/utils"
+)
+
+// RotateStats summarizes a key rotation
+type RotateStats struct {
+	Rotated int
+	Current int
+	// Failed lists the files that could not be decrypted. They are left as
+	// they are.
+	Failed []FileError
+}
+
+// Rotate rewraps every file of an encrypted target with the active key.
+// Each file is replaced atomically and keeps its permissions and
+// modification time, and files already using the active key are skipped,
+// so an interrupted rotation continues where it stopped when run again.
+// Files of earlier formats are encrypted again for their path, so targets
+// with encrypted names must be wrapped with EncryptNames.
+func (m *Manager) Rotate(target Target, cryptoManager *crypto.Manager) (*RotateStats, error) {
+	stats := &RotateStats{}
+	pool := newWorkerPool(m.workers)
+	defer pool.close()
+
+	err := target.Walk(func(rel string, info os.FileInfo) error {
+		if !info.Mode().IsRegular() || utils.IsTempFile(rel) || utils.IsPartialFile(rel) || isLongNameFile(rel) || rel == manifestName {
+			return nil
+		}
+		pool.submit(func() error {
+			return m.rotateFile(target, rel, info, cryptoManager, stats)
+		})
+		return nil
+	})
+	if err != nil {
+		pool.wait()
+		return stats, fmt.Errorf("error scanning %s: %w", target, err)
+	}
+
+	// The manifest is stored at the root under its plain name
+	raw := unwrapNames(target)
+	if info, err := raw.Lstat(manifestName); err == nil {
+		pool.submit(func() error {
+			return m.rotateFile(raw, manifestName, info, cryptoManager, stats)
+		})
+	}
+	return stats, pool.wait()
+}
+
+// rotateFile rewraps a single file unless it already uses the active key
+func (m *Manager) rotateFile(target Target, rel string, info os.FileInfo, cryptoManager *crypto.Manager, stats *RotateStats) error {
+	current, err := m.isCurrent(target, rel, cryptoManager)
+	if err != nil {
+		return err
+	}
+	if current {
+		m.mu.Lock()
+		stats.Current++
+		m.mu.Unlock()
+		return nil
+	}
+
+	in, err := target.Open(rel)
+	if err != nil {
+		return fmt.Errorf("error opening %s: %w", rel, err)
+	}
+	defer in.Close()
+
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(cryptoManager.Rewrap(w, in, filepath.ToSlash(rel)))
+	}()
+	defer r.Close()
+
+	if err := target.WriteFile(rel, r, info.Mode().Perm()); err != nil {
+		if undecryptable(err) {
+			m.mu.Lock()
+			stats.Failed = append(stats.Failed, FileError{Path: rel, Err: err})
+			m.mu.Unlock()
+			return nil
+		}
+		return fmt.Errorf("error rotating %s: %w", rel, err)
+	}
+
+	// Unchanged times keep the next sync from transferring the file again
+	if err := target.Chtimes(rel, info.ModTime(), info.ModTime()); err != nil {
+		return fmt.Errorf("error setting times on %s: %w", rel, err)
+	}
+	m.mu.Lock()
+	stats.Rotated++
+	m.mu.Unlock()
+	return nil
+}
+
+// isCurrent reports whether a file already uses the active key
+func (m *Manager) isCurrent(target Target, rel string, cryptoManager *crypto.Manager) (bool, error) {
+	in, err := target.Open(rel)
+	if err != nil {
+		return false, fmt.Errorf("error opening %s: %w", rel, err)
+	}
+	defer in.Close()
+
+	current, err := cryptoManager.Current(in)
+	if err != nil && !undecryptable(err) {
+		return false, fmt.Errorf("error reading %s: %w", rel, err)
+	}
+	return current, nil
+}
+
+// isLongNameFile reports whether a file holds the full encrypted name of a
+// long name
+func isLongNameFile(rel string) bool {
+	base := filepath.Base(rel)
+	return strings.HasPrefix(base, longNamePrefix) && strings.HasSuffix(base, longNameSuffix)
+}
@@ -0,0 +1,103 @@
+package sync
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gosync/internal/crypto"
+)
+
+// contentHashes hashes every file of an encrypted tree like the manifest
+// records them
+func contentHashes(t *testing.T, dir string) map[string][]byte {
+	t.Helper()
+	hashes := make(map[string][]byte)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		hash := crypto.NewContentHash()
+		hash.Write(data)
+		hashes[path] = hash.Sum()
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hashes
+}
+
+func TestRotate(t *testing.T) {
+	dest, keyFile, cryptoManager := encryptedTree(t)
+	before := contentHashes(t, dest)
+
+	keyring, err := crypto.LoadKeyring(keyFile, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldID := cryptoManager.ActiveKey()
+	newID, err := keyring.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotated, err := crypto.NewKeyringManager(keyring)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := NewManager(Options{}).Rotate(NewLocalTarget(dest), rotated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Both files and the manifest
+	if stats.Rotated != 3 || stats.Current != 0 || len(stats.Failed) != 0 {
+		t.Errorf("rotated %d, current %d, failed %v, want 3 rotated", stats.Rotated, stats.Current, stats.Failed)
+	}
+	after := contentHashes(t, dest)
+	if len(after) != len(before) {
+		t.Fatalf("%d files after rotating, want %d", len(after), len(before))
+	}
+	for path, hash := range before {
+		if !bytes.Equal(after[path], hash) {
+			t.Errorf("rotating changed the contents of %s", path)
+		}
+	}
+
+	// The old key is no longer needed
+	var newOnly []crypto.KeyringKey
+	for _, key := range keyring.Keys {
+		if key.ID != oldID {
+			newOnly = append(newOnly, key)
+		}
+	}
+	keyring.Keys = newOnly
+	m, err := crypto.NewKeyringManager(keyring)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.ActiveKey() != newID {
+		t.Fatalf("active key %s, want %s", m.ActiveKey(), newID)
+	}
+	verified, err := NewManager(Options{}).Verify(NewLocalTarget(dest), m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if verified.Restored != 2 || len(verified.Failed) != 0 || len(verified.Missing) != 0 {
+		t.Errorf("verified %d, failed %v, missing %v with the new key alone", verified.Restored, verified.Failed, verified.Missing)
+	}
+
+	// Running again finds nothing left to do
+	stats, err = NewManager(Options{}).Rotate(NewLocalTarget(dest), m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Rotated != 0 || stats.Current != 3 {
+		t.Errorf("second rotation rotated %d, current %d, want 3 current", stats.Rotated, stats.Current)
+	}
+}
@@ -0,0 +1,129 @@
+package sync
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// stateVersion is bumped whenever the state file format changes
+const stateVersion = 1
+
+// Entry types recorded in the state database
+const (
+	EntryFile    = "file"
+	EntryDir     = "dir"
+	EntrySymlink = "symlink"
+)
+
+// EntryState records one side of a path as it was when last synchronized
+type EntryState struct {
+	Type    string      `json:"type"`
+	Size    int64       `json:"size,omitempty"`
+	Mode    os.FileMode `json:"mode,omitempty"`
+	ModTime time.Time   `json:"mtime,omitempty"`
+	Hash    string      `json:"hash,omitempty"`
+	Link    string      `json:"link,omitempty"`
+	// ModTimeB is the modification time on side B of a bidirectional sync
+	// if it differs from ModTime, as on targets that store whole seconds
+	ModTimeB time.Time `json:"mtime_b,omitempty"`
+}
+
+// sameAs reports whether an entry looks unchanged compared to a recorded
+// one. Times are compared at full precision, so edits made within the same
+// second as the recorded version are still noticed.
+func (e EntryState) sameAs(other EntryState) bool {
+	if e.Type != other.Type {
+		return false
+	}
+	switch e.Type {
+	case EntryFile:
+		return e.Size == other.Size && e.ModTime.Equal(other.ModTime)
+	case EntrySymlink:
+		return e.Link == other.Link
+	default:
+		return true
+	}
+}
+
+// sideB returns the entry as recorded for side B of a bidirectional sync
+func (e EntryState) sideB() EntryState {
+	if !e.ModTimeB.IsZero() {
+		e.ModTime = e.ModTimeB
+	}
+	e.ModTimeB = time.Time{}
+	return e
+}
+
+// State is the persistent record of the last successful sync between two
+// trees. Entries are keyed by slash-separated relative path.
+type State struct {
+	Version int                   `json:"version"`
+	A       string                `json:"a"`
+	B       string                `json:"b"`
+	Synced  time.Time             `json:"synced"`
+	Entries map[string]EntryState `json:"entries"`
+}
+
+// NewState creates an empty state for a pair of trees
+func NewState(a, b string) *State {
+	return &State{
+		Version: stateVersion,
+		A:       a,
+		B:       b,
+		Entries: make(map[string]EntryState),
+	}
+}
+
+// LoadState reads the state file, returning an empty state if it does not
+// exist yet
+func LoadState(statePath, a, b string) (*State, error) {
+	data, err := os.ReadFile(statePath)
+	if os.IsNotExist(err) {
+		return NewState(a, b), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading state file: %w", err)
+	}
+
+	state := &State{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("error parsing state file: %w", err)
+	}
+	if state.Version != stateVersion {
+		return nil, fmt.Errorf("unsupported state version %d", state.Version)
+	}
+	if state.A != a || state.B != b {
+		return nil, fmt.Errorf("state file %s belongs to %s <-> %s", statePath, state.A, state.B)
+	}
+	if state.Entries == nil {
+		state.Entries = make(map[string]EntryState)
+	}
+
+	return state, nil
+}
+
+// SaveState writes the state file, replacing the previous one only once the
+// new contents are complete
+func SaveState(state *State, statePath string) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("error marshaling state: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(statePath), 0700); err != nil {
+		return fmt.Errorf("error creating state directory: %w", err)
+	}
+
+	tmp := statePath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("error writing state file: %w", err)
+	}
+	if err := os.Rename(tmp, statePath); err != nil {
+		return fmt.Errorf("error writing state file: %w", err)
+	}
+
+	return nil
+}
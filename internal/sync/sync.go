@@ -1,53 +1,159 @@
 package sync
 
 import (
+	"crypto/sha256"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
 
-	"gosync/internal/progress"
+	"gosync/internal/crypto"
 	"gosync/pkg/checksum"
 	"gosync/pkg/utils"
-	"gosync/internal/crypto"
 )
 
+// defaultBlockSize is used when no block size is configured
+const defaultBlockSize = 4096
+
+// Options configures a sync manager
+type Options struct {
+	BlockSize      int64
+	IgnorePatterns []string
+	Compare        CompareMode
+	Delete         DeleteMode
+	DeleteExcluded bool
+	Conflict       ConflictPolicy
+	// Ask is consulted for every conflict under the ask policy
+	Ask AskFunc
+	// Workers is the number of files transferred concurrently, defaulting
+	// to the number of CPUs
+	Workers int
+	// Preserve selects the attributes carried over, DefaultPreserve if unset
+	Preserve PreserveFlags
+	// NoManifest lets Restore and Verify accept an encrypted tree without
+	// a manifest, where deleted and rolled back files go unnoticed
+	NoManifest bool
+}
+
+// Stats summarizes the outcome of a sync run
+type Stats struct {
+	Transferred int
+	Skipped     int
+	Deleted     int
+	Conflicts   int
+	Bytes       int64
+}
+
 // Manager handles file synchronization operations
 type Manager struct {
-	checksumCalc *checksum.Calculator
-	blockSize    int64
+	checksumCalc   *checksum.Calculator
+	blockSize      int64
 	ignorePatterns []string
+	compare        CompareMode
+	deleteMode     DeleteMode
+	deleteExcluded bool
+	conflictPolicy ConflictPolicy
+	ask            AskFunc
+	workers        int
+	preserve       PreserveFlags
+	noManifest     bool
+	state          *State
+	conflicts      []Conflict
+	// manifest records the entries of an encrypted target
+	manifest *Manifest
+
+	// mu guards stats, which workers update concurrently
+	mu    sync.Mutex
+	stats Stats
 }
 
 // NewManager creates a new sync manager
-func NewManager(blockSize int64, ignorePatterns []string) *Manager {
+func NewManager(opts Options) *Manager {
+	blockSize := opts.BlockSize
+	if blockSize <= 0 {
+		blockSize = defaultBlockSize
+	}
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	preserve := opts.Preserve
+	if preserve == 0 {
+		preserve = DefaultPreserve
+	}
 	return &Manager{
-		checksumCalc:    checksum.NewCalculator(blockSize),
-		blockSize:       blockSize,
-		ignorePatterns: ignorePatterns,
+		checksumCalc:   checksum.NewCalculator(blockSize),
+		blockSize:      blockSize,
+		ignorePatterns: opts.IgnorePatterns,
+		compare:        opts.Compare,
+		deleteMode:     opts.Delete,
+		deleteExcluded: opts.DeleteExcluded,
+		conflictPolicy: opts.Conflict,
+		ask:            opts.Ask,
+		workers:        workers,
+		preserve:       preserve,
+		noManifest:     opts.NoManifest,
 	}
 }
 
+// UseState enables conflict detection for one-way syncs: destination files
+// that changed since the recorded state are handled by the conflict policy
+func (m *Manager) UseState(state *State) {
+	m.state = state
+}
+
+// Stats returns statistics of the last sync run
+func (m *Manager) Stats() Stats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.stats
+}
+
+// countTransfer records a transferred file in the statistics
+func (m *Manager) countTransfer(size int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.stats.Transferred++
+	m.stats.Bytes += size
+}
+
+// countDelete records a deleted entry in the statistics
+func (m *Manager) countDelete() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.stats.Deleted++
+}
+
 // SyncDirectory synchronizes two directories with optional encryption
 func (m *Manager) SyncDirectory(source, dest string, cryptoManager *crypto.Manager) error {
-	// Get total size for progress tracking
-	var totalSize int64
-	err := filepath.Walk(source, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		if !info.IsDir() && !isSymlink(info.Mode()) {
-			totalSize += info.Size()
-		}
-		return nil
-	})
+	return m.Sync(source, NewLocalTarget(dest), cryptoManager)
+}
+
+// Sync synchronizes a local source directory into a target with optional
+// encryption
+func (m *Manager) Sync(source string, target Target, cryptoManager *crypto.Manager) error {
+	if err := m.LoadManifest(target, cryptoManager); err != nil {
+		return err
+	}
+	plan, err := m.Plan(source, target, cryptoManager != nil)
 	if err != nil {
-		return fmt.Errorf("error calculating total size: %w", err)
+		return err
 	}
+	return m.Execute(plan, target, cryptoManager)
+}
 
-	tracker := progress.NewTracker(totalSize)
+// walkSource walks the source tree, skipping ignored entries, and calls fn
+// with the absolute and relative path of each remaining entry
+func (m *Manager) walkSource(source string, fn func(path, rel string, info os.FileInfo) error) error {
+	return m.walkTree(source, source, fn)
+}
 
-	// Walk through source directory
-	return filepath.Walk(source, func(path string, info os.FileInfo, err error) error {
+// walkTree walks the part of the source tree below root like walkSource
+func (m *Manager) walkTree(source, root string, fn func(path, rel string, info os.FileInfo) error) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
@@ -59,73 +165,71 @@ func (m *Manager) SyncDirectory(source, dest string, cryptoManager *crypto.Manag
 		}
 
 		// Skip files matching ignore patterns
-		for _, pattern := range m.ignorePatterns {
-			match, err := filepath.Match(pattern, relativePath)
-			if err != nil {
-				return fmt.Errorf("error matching pattern: %w", err)
-			}
-			if match {
-				return nil
-			}
-		}
-
-		// Construct destination path
-		destPath := filepath.Join(dest, relativePath)
-
-		// Handle different file types
-		mode := info.Mode()
-		switch {
-		case mode.IsDir():
-			// Create directory
-			if err := os.MkdirAll(destPath, mode.Perm()); err != nil {
-				return fmt.Errorf("error creating directory %s: %w", destPath, err)
+		if relativePath != "." && m.isIgnored(relativePath) {
+			if info.IsDir() {
+				return filepath.SkipDir
 			}
 			return nil
+		}
 
-		case isSymlink(mode):
-			// Read and recreate symlink
-			link, err := os.Readlink(path)
-			if err != nil {
-				return fmt.Errorf("error reading symlink %s: %w", path, err)
-			}
-
-			// Remove existing symlink if it exists
-			_ = os.Remove(destPath)
-
-			// Create parent directory
-			if err := os.MkdirAll(filepath.Dir(destPath), 0755); err != nil {
-				return fmt.Errorf("error creating parent directory for symlink: %w", err)
-			}
+		return fn(path, relativePath, info)
+	})
+}
 
-			// Create new symlink
-			if err := os.Symlink(link, destPath); err != nil {
-				return fmt.Errorf("error creating symlink %s: %w", destPath, err)
-			}
-			return nil
+// isIgnored checks a relative path against the ignore patterns. Temporary
+// files of writes in progress and partial transfers are never synchronized
+// either.
+func (m *Manager) isIgnored(rel string) bool {
+	return utils.IsTempFile(rel) || utils.IsPartialFile(rel) || utils.IsPathExcluded(rel, m.ignorePatterns)
+}
 
-		default:
-			// Regular file
-			// Ensure destination directory exists
-			if err := os.MkdirAll(filepath.Dir(destPath), 0755); err != nil {
-				return fmt.Errorf("error creating destination directory: %w", err)
+// removeTempFiles deletes temporary files left in a target by interrupted
+// writes, and partial transfers that can no longer be resumed because their
+// checkpoint is missing
+func (m *Manager) removeTempFiles(target Target) error {
+	var stale []string
+	partials := make(map[string]bool)
+	err := target.Walk(func(rel string, info os.FileInfo) error {
+		switch {
+		case info.IsDir():
+			if m.isIgnored(rel) {
+				return filepath.SkipDir
 			}
+		case utils.IsTempFile(rel):
+			stale = append(stale, rel)
+		case utils.IsPartialFile(rel):
+			partials[rel] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error scanning %s: %w", target, err)
+	}
 
-			// Sync the file with optional encryption
-			if cryptoManager != nil {
-				if err := cryptoManager.EncryptFile(path, destPath); err != nil {
-					return fmt.Errorf("error encrypting file %s: %w", path, err)
-				}
-			} else {
-				if err := utils.CopyFile(path, destPath); err != nil {
-					return fmt.Errorf("error copying file %s: %w", path, err)
-				}
-			}
+	// A partial file and its checkpoint are only useful together
+	for rel := range partials {
+		pair := rel + ".json"
+		if strings.HasSuffix(rel, ".json") {
+			pair = strings.TrimSuffix(rel, ".json")
+		}
+		if !partials[pair] {
+			stale = append(stale, rel)
+		}
+	}
 
-			// Update progress
-			tracker.Update(info.Size())
-			return nil
+	for _, rel := range stale {
+		if err := target.Remove(rel); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("error removing stale temporary file %s: %w", rel, err)
 		}
-	})
+	}
+	return nil
+}
+
+// hasBasis reports whether a local destination holds an older version of a
+// file that a delta can be computed against
+func hasBasis(dest string) bool {
+	destInfo, err := os.Lstat(dest)
+	return err == nil && destInfo.Mode().IsRegular() && destInfo.Size() > 0
 }
 
 // isSymlink checks if the file mode indicates a symbolic link
@@ -133,54 +237,80 @@ func isSymlink(mode os.FileMode) bool {
 	return mode&os.ModeSymlink != 0
 }
 
-// syncFile synchronizes a single file
-func (m *Manager) syncFile(source, dest string, tracker *progress.Tracker) error {
-	sourceInfo, err := os.Stat(source)
-	if err != nil {
-		return err
+// transferFile writes the contents of a source file to the target.
+// Encrypted files are streamed through the cipher into any target, so
+// remote ones only ever receive ciphertext, and local targets get
+// delta transfer. Large files are sent resumably when there is no older
+// version to compute a delta against, and other targets receive a plain
+// stream of the file.
+func (m *Manager) transferFile(source, rel string, target Target, perm os.FileMode, cryptoManager *crypto.Manager) error {
+	if cryptoManager != nil {
+		return m.encryptFile(source, rel, target, perm, cryptoManager)
 	}
 
-	destInfo, err := os.Stat(dest)
-	if err == nil {
-		// File exists, check if it needs updating
-		if sourceInfo.ModTime().Equal(destInfo.ModTime()) &&
-			sourceInfo.Size() == destInfo.Size() {
-			return nil
+	local, isLocal := target.(*LocalTarget)
+
+	if isLocal && hasBasis(local.Path(rel)) {
+		if err := m.deltaCopy(source, local.Path(rel)); err != nil {
+			return fmt.Errorf("error copying file %s: %w", source, err)
 		}
-	} else if !os.IsNotExist(err) {
-		return err
+		return nil
 	}
 
-	// Copy file with progress tracking
-	sourceFile, err := os.Open(source)
+	info, err := os.Stat(source)
 	if err != nil {
-		return err
+		return fmt.Errorf("error reading file %s: %w", source, err)
+	}
+	if resumable(info.Size()) {
+		return m.resumableCopy(source, rel, target, perm)
 	}
-	defer sourceFile.Close()
 
-	destFile, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, sourceInfo.Mode())
+	if isLocal {
+		if err := utils.CopyFile(source, local.Path(rel)); err != nil {
+			return fmt.Errorf("error copying file %s: %w", source, err)
+		}
+		return nil
+	}
+
+	in, err := os.Open(source)
 	if err != nil {
-		return err
+		return fmt.Errorf("error opening file %s: %w", source, err)
 	}
-	defer destFile.Close()
+	defer in.Close()
 
-	buffer := make([]byte, m.blockSize)
-	for {
-		n, err := sourceFile.Read(buffer)
-		if err != nil {
-			if err.Error() == "EOF" {
-				break
-			}
-			return err
-		}
+	if err := target.WriteFile(rel, in, perm); err != nil {
+		return fmt.Errorf("error writing %s to %s: %w", rel, target, err)
+	}
+	return nil
+}
 
-		if _, err := destFile.Write(buffer[:n]); err != nil {
-			return err
-		}
+// encryptFile writes the encrypted contents of a source file to the target,
+// bound to its path, and records their hashes in the manifest
+func (m *Manager) encryptFile(source, rel string, target Target, perm os.FileMode, cryptoManager *crypto.Manager) error {
+	in, err := os.Open(source)
+	if err != nil {
+		return fmt.Errorf("error opening file %s: %w", source, err)
+	}
+	defer in.Close()
 
-		tracker.Update(int64(n))
+	plain := sha256.New()
+	counter := &countWriter{}
+	encrypted := cryptoManager.EncryptReader(io.TeeReader(in, io.MultiWriter(plain, counter)), filepath.ToSlash(rel))
+	defer encrypted.Close()
+	contents := crypto.NewContentHash()
+	if err := target.WriteFile(rel, io.TeeReader(encrypted, contents), perm); err != nil {
+		return fmt.Errorf("error encrypting file %s: %w", source, err)
 	}
+	m.recordContents(rel, counter.n, plain.Sum(nil), contents.Sum())
+	return nil
+}
+
+// countWriter counts the bytes written to it
+type countWriter struct {
+	n int64
+}
 
-	// Preserve modification time
-	return os.Chtimes(dest, sourceInfo.ModTime(), sourceInfo.ModTime())
+func (w *countWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
 }
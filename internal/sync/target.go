@@ -0,0 +1,173 @@
+package sync
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gosync/internal/platform"
+	"gosync/pkg/utils"
+)
+
+// Target is a destination tree that the sync engine writes into. Paths
+// passed to a target are relative to its root and use the local separator.
+type Target interface {
+	// Lstat returns information about an entry without following symlinks
+	Lstat(rel string) (os.FileInfo, error)
+	// Walk visits every entry below the root, parents before children.
+	// Returning filepath.SkipDir for a directory skips its contents. A
+	// missing root is treated as an empty tree.
+	Walk(fn func(rel string, info os.FileInfo) error) error
+	MkdirAll(rel string, perm os.FileMode) error
+	// WriteFile replaces a file with the contents of r. The new contents
+	// become visible all at once, never partially written. A zero perm
+	// leaves the permissions to the target's default.
+	WriteFile(rel string, r io.Reader, perm os.FileMode) error
+	// Append opens a file for writing at offset, creating it if needed and
+	// discarding anything beyond offset. Writers with a Sync method can be
+	// flushed to stable storage.
+	Append(rel string, offset int64) (io.WriteCloser, error)
+	Open(rel string) (io.ReadCloser, error)
+	Symlink(link, rel string) error
+	Readlink(rel string) (string, error)
+	Remove(rel string) error
+	RemoveAll(rel string) error
+	// Rename renames an entry, replacing an existing file at the new name
+	Rename(from, to string) error
+	Chmod(rel string, mode os.FileMode) error
+	Chtimes(rel string, atime, mtime time.Time) error
+	// Lchown changes the numeric owner and group of an entry
+	Lchown(rel string, uid, gid int) error
+	// Owner extracts the numeric owner and group from information returned
+	// by Lstat or Walk, if the target reports them
+	Owner(info os.FileInfo) (uid, gid int, ok bool)
+	// String describes the target for log messages
+	String() string
+}
+
+// LocalTarget is a target directory on the local filesystem
+type LocalTarget struct {
+	root string
+}
+
+// NewLocalTarget creates a target rooted at the given local directory
+func NewLocalTarget(root string) *LocalTarget {
+	return &LocalTarget{root: root}
+}
+
+// Path returns the local filesystem path of a target entry
+func (t *LocalTarget) Path(rel string) string {
+	return filepath.Join(t.root, rel)
+}
+
+func (t *LocalTarget) Lstat(rel string) (os.FileInfo, error) {
+	return os.Lstat(t.Path(rel))
+}
+
+func (t *LocalTarget) Walk(fn func(rel string, info os.FileInfo) error) error {
+	if _, err := os.Lstat(t.root); os.IsNotExist(err) {
+		return nil
+	}
+	return filepath.Walk(t.root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(t.root, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		return fn(rel, info)
+	})
+}
+
+func (t *LocalTarget) MkdirAll(rel string, perm os.FileMode) error {
+	return os.MkdirAll(t.Path(rel), perm)
+}
+
+func (t *LocalTarget) WriteFile(rel string, r io.Reader, perm os.FileMode) error {
+	if perm == 0 {
+		perm = 0666
+	}
+	file, err := utils.CreateAtomic(t.Path(rel), perm)
+	if err != nil {
+		return err
+	}
+	defer file.Abort()
+
+	if _, err := io.Copy(file, r); err != nil {
+		return err
+	}
+	return file.Commit()
+}
+
+func (t *LocalTarget) Append(rel string, offset int64) (io.WriteCloser, error) {
+	file, err := os.OpenFile(t.Path(rel), os.O_WRONLY|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	if err := file.Truncate(offset); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+func (t *LocalTarget) Open(rel string) (io.ReadCloser, error) {
+	return os.Open(t.Path(rel))
+}
+
+func (t *LocalTarget) Symlink(link, rel string) error {
+	return os.Symlink(link, t.Path(rel))
+}
+
+func (t *LocalTarget) Readlink(rel string) (string, error) {
+	return os.Readlink(t.Path(rel))
+}
+
+func (t *LocalTarget) Remove(rel string) error {
+	return os.Remove(t.Path(rel))
+}
+
+func (t *LocalTarget) RemoveAll(rel string) error {
+	return os.RemoveAll(t.Path(rel))
+}
+
+func (t *LocalTarget) Rename(from, to string) error {
+	return os.Rename(t.Path(from), t.Path(to))
+}
+
+func (t *LocalTarget) Chmod(rel string, mode os.FileMode) error {
+	return os.Chmod(t.Path(rel), mode)
+}
+
+func (t *LocalTarget) Chtimes(rel string, atime, mtime time.Time) error {
+	return os.Chtimes(t.Path(rel), atime, mtime)
+}
+
+func (t *LocalTarget) Lchown(rel string, uid, gid int) error {
+	return os.Lchown(t.Path(rel), uid, gid)
+}
+
+func (t *LocalTarget) Owner(info os.FileInfo) (uid, gid int, ok bool) {
+	return platform.FileOwner(info)
+}
+
+func (t *LocalTarget) Xattrs(rel string) (map[string][]byte, error) {
+	return platform.Xattrs(t.Path(rel))
+}
+
+func (t *LocalTarget) SetXattrs(rel string, attrs map[string][]byte) error {
+	return platform.SetXattrs(t.Path(rel), attrs)
+}
+
+func (t *LocalTarget) String() string {
+	return t.root
+}
@@ -0,0 +1,76 @@
+package sync
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// workerPool runs jobs on a fixed number of goroutines and collects the
+// errors of all failed jobs
+type workerPool struct {
+	jobs chan func() error
+	wg   sync.WaitGroup
+
+	mu   sync.Mutex
+	errs []error
+}
+
+// newWorkerPool starts a pool with the given number of workers
+func newWorkerPool(workers int) *workerPool {
+	if workers < 1 {
+		workers = 1
+	}
+	p := &workerPool{jobs: make(chan func() error)}
+	for i := 0; i < workers; i++ {
+		go func() {
+			for job := range p.jobs {
+				if err := job(); err != nil {
+					p.fail(err)
+				}
+				p.wg.Done()
+			}
+		}()
+	}
+	return p
+}
+
+// submit queues a job, blocking until a worker is free
+func (p *workerPool) submit(job func() error) {
+	p.wg.Add(1)
+	p.jobs <- job
+}
+
+// fail records an error without stopping the other jobs
+func (p *workerPool) fail(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.errs = append(p.errs, err)
+}
+
+// wait blocks until all submitted jobs finished and returns the combined
+// errors so far
+func (p *workerPool) wait() error {
+	p.wg.Wait()
+	return p.err()
+}
+
+// err combines the recorded errors into one
+func (p *workerPool) err() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch len(p.errs) {
+	case 0:
+		return nil
+	case 1:
+		return p.errs[0]
+	default:
+		return fmt.Errorf("%d operations failed:\n%w", len(p.errs), errors.Join(p.errs...))
+	}
+}
+
+// close waits for the submitted jobs and stops the workers
+func (p *workerPool) close() {
+	p.wg.Wait()
+	close(p.jobs)
+}
@@ -0,0 +1,233 @@
+package watcher
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Op describes what happened to a path. Events of a batch are coalesced,
+// so an Op holds the net effect of everything that happened to the path
+// during the debounce window.
+type Op uint32
+
+const (
+	// OpCreate is set for paths that did not exist before the window
+	OpCreate Op = 1 << iota
+	// OpWrite is set for paths whose contents changed, including paths that
+	// were replaced by a new entry
+	OpWrite
+	// OpRemove is set for paths that no longer exist
+	OpRemove
+	// OpChmod is set for paths whose attributes changed
+	OpChmod
+	// OpMove is set for entries renamed within the watched tree; the event
+	// has a Move with the old path
+	OpMove
+)
+
+var opNames = []struct {
+	op   Op
+	name string
+}{
+	{OpCreate, "CREATE"},
+	{OpWrite, "WRITE"},
+	{OpRemove, "REMOVE"},
+	{OpChmod, "CHMOD"},
+	{OpMove, "MOVE"},
+}
+
+// Has reports whether all of the given operations are set
+func (o Op) Has(op Op) bool {
+	return o&op == op
+}
+
+// String returns the operations separated by "|"
+func (o Op) String() string {
+	var names []string
+	for _, n := range opNames {
+		if o.Has(n.op) {
+			names = append(names, n.name)
+		}
+	}
+	return strings.Join(names, "|")
+}
+
+// Batch is the set of changes of one debounce window, one event per path,
+// ordered by path so directories come before their contents
+type Batch struct {
+	Events []FileEvent
+	// Start and End span the raw events the batch was built from
+	Start time.Time
+	End   time.Time
+	// Resync is set when changes were lost, because the kernel queue or
+	// the watcher's buffers overflowed. The batch has no events; the whole
+	// tree has to be scanned again.
+	Resync bool
+	// Removed lists, for a Resync batch, the paths the dropped changes
+	// removed or moved away. A rescan cannot tell them from entries that
+	// never were in the source. Removals the kernel dropped are unknown.
+	Removed []string
+}
+
+// resyncBatch returns a batch asking for a full rescan in place of the
+// dropped batches between start and end
+func resyncBatch(start, end time.Time, dropped []Batch) Batch {
+	removed := make(map[string]bool)
+	for _, batch := range dropped {
+		for _, path := range batch.Removed {
+			removed[path] = true
+		}
+		for _, event := range batch.Events {
+			if event.Op.Has(OpRemove) {
+				removed[event.Path] = true
+			} else if event.Op.Has(OpMove) {
+				removed[event.Move.From] = true
+			}
+		}
+	}
+
+	resync := Batch{Start: start, End: end, Resync: true}
+	for path := range removed {
+		resync.Removed = append(resync.Removed, path)
+	}
+	sort.Strings(resync.Removed)
+	return resync
+}
+
+// change accumulates the raw events of a path during a debounce window
+type change struct {
+	// existed is whether the path existed before the window and exists
+	// whether it exists now
+	existed bool
+	exists  bool
+	// replaced is set when the entry at the path was removed and another
+	// one created
+	replaced bool
+	chmod    bool
+	written  bool
+	move     *Move
+	time     time.Time
+}
+
+// changeSet coalesces the raw events of a debounce window per path
+type changeSet struct {
+	changes map[string]*change
+	start   time.Time
+}
+
+func newChangeSet() *changeSet {
+	return &changeSet{changes: make(map[string]*change)}
+}
+
+func (c *changeSet) empty() bool {
+	return len(c.changes) == 0
+}
+
+// get returns the change of a path, starting one if there is none. The
+// first event tells whether the path existed before.
+func (c *changeSet) get(path string, op fsnotify.Op, now time.Time) *change {
+	if c.start.IsZero() {
+		c.start = now
+	}
+	ch, ok := c.changes[path]
+	if !ok {
+		existed := op&fsnotify.Create == 0
+		ch = &change{existed: existed, exists: existed}
+		c.changes[path] = ch
+	}
+	ch.time = now
+	return ch
+}
+
+// add records a raw event
+func (c *changeSet) add(path string, op fsnotify.Op, now time.Time) {
+	ch := c.get(path, op, now)
+	switch {
+	case op&fsnotify.Create != 0:
+		if !ch.exists && ch.existed {
+			ch.replaced = true
+		}
+		ch.exists = true
+	case op&(fsnotify.Remove|fsnotify.Rename) != 0:
+		ch.exists = false
+		ch.move = nil
+	case op&fsnotify.Write != 0:
+		ch.written = true
+	case op&fsnotify.Chmod != 0:
+		ch.chmod = true
+	}
+}
+
+// moveOf returns the move that brought an entry to a path, if any
+func (c *changeSet) moveOf(path string) *Move {
+	if ch, ok := c.changes[path]; ok {
+		return ch.move
+	}
+	return nil
+}
+
+// addMove records an entry that was renamed within the tree. The renamed
+// path reports no change of its own any more.
+func (c *changeSet) addMove(move *Move, now time.Time) {
+	from := c.changes[move.From]
+	delete(c.changes, move.From)
+
+	if from != nil && !from.existed {
+		// Created during the window, so it is new at its final path
+		c.add(move.To, fsnotify.Create, now)
+		return
+	}
+	if move.From == move.To {
+		// Moved back where it came from
+		c.add(move.To, fsnotify.Write, now)
+		return
+	}
+	ch := c.get(move.To, fsnotify.Create, now)
+	ch.exists = true
+	ch.move = move
+	if from != nil && from.written {
+		ch.written = true
+	}
+}
+
+// batch returns the net effect of the window as a batch
+func (c *changeSet) batch(end time.Time) Batch {
+	batch := Batch{Start: c.start, End: end}
+	for path, ch := range c.changes {
+		op := ch.op()
+		if op == 0 {
+			continue
+		}
+		batch.Events = append(batch.Events, FileEvent{Path: path, Op: op, Time: ch.time, Move: ch.move})
+	}
+	sort.Slice(batch.Events, func(i, j int) bool { return batch.Events[i].Path < batch.Events[j].Path })
+	return batch
+}
+
+// op computes the net effect of a change
+func (ch *change) op() Op {
+	var op Op
+	switch {
+	case ch.move != nil:
+		op = OpMove
+		if ch.written {
+			op |= OpWrite
+		}
+	case !ch.existed && !ch.exists:
+		// Created and removed again
+		return 0
+	case !ch.existed:
+		op = OpCreate
+	case !ch.exists:
+		op = OpRemove
+	case ch.replaced || ch.written:
+		op = OpWrite
+	}
+	if ch.chmod && ch.exists {
+		op |= OpChmod
+	}
+	return op
+}
@@ -0,0 +1,67 @@
+package watcher
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+func TestChangeSetCoalescing(t *testing.T) {
+	tests := []struct {
+		name string
+		ops  []fsnotify.Op
+		want Op
+	}{
+		{name: "created", ops: []fsnotify.Op{fsnotify.Create}, want: OpCreate},
+		{name: "created and written", ops: []fsnotify.Op{fsnotify.Create, fsnotify.Write}, want: OpCreate},
+		{name: "created, written and removed", ops: []fsnotify.Op{fsnotify.Create, fsnotify.Write, fsnotify.Remove}},
+		{name: "created and renamed away", ops: []fsnotify.Op{fsnotify.Create, fsnotify.Rename}},
+		{name: "written", ops: []fsnotify.Op{fsnotify.Write, fsnotify.Write}, want: OpWrite},
+		{name: "written and chmodded", ops: []fsnotify.Op{fsnotify.Write, fsnotify.Chmod}, want: OpWrite | OpChmod},
+		{name: "chmodded", ops: []fsnotify.Op{fsnotify.Chmod}, want: OpChmod},
+		{name: "removed", ops: []fsnotify.Op{fsnotify.Remove}, want: OpRemove},
+		{name: "chmodded and removed", ops: []fsnotify.Op{fsnotify.Chmod, fsnotify.Remove}, want: OpRemove},
+		{name: "removed and created", ops: []fsnotify.Op{fsnotify.Remove, fsnotify.Create}, want: OpWrite},
+		{name: "renamed away and back", ops: []fsnotify.Op{fsnotify.Rename, fsnotify.Create}, want: OpWrite},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			changes := newChangeSet()
+			now := time.Now()
+			for _, op := range tt.ops {
+				changes.add("/src/file", op, now)
+			}
+			var got Op
+			if batch := changes.batch(now); len(batch.Events) > 0 {
+				got = batch.Events[0].Op
+			}
+			if got != tt.want {
+				t.Errorf("op = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResyncBatch(t *testing.T) {
+	now := time.Now()
+	dropped := []Batch{
+		resyncBatch(now, now, []Batch{{Events: []FileEvent{{Path: "/src/a", Op: OpRemove}}}}),
+		{Events: []FileEvent{
+			{Path: "/src/b", Op: OpRemove},
+			{Path: "/src/c", Op: OpWrite},
+			{Path: "/src/e", Op: OpMove, Move: &Move{From: "/src/d", To: "/src/e"}},
+		}},
+		{Events: []FileEvent{{Path: "/src/a", Op: OpRemove}}},
+	}
+
+	batch := resyncBatch(now, now, dropped)
+	if !batch.Resync || len(batch.Events) != 0 {
+		t.Errorf("resync = %v with %d events, want a resync without events", batch.Resync, len(batch.Events))
+	}
+	if want := []string{"/src/a", "/src/b", "/src/d"}; !reflect.DeepEqual(batch.Removed, want) {
+		t.Errorf("removed = %v, want %v", batch.Removed, want)
+	}
+}
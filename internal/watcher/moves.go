@@ -0,0 +1,130 @@
+package watcher
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+
+	"gosync/internal/platform"
+)
+
+// Move describes an entry renamed from one watched path to another
+type Move struct {
+	From string
+	To   string
+	// Verify is set when the move was matched by size and modification
+	// time because the platform has no inode numbers, so the contents
+	// should be compared before relying on it
+	Verify bool
+}
+
+// identity describes an entry well enough to recognize it under a new name
+type identity struct {
+	dev, ino uint64
+	hasID    bool
+	dir      bool
+	size     int64
+	modTime  time.Time
+}
+
+func identify(info os.FileInfo) identity {
+	dev, ino, ok := platform.FileID(info)
+	return identity{
+		dev:     dev,
+		ino:     ino,
+		hasID:   ok,
+		dir:     info.IsDir(),
+		size:    info.Size(),
+		modTime: info.ModTime(),
+	}
+}
+
+// same reports whether two identities describe the same entry. Without
+// inode numbers files of the same size and modification time are assumed
+// to be the same; renames keep both.
+func (a identity) same(b identity) bool {
+	if a.hasID && b.hasID {
+		return a.dev == b.dev && a.ino == b.ino
+	}
+	return !a.dir && !b.dir && a.size == b.size && a.modTime.Equal(b.modTime)
+}
+
+// pendingMove is an entry renamed away whose new name is not known yet
+type pendingMove struct {
+	id identity
+	// origin is where the entry was before the current debounce window
+	origin string
+}
+
+// remember records the identity of an entry
+func (w *Watcher) remember(path string, info os.FileInfo) {
+	w.files[path] = identify(info)
+}
+
+// forget drops an entry and, for directories, everything below it
+func (w *Watcher) forget(path string) {
+	delete(w.files, path)
+	prefix := path + string(filepath.Separator)
+	for known := range w.files {
+		if strings.HasPrefix(known, prefix) {
+			delete(w.files, known)
+		}
+	}
+}
+
+// renamed handles an entry that was renamed away. It becomes a move if the
+// same entry shows up under a new name within the debounce window, and a
+// removal otherwise.
+func (w *Watcher) renamed(path string, changes *changeSet, now time.Time) {
+	origin := path
+	if move := changes.moveOf(path); move != nil {
+		// Moved twice in a row; the destination only knows the origin
+		origin = move.From
+		delete(changes.changes, path)
+		changes.add(origin, fsnotify.Rename, now)
+	} else {
+		changes.add(path, fsnotify.Rename, now)
+	}
+
+	id, ok := w.files[path]
+	if !ok {
+		return
+	}
+	delete(w.files, path)
+	w.pending[path] = pendingMove{id: id, origin: origin}
+}
+
+// matchMove looks for a renamed entry that reappeared as a newly created
+// path. It returns the move, or nil if there is none.
+func (w *Watcher) matchMove(path string, info os.FileInfo) *Move {
+	id := identify(info)
+	for from, pending := range w.pending {
+		if !pending.id.same(id) {
+			continue
+		}
+		delete(w.pending, from)
+
+		// Entries below a moved directory keep their identities
+		oldPrefix := from + string(filepath.Separator)
+		for known, childID := range w.files {
+			if strings.HasPrefix(known, oldPrefix) {
+				delete(w.files, known)
+				w.files[filepath.Join(path, strings.TrimPrefix(known, oldPrefix))] = childID
+			}
+		}
+		return &Move{From: pending.origin, To: path, Verify: !id.hasID}
+	}
+	return nil
+}
+
+// expireMoves forgets renamed entries that never reappeared. They left the
+// watched tree and are reported as removed.
+func (w *Watcher) expireMoves() {
+	for from := range w.pending {
+		w.forget(from)
+	}
+	w.pending = make(map[string]pendingMove)
+}
@@ -0,0 +1,100 @@
+package watcher
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+func TestMovePairing(t *testing.T) {
+	tests := []struct {
+		name string
+		dir  bool
+		// outside moves the entry out of the watched tree
+		outside bool
+		want    []FileEvent
+	}{
+		{
+			name: "file",
+			want: []FileEvent{{Path: "new", Op: OpMove, Move: &Move{From: "old", To: "new"}}},
+		},
+		{
+			name: "directory",
+			dir:  true,
+			want: []FileEvent{{Path: "new", Op: OpMove, Move: &Move{From: "old", To: "new"}}},
+		},
+		{
+			name:    "moved out of the tree",
+			outside: true,
+			want:    []FileEvent{{Path: "old", Op: OpRemove}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			w := testWatcher(t, root, Options{})
+			old, renamed := filepath.Join(root, "old"), filepath.Join(root, "new")
+			if tt.dir {
+				if err := os.MkdirAll(filepath.Join(old, "sub"), 0755); err != nil {
+					t.Fatal(err)
+				}
+			} else if err := os.WriteFile(old, []byte("contents"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := w.addTree(root, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.outside {
+				renamed = filepath.Join(t.TempDir(), "new")
+			}
+			if err := os.Rename(old, renamed); err != nil {
+				t.Fatal(err)
+			}
+			changes := newChangeSet()
+			now := time.Now()
+			w.handle(fsnotify.Event{Name: old, Op: fsnotify.Rename}, changes, now)
+			if !tt.outside {
+				w.handle(fsnotify.Event{Name: renamed, Op: fsnotify.Create}, changes, now)
+			}
+			w.expireMoves()
+
+			got := changes.batch(now).Events
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d events, want %d", len(got), len(tt.want))
+			}
+			for i, want := range tt.want {
+				event := got[i]
+				if rel(root, event.Path) != want.Path || event.Op != want.Op {
+					t.Errorf("event %d = %s %v, want %s %v", i, rel(root, event.Path), event.Op, want.Path, want.Op)
+				}
+				if want.Move != nil && (event.Move == nil || rel(root, event.Move.From) != want.Move.From || rel(root, event.Move.To) != want.Move.To) {
+					t.Errorf("event %d moved %+v, want %+v", i, event.Move, want.Move)
+				}
+			}
+
+			if tt.dir {
+				// Entries below the directory are known under the new name
+				if _, ok := w.files[filepath.Join(renamed, "sub")]; !ok {
+					t.Errorf("%s not known after the move", filepath.Join(renamed, "sub"))
+				}
+				if !w.dirs[filepath.Join(renamed, "sub")] || w.dirs[filepath.Join(old, "sub")] {
+					t.Errorf("watched directories after the move: %v", w.dirs)
+				}
+			}
+		})
+	}
+}
+
+// rel returns a path relative to root for comparing events
+func rel(root, path string) string {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return path
+	}
+	return rel
+}
@@ -0,0 +1,170 @@
+package watcher
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// DefaultPollInterval is how often the polling backend scans by default
+const DefaultPollInterval = time.Second
+
+// backend delivers raw events for the directories added to it
+type backend interface {
+	Add(path string) error
+	Remove(path string) error
+	Close() error
+}
+
+// poller is a backend for file systems without change notifications, such
+// as NFS, SMB and FUSE mounts. It scans the watched directories at a fixed
+// interval and compares them with the previous scan.
+type poller struct {
+	interval time.Duration
+	events   chan fsnotify.Event
+	errors   chan error
+	done     chan struct{}
+
+	mu sync.Mutex
+	// dirs holds the entries of every watched directory as of the last scan
+	dirs map[string]map[string]os.FileInfo
+}
+
+func newPoller(interval time.Duration) *poller {
+	if interval <= 0 {
+		interval = DefaultPollInterval
+	}
+	p := &poller{
+		interval: interval,
+		events:   make(chan fsnotify.Event),
+		errors:   make(chan error),
+		done:     make(chan struct{}),
+		dirs:     make(map[string]map[string]os.FileInfo),
+	}
+	go p.run()
+	return p
+}
+
+// Add starts polling a directory, taking its current entries as the
+// baseline
+func (p *poller) Add(path string) error {
+	entries, err := snapshot(path)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	p.dirs[path] = entries
+	p.mu.Unlock()
+	return nil
+}
+
+// Remove stops polling a directory
+func (p *poller) Remove(path string) error {
+	p.mu.Lock()
+	delete(p.dirs, path)
+	p.mu.Unlock()
+	return nil
+}
+
+func (p *poller) Close() error {
+	close(p.done)
+	return nil
+}
+
+func (p *poller) run() {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			for _, event := range p.scan() {
+				select {
+				case p.events <- event:
+				case <-p.done:
+					return
+				}
+			}
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// scan compares every watched directory with its last snapshot. Vanished
+// entries are reported as renamed, so they can be matched with entries that
+// appeared elsewhere, and come before all others.
+func (p *poller) scan() []fsnotify.Event {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var gone, changed []fsnotify.Event
+	for dir, old := range p.dirs {
+		current, err := snapshot(dir)
+		if os.IsNotExist(err) {
+			// Reported by the scan of its parent
+			delete(p.dirs, dir)
+			continue
+		}
+		if err != nil {
+			go p.report(err)
+			continue
+		}
+		p.dirs[dir] = current
+
+		for name, info := range current {
+			path := filepath.Join(dir, name)
+			before, ok := old[name]
+			switch {
+			case !ok:
+				changed = append(changed, fsnotify.Event{Name: path, Op: fsnotify.Create})
+			case before.IsDir() != info.IsDir():
+				gone = append(gone, fsnotify.Event{Name: path, Op: fsnotify.Rename})
+				changed = append(changed, fsnotify.Event{Name: path, Op: fsnotify.Create})
+			case !info.IsDir() && (before.Size() != info.Size() || !before.ModTime().Equal(info.ModTime())):
+				changed = append(changed, fsnotify.Event{Name: path, Op: fsnotify.Write})
+			case before.Mode() != info.Mode():
+				changed = append(changed, fsnotify.Event{Name: path, Op: fsnotify.Chmod})
+			}
+		}
+		for name := range old {
+			if _, ok := current[name]; !ok {
+				gone = append(gone, fsnotify.Event{Name: filepath.Join(dir, name), Op: fsnotify.Rename})
+			}
+		}
+	}
+
+	// Parents before their contents, like a real watcher would report them
+	sort.Slice(changed, func(i, j int) bool { return changed[i].Name < changed[j].Name })
+	return append(gone, changed...)
+}
+
+// report delivers a scan error unless the poller was closed
+func (p *poller) report(err error) {
+	select {
+	case p.errors <- err:
+	case <-p.done:
+	}
+}
+
+// snapshot reads the entries of a directory without following symlinks
+func snapshot(dir string) (map[string]os.FileInfo, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	infos := make(map[string]os.FileInfo, len(entries))
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			// Removed since reading the directory
+			continue
+		}
+		infos[entry.Name()] = info
+	}
+	return infos, nil
+}
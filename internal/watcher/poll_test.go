@@ -0,0 +1,116 @@
+package watcher
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+func TestFallbackToPolling(t *testing.T) {
+	root := t.TempDir()
+	w := testWatcher(t, root, Options{Mode: ModeAuto, PollInterval: time.Hour})
+	w.backend = stubBackend{err: fmt.Errorf("add watch: %w", syscall.ENOSPC)}
+
+	if err := w.addWatch(root); err != nil {
+		t.Fatal(err)
+	}
+	defer w.backend.Close()
+	if !w.Polling() {
+		t.Error("still using notifications after running out of watches")
+	}
+	if p, ok := w.backend.(*poller); !ok || p.dirs[root] == nil {
+		t.Errorf("%s not polled", root)
+	}
+}
+
+func TestPollScan(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(dir string) error
+		want   []fsnotify.Event
+	}{
+		{
+			name:   "unchanged",
+			change: func(dir string) error { return nil },
+		},
+		{
+			name: "created",
+			change: func(dir string) error {
+				return os.WriteFile(filepath.Join(dir, "new"), nil, 0644)
+			},
+			want: []fsnotify.Event{{Name: "new", Op: fsnotify.Create}},
+		},
+		{
+			name: "written",
+			change: func(dir string) error {
+				return os.WriteFile(filepath.Join(dir, "file"), []byte("longer"), 0644)
+			},
+			want: []fsnotify.Event{{Name: "file", Op: fsnotify.Write}},
+		},
+		{
+			name: "chmodded",
+			change: func(dir string) error {
+				return os.Chmod(filepath.Join(dir, "file"), 0600)
+			},
+			want: []fsnotify.Event{{Name: "file", Op: fsnotify.Chmod}},
+		},
+		{
+			name: "removed",
+			change: func(dir string) error {
+				return os.Remove(filepath.Join(dir, "file"))
+			},
+			want: []fsnotify.Event{{Name: "file", Op: fsnotify.Rename}},
+		},
+		{
+			name: "replaced by a directory",
+			change: func(dir string) error {
+				if err := os.Remove(filepath.Join(dir, "file")); err != nil {
+					return err
+				}
+				return os.Mkdir(filepath.Join(dir, "file"), 0755)
+			},
+			want: []fsnotify.Event{{Name: "file", Op: fsnotify.Rename}, {Name: "file", Op: fsnotify.Create}},
+		},
+		{
+			name: "renamed",
+			change: func(dir string) error {
+				return os.Rename(filepath.Join(dir, "file"), filepath.Join(dir, "moved"))
+			},
+			want: []fsnotify.Event{{Name: "file", Op: fsnotify.Rename}, {Name: "moved", Op: fsnotify.Create}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(dir, "file"), []byte("data"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			p := newPoller(time.Hour)
+			defer p.Close()
+			if err := p.Add(dir); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := tt.change(dir); err != nil {
+				t.Fatal(err)
+			}
+			var got []fsnotify.Event
+			for _, event := range p.scan() {
+				got = append(got, fsnotify.Event{Name: rel(dir, event.Name), Op: event.Op})
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("events = %v, want %v", got, tt.want)
+			}
+			if got := p.scan(); len(got) != 0 {
+				t.Errorf("events of a second scan: %v", got)
+			}
+		})
+	}
+}
@@ -1,97 +1,436 @@
 package watcher
 
 import (
+	"errors"
 	"fmt"
 	"path/filepath"
+	"strings"
+	"syscall"
 	"time"
 
 	"os"
 
 	"github.com/fsnotify/fsnotify"
+
+	"gosync/pkg/utils"
 )
 
+// FileEvent is the net change of a path during a debounce window
 type FileEvent struct {
-	Path      string
-	Operation string
-	Time      time.Time
+	Path string
+	Op   Op
+	// Time is when the last raw event for the path arrived
+	Time time.Time
+	// Move is set for OpMove events, whose Path is the new name
+	Move *Move
+}
+
+// Mode selects how a Watcher detects changes
+type Mode string
+
+const (
+	// ModeInotify relies on change notifications of the operating system
+	// (inotify, kqueue or ReadDirectoryChangesW)
+	ModeInotify Mode = "inotify"
+	// ModePoll scans the watched directories periodically, which works on
+	// any file system
+	ModePoll Mode = "poll"
+	// ModeAuto uses notifications and falls back to polling when they are
+	// unavailable or the system runs out of watches
+	ModeAuto Mode = "auto"
+)
+
+// ParseMode parses a watch mode name as used in the configuration
+func ParseMode(name string) (Mode, error) {
+	switch Mode(name) {
+	case "", ModeAuto:
+		return ModeAuto, nil
+	case ModeInotify, ModePoll:
+		return Mode(name), nil
+	default:
+		return "", fmt.Errorf("unknown watch mode %q (want inotify, poll or auto)", name)
+	}
+}
+
+// Options configures a Watcher
+type Options struct {
+	// DebounceMs is how long no more events must arrive before changes
+	// are reported
+	DebounceMs int
+	// IgnorePatterns are neither watched nor reported
+	IgnorePatterns []string
+	Mode           Mode
+	// MaxWait bounds how long changes are held back while events keep
+	// arriving (default: DefaultMaxWait)
+	MaxWait time.Duration
+	// BufferSize is the number of batches kept while the consumer is busy
+	// and MaxBatch the number of changed paths a batch holds. Beyond
+	// either, changes are dropped for a batch asking for a full rescan.
+	// (defaults: DefaultBufferSize and DefaultMaxBatch)
+	BufferSize int
+	MaxBatch   int
+	// PollInterval is the time between scans when polling
+	// (default: DefaultPollInterval)
+	PollInterval time.Duration
 }
 
+const (
+	// DefaultMaxWait is how long a batch is held back at most by default
+	DefaultMaxWait = 2 * time.Second
+	// DefaultBufferSize is the number of batches kept for a busy consumer
+	// by default
+	DefaultBufferSize = 64
+	// DefaultMaxBatch is the number of changed paths a batch holds at most
+	// by default
+	DefaultMaxBatch = 10000
+
+	// errorBuffer is the number of errors kept for a busy consumer
+	errorBuffer = 16
+)
+
 type Watcher struct {
-	watcher    *fsnotify.Watcher
-	events     chan FileEvent
+	backend    backend
+	rawEvents  <-chan fsnotify.Event
+	rawErrors  <-chan error
+	mode       Mode
+	polling    bool
+	interval   time.Duration
+	batches    chan Batch
 	errors     chan error
 	done       chan struct{}
 	debounceMs int
+	maxWait    time.Duration
+	bufferSize int
+	maxBatch   int
+	recursive  bool
+	// root is the watched path and ignorePatterns are matched against
+	// paths relative to it, like the sync engine does
+	root           string
+	ignorePatterns []string
+	// dirs holds the watched directories. After Watch it is only used by
+	// processEvents.
+	dirs map[string]bool
+	// files holds the identities of watched entries and pending the
+	// entries renamed away in the current debounce window, to tell moves
+	// from removals
+	files   map[string]identity
+	pending map[string]pendingMove
 }
 
-func NewWatcher(debounceMs int) (*Watcher, error) {
+// NewWatcher creates a watcher with the given options
+func NewWatcher(opts Options) (*Watcher, error) {
+	mode, err := ParseMode(string(opts.Mode))
+	if err != nil {
+		return nil, err
+	}
+
+	maxWait := opts.MaxWait
+	if maxWait <= 0 {
+		maxWait = DefaultMaxWait
+	}
+
+	bufferSize := opts.BufferSize
+	if bufferSize <= 0 {
+		bufferSize = DefaultBufferSize
+	}
+	maxBatch := opts.MaxBatch
+	if maxBatch <= 0 {
+		maxBatch = DefaultMaxBatch
+	}
+
+	w := &Watcher{
+		mode:           mode,
+		interval:       opts.PollInterval,
+		maxWait:        maxWait,
+		bufferSize:     bufferSize,
+		maxBatch:       maxBatch,
+		batches:        make(chan Batch),
+		errors:         make(chan error, errorBuffer),
+		done:           make(chan struct{}),
+		debounceMs:     opts.DebounceMs,
+		ignorePatterns: opts.IgnorePatterns,
+		dirs:           make(map[string]bool),
+		files:          make(map[string]identity),
+		pending:        make(map[string]pendingMove),
+	}
+
+	if mode == ModePoll {
+		w.usePolling()
+		return w, nil
+	}
 	fsWatcher, err := fsnotify.NewWatcher()
 	if err != nil {
+		if mode == ModeAuto {
+			w.usePolling()
+			return w, nil
+		}
 		return nil, fmt.Errorf("failed to create watcher: %w", err)
 	}
+	w.backend = fsWatcher
+	w.rawEvents = fsWatcher.Events
+	w.rawErrors = fsWatcher.Errors
+	return w, nil
+}
 
-	return &Watcher{
-		watcher:    fsWatcher,
-		events:     make(chan FileEvent),
-		errors:     make(chan error),
-		done:       make(chan struct{}),
-		debounceMs: debounceMs,
-	}, nil
+// Polling reports whether changes are detected by polling
+func (w *Watcher) Polling() bool {
+	return w.polling
+}
+
+// usePolling switches to the polling backend, carrying over the watched
+// directories. Events still queued in the previous backend are drained and
+// dropped, so processEvents asks for a rescan after switching.
+func (w *Watcher) usePolling() {
+	p := newPoller(w.interval)
+	for dir := range w.dirs {
+		// Directories that are gone were reported already
+		p.Add(dir)
+	}
+	if w.backend != nil {
+		w.drain()
+		w.backend.Close()
+	}
+	w.backend = p
+	w.rawEvents = p.events
+	w.rawErrors = p.errors
+	w.polling = true
+}
+
+// drain discards the events and errors queued in the current backend
+func (w *Watcher) drain() {
+	for {
+		select {
+		case <-w.rawEvents:
+		case <-w.rawErrors:
+		default:
+			return
+		}
+	}
+}
+
+// addWatch watches a single directory. In auto mode running out of
+// notification watches switches to polling.
+func (w *Watcher) addWatch(dir string) error {
+	err := w.backend.Add(dir)
+	if err != nil && w.mode == ModeAuto && !w.polling && errors.Is(err, syscall.ENOSPC) {
+		w.usePolling()
+		err = w.backend.Add(dir)
+	}
+	if err != nil {
+		return err
+	}
+	w.dirs[dir] = true
+	return nil
 }
 
 func (w *Watcher) Watch(path string, recursive bool) error {
+	w.root = path
+	w.recursive = recursive
 	if recursive {
-		err := filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
-			if err != nil {
-				return err
-			}
-			if info.IsDir() {
-				return w.watcher.Add(path)
-			}
-			return nil
-		})
-		if err != nil {
+		if err := w.addTree(path, nil); err != nil {
 			return fmt.Errorf("failed to walk directory: %w", err)
 		}
 	} else {
-		if err := w.watcher.Add(path); err != nil {
+		if err := w.addWatch(path); err != nil {
 			return fmt.Errorf("failed to watch path: %w", err)
 		}
+		if err := w.rememberDir(path); err != nil {
+			return fmt.Errorf("failed to read directory: %w", err)
+		}
 	}
 
 	go w.processEvents()
 	return nil
 }
 
+// addTree watches root and every directory below it. Directories are
+// watched before their entries are read, so nothing created in between is
+// missed. found is called for each entry inside root, so events missed
+// before the watches were in place can be made up for.
+func (w *Watcher) addTree(root string, found func(path string)) error {
+	info, err := os.Lstat(root)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return w.addWatch(root)
+	}
+	return w.addDir(root, found)
+}
+
+func (w *Watcher) addDir(dir string, found func(path string)) error {
+	if err := w.addWatch(dir); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		if w.isIgnored(path) {
+			continue
+		}
+		info, err := entry.Info()
+		if os.IsNotExist(err) {
+			// Entries may disappear while a new tree is still being filled
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		w.remember(path, info)
+		if found != nil {
+			found(path)
+		}
+		if info.IsDir() {
+			if err := w.addDir(path, found); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// rememberDir records the identities of the entries of a single directory
+func (w *Watcher) rememberDir(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		if w.isIgnored(path) {
+			continue
+		}
+		if info, err := entry.Info(); err == nil {
+			w.remember(path, info)
+		}
+	}
+	return nil
+}
+
+// isIgnored checks a path against the ignore patterns. Temporary and
+// partial files written by syncs are ignored as well.
+func (w *Watcher) isIgnored(path string) bool {
+	rel, err := filepath.Rel(w.root, path)
+	if err != nil || rel == "." {
+		return false
+	}
+	return utils.IsTempFile(rel) || utils.IsPartialFile(rel) || utils.IsPathExcluded(rel, w.ignorePatterns)
+}
+
+// removeTree drops the watches of a removed or renamed directory and of
+// every directory below it
+func (w *Watcher) removeTree(root string) {
+	prefix := root + string(filepath.Separator)
+	for dir := range w.dirs {
+		if dir == root || strings.HasPrefix(dir, prefix) {
+			// The kernel already dropped watches of deleted directories
+			w.backend.Remove(dir)
+			delete(w.dirs, dir)
+		}
+	}
+}
+
 func (w *Watcher) processEvents() {
-	eventMap := make(map[string]FileEvent)
-	timer := time.NewTimer(time.Duration(w.debounceMs) * time.Millisecond)
+	changes := newChangeSet()
+	debounce := time.Duration(w.debounceMs) * time.Millisecond
+	timer := time.NewTimer(debounce)
 	timer.Stop()
 
+	// Batches wait here while the consumer is busy, so raw events keep
+	// being drained
+	var queue []Batch
+	enqueue := func(batch Batch) {
+		if len(queue) >= w.bufferSize {
+			queue = []Batch{resyncBatch(queue[0].Start, time.Now(), append(queue, batch))}
+			return
+		}
+		queue = append(queue, batch)
+	}
+	// overflow drops every change not delivered yet and asks for a rescan
+	overflow := func() {
+		w.expireMoves()
+		now := time.Now()
+		start := changes.start
+		if len(queue) > 0 {
+			start = queue[0].Start
+		}
+		if start.IsZero() {
+			start = now
+		}
+		queue = []Batch{resyncBatch(start, now, append(queue, changes.batch(now)))}
+		changes = newChangeSet()
+		timer.Stop()
+	}
+
 	for {
+		var out chan<- Batch
+		var next Batch
+		if len(queue) > 0 {
+			out = w.batches
+			next = queue[0]
+		}
+
 		select {
-		case event, ok := <-w.watcher.Events:
+		case out <- next:
+			queue = queue[1:]
+
+		case event, ok := <-w.rawEvents:
 			if !ok {
 				return
 			}
-			eventMap[event.Name] = FileEvent{
-				Path:      event.Name,
-				Operation: event.Op.String(),
-				Time:      time.Now(),
+			// Watched directories moved elsewhere report events without
+			// a name
+			if event.Name == "" || w.isIgnored(event.Name) {
+				continue
+			}
+			now := time.Now()
+			polling := w.polling
+			w.handle(event, changes, now)
+			// Switching to polling drops the events the previous backend
+			// had queued, and the poller only notices later changes
+			if w.polling != polling || len(changes.changes) > w.maxBatch {
+				overflow()
+				continue
+			}
+
+			// Flush once events stop for the debounce time, but never
+			// hold changes back longer than the maximum wait
+			wait := debounce
+			if deadline := changes.start.Add(w.maxWait); now.Add(wait).After(deadline) {
+				wait = deadline.Sub(now)
+			}
+			// A tick left over from the previous window would flush this
+			// one early
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
 			}
-			timer.Reset(time.Duration(w.debounceMs) * time.Millisecond)
+			timer.Reset(wait)
 
-		case err, ok := <-w.watcher.Errors:
+		case err, ok := <-w.rawErrors:
 			if !ok {
 				return
 			}
-			w.errors <- err
+			if errors.Is(err, fsnotify.ErrEventOverflow) {
+				// The kernel dropped events
+				overflow()
+				continue
+			}
+			w.report(err)
 
 		case <-timer.C:
-			for _, event := range eventMap {
-				w.events <- event
+			w.expireMoves()
+			batch := changes.batch(time.Now())
+			changes = newChangeSet()
+			if len(batch.Events) > 0 {
+				enqueue(batch)
 			}
-			eventMap = make(map[string]FileEvent)
 
 		case <-w.done:
 			return
@@ -99,8 +438,83 @@ func (w *Watcher) processEvents() {
 	}
 }
 
-func (w *Watcher) Events() <-chan FileEvent {
-	return w.events
+// report passes on an error, dropping it if the consumer is not keeping up
+// with errors
+func (w *Watcher) report(err error) {
+	select {
+	case w.errors <- err:
+	default:
+	}
+}
+
+// handle records a raw event and keeps the watches and identities of
+// entries up to date
+func (w *Watcher) handle(event fsnotify.Event, changes *changeSet, now time.Time) {
+	switch {
+	case event.Op&fsnotify.Create != 0:
+		info, err := os.Lstat(event.Name)
+		if err != nil {
+			// Already gone again; its removal follows
+			changes.add(event.Name, event.Op, now)
+			return
+		}
+		w.remember(event.Name, info)
+
+		move := w.matchMove(event.Name, info)
+		if move != nil {
+			changes.addMove(move, now)
+		} else {
+			changes.add(event.Name, event.Op, now)
+		}
+
+		if info.IsDir() && w.recursive {
+			// Files created before the watch was added have no events of
+			// their own. A moved directory is synced as a whole.
+			var found func(string)
+			if move == nil {
+				found = func(path string) {
+					changes.add(path, fsnotify.Create, now)
+				}
+			}
+			polling := w.polling
+			if err := w.addTree(event.Name, found); err != nil && !os.IsNotExist(err) {
+				w.report(fmt.Errorf("failed to watch %s: %w", event.Name, err))
+			}
+			if w.polling != polling {
+				w.report(fmt.Errorf("out of watches at %s, falling back to polling", event.Name))
+			}
+		}
+
+	case event.Op&fsnotify.Rename != 0:
+		if w.dirs[event.Name] {
+			w.removeTree(event.Name)
+		}
+		w.renamed(event.Name, changes, now)
+
+	case event.Op&fsnotify.Remove != 0:
+		if w.dirs[event.Name] {
+			w.removeTree(event.Name)
+		}
+		w.forget(event.Name)
+		if move := changes.moveOf(event.Name); move != nil {
+			// The moved entry is gone, so is its origin
+			delete(changes.changes, event.Name)
+			changes.add(move.From, fsnotify.Remove, now)
+		} else {
+			changes.add(event.Name, event.Op, now)
+		}
+
+	default:
+		if info, err := os.Lstat(event.Name); err == nil {
+			w.remember(event.Name, info)
+		}
+		changes.add(event.Name, event.Op, now)
+	}
+}
+
+// Batches delivers the changes of each debounce window
+func (w *Watcher) Batches() <-chan Batch {
+	return w.batches
 }
 
 func (w *Watcher) Errors() <-chan error {
@@ -109,5 +523,5 @@ func (w *Watcher) Errors() <-chan error {
 
 func (w *Watcher) Close() error {
 	close(w.done)
-	return w.watcher.Close()
+	return w.backend.Close()
 }
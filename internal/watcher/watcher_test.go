@@ -0,0 +1,148 @@
+package watcher
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// stubBackend accepts every directory, or fails with err
+type stubBackend struct {
+	err error
+}
+
+func (b stubBackend) Add(path string) error    { return b.err }
+func (b stubBackend) Remove(path string) error { return nil }
+func (b stubBackend) Close() error             { return nil }
+
+// testWatcher creates a recursive watcher of root on a stub backend
+func testWatcher(t *testing.T, root string, opts Options) *Watcher {
+	t.Helper()
+	w, err := NewWatcher(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.backend.Close()
+	w.backend = stubBackend{}
+	w.rawEvents, w.rawErrors = nil, nil
+	w.root = root
+	w.recursive = true
+	return w
+}
+
+// feed starts processing raw events sent to the returned channels
+func feed(t *testing.T, w *Watcher) (chan<- fsnotify.Event, chan<- error) {
+	t.Helper()
+	events, errs := make(chan fsnotify.Event), make(chan error)
+	w.rawEvents, w.rawErrors = events, errs
+	go w.processEvents()
+	t.Cleanup(func() { w.Close() })
+	return events, errs
+}
+
+func TestMaxWait(t *testing.T) {
+	root := t.TempDir()
+	w := testWatcher(t, root, Options{DebounceMs: 50, MaxWait: 200 * time.Millisecond})
+	events, _ := feed(t, w)
+
+	// Events keep arriving well within the debounce time
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		ticker := time.NewTicker(10 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				select {
+				case events <- fsnotify.Event{Name: filepath.Join(root, "file"), Op: fsnotify.Write}:
+				case <-stop:
+					return
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	start := time.Now()
+	select {
+	case batch := <-w.Batches():
+		if len(batch.Events) != 1 || batch.Events[0].Op != OpWrite {
+			t.Errorf("batch = %+v, want a single write", batch.Events)
+		}
+		if waited := time.Since(start); waited > time.Second {
+			t.Errorf("batch held back for %v", waited)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no batch while events kept arriving")
+	}
+}
+
+func TestOverflow(t *testing.T) {
+	tests := []struct {
+		name string
+		// overflow makes the watcher drop changes after the removals
+		overflow func(events chan<- fsnotify.Event, errs chan<- error, root string)
+	}{
+		{
+			name: "queue full",
+			overflow: func(events chan<- fsnotify.Event, errs chan<- error, root string) {
+				for i := 0; i < 3; i++ {
+					events <- fsnotify.Event{Name: filepath.Join(root, fmt.Sprint("more", i)), Op: fsnotify.Write}
+					time.Sleep(30 * time.Millisecond)
+				}
+			},
+		},
+		{
+			name: "kernel queue overflow",
+			overflow: func(events chan<- fsnotify.Event, errs chan<- error, root string) {
+				errs <- fsnotify.ErrEventOverflow
+			},
+		},
+		{
+			name: "batch too large",
+			overflow: func(events chan<- fsnotify.Event, errs chan<- error, root string) {
+				for i := 0; i < 5; i++ {
+					events <- fsnotify.Event{Name: filepath.Join(root, fmt.Sprint("more", i)), Op: fsnotify.Write}
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			w := testWatcher(t, root, Options{DebounceMs: 5, BufferSize: 2, MaxBatch: 4})
+			events, errs := feed(t, w)
+
+			// Nobody reads batches, so they pile up
+			var want []string
+			for i := 0; i < 2; i++ {
+				path := filepath.Join(root, fmt.Sprint("removed", i))
+				want = append(want, path)
+				events <- fsnotify.Event{Name: path, Op: fsnotify.Remove}
+				time.Sleep(30 * time.Millisecond)
+			}
+			tt.overflow(events, errs, root)
+			time.Sleep(30 * time.Millisecond)
+
+			batch := <-w.Batches()
+			if !batch.Resync {
+				t.Fatalf("got %d events instead of a resync", len(batch.Events))
+			}
+			if !reflect.DeepEqual(batch.Removed, want) {
+				t.Errorf("removed = %v, want %v", batch.Removed, want)
+			}
+			select {
+			case batch := <-w.Batches():
+				t.Errorf("another batch after the resync: %+v", batch)
+			case <-time.After(50 * time.Millisecond):
+			}
+		})
+	}
+}
@@ -26,8 +26,13 @@ func (c *Calculator) CalculateFileChecksum(filepath string) ([]byte, error) {
 	}
 	defer file.Close()
 
+	return c.CalculateChecksum(file)
+}
+
+// CalculateChecksum computes the SHA-256 checksum of everything read from r
+func (c *Calculator) CalculateChecksum(r io.Reader) ([]byte, error) {
 	hash := sha256.New()
-	if _, err := io.Copy(hash, file); err != nil {
+	if _, err := io.Copy(hash, r); err != nil {
 		return nil, err
 	}
 
@@ -42,21 +47,27 @@ func (c *Calculator) CalculateBlockChecksum(filepath string) (map[int64][]byte,
 	}
 	defer file.Close()
 
+	return c.CalculateStreamBlockChecksum(file)
+}
+
+// CalculateStreamBlockChecksum computes checksums for each block read from
+// r. Only the last block may be shorter than the block size.
+func (c *Calculator) CalculateStreamBlockChecksum(r io.Reader) (map[int64][]byte, error) {
 	checksums := make(map[int64][]byte)
 	buffer := make([]byte, c.blockSize)
-	
+
 	for blockNum := int64(0); ; blockNum++ {
-		n, err := file.Read(buffer)
-		if err == io.EOF {
+		n, err := io.ReadFull(r, buffer)
+		if n > 0 {
+			hash := sha256.Sum256(buffer[:n])
+			checksums[blockNum] = hash[:]
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
 			break
 		}
 		if err != nil {
 			return nil, err
 		}
-
-		hash := sha256.New()
-		hash.Write(buffer[:n])
-		checksums[blockNum] = hash.Sum(nil)
 	}
 
 	return checksums, nil
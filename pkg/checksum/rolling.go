@@ -0,0 +1,99 @@
+package checksum
+
+import (
+	"crypto/sha256"
+	"io"
+	"os"
+)
+
+// Rolling is an Adler-32 style weak checksum over a fixed-size window.
+// The window can be slid forward one byte at a time in constant time,
+// which is what makes block matching at arbitrary offsets affordable.
+type Rolling struct {
+	a, b   uint32
+	window uint32
+}
+
+// NewRolling computes the weak checksum of the given window
+func NewRolling(window []byte) *Rolling {
+	r := &Rolling{window: uint32(len(window))}
+	for i, c := range window {
+		r.a += uint32(c)
+		r.b += uint32(len(window)-i) * uint32(c)
+	}
+	return r
+}
+
+// Roll slides the window one byte forward, dropping out and appending in
+func (r *Rolling) Roll(out, in byte) {
+	// Both halves are kept modulo 2^16; uint32 wraparound preserves that.
+	r.a = r.a - uint32(out) + uint32(in)
+	r.b = r.b - r.window*uint32(out) + r.a
+}
+
+// Sum returns the current weak checksum
+func (r *Rolling) Sum() uint32 {
+	return (r.a & 0xffff) | (r.b&0xffff)<<16
+}
+
+// WeakChecksum computes the weak rolling checksum of a block
+func WeakChecksum(data []byte) uint32 {
+	return NewRolling(data).Sum()
+}
+
+// StrongChecksum computes the strong (SHA-256) checksum of a block
+func StrongChecksum(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
+
+// BlockSignature holds the checksums of a single block of a file
+type BlockSignature struct {
+	Index  int64
+	Offset int64
+	Size   int64
+	Weak   uint32
+	Strong []byte
+}
+
+// Signature describes a file as a list of block checksums, used as the
+// basis for computing a delta against another version of the file
+type Signature struct {
+	BlockSize int64
+	Size      int64
+	Blocks    []BlockSignature
+}
+
+// CalculateSignature computes weak and strong checksums for each block in a file
+func (c *Calculator) CalculateSignature(filepath string) (*Signature, error) {
+	file, err := os.Open(filepath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	sig := &Signature{BlockSize: c.blockSize}
+	buffer := make([]byte, c.blockSize)
+
+	for index := int64(0); ; index++ {
+		n, err := io.ReadFull(file, buffer)
+		if n > 0 {
+			sig.Blocks = append(sig.Blocks, BlockSignature{
+				Index:  index,
+				Offset: sig.Size,
+				Size:   int64(n),
+				Weak:   WeakChecksum(buffer[:n]),
+				Strong: StrongChecksum(buffer[:n]),
+			})
+			sig.Size += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return sig, nil
+}
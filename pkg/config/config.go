@@ -20,16 +20,25 @@ type SyncConfig struct {
 	IgnorePatterns []string `yaml:"ignore_patterns"`
 	BlockSize      int64    `yaml:"block_size"`
 	Compression    bool     `yaml:"compression"`
+	Compare        string   `yaml:"compare,omitempty"`
+	Conflict       string   `yaml:"conflict,omitempty"`
+	Workers        int      `yaml:"workers,omitempty"`
+	Preserve       string   `yaml:"preserve,omitempty"`
 }
 
 type EncryptionConfig struct {
-	Enabled  bool   `yaml:"enabled"`
-	KeyFile  string `yaml:"key_file"`
+	Enabled      bool     `yaml:"enabled"`
+	KeyFile      string   `yaml:"key_file"`
+	EncryptNames bool     `yaml:"encrypt_names,omitempty"`
+	Recipients   []string `yaml:"recipients,omitempty"`
 }
 
 type WatchConfig struct {
-	DebounceMs int  `yaml:"debounce_ms"`
-	Recursive  bool `yaml:"recursive"`
+	DebounceMs     int    `yaml:"debounce_ms"`
+	Recursive      bool   `yaml:"recursive"`
+	MaxWaitMs      int    `yaml:"max_wait_ms,omitempty"`
+	Mode           string `yaml:"mode,omitempty"`
+	PollIntervalMs int    `yaml:"poll_interval_ms,omitempty"`
 }
 
 type RemoteConfig struct {
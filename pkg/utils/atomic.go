@@ -0,0 +1,106 @@
+package utils
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+)
+
+// tempPattern matches the hidden names files are written under before
+// they atomically replace their destination
+var tempPattern = regexp.MustCompile(`^\..+\.gosync-[0-9]+$`)
+
+// partialPattern matches interrupted transfers kept for resuming and their
+// checkpoints
+var partialPattern = regexp.MustCompile(`^\..+\.gosync-partial(\.json)?$`)
+
+// TempName returns a hidden temporary name for writing a file named base
+// in the same directory
+func TempName(base string) string {
+	return "." + base + ".gosync-" + strconv.FormatUint(uint64(rand.Uint32()), 10)
+}
+
+// IsTempFile reports whether a file name is a temporary file, possibly
+// left behind by an interrupted write
+func IsTempFile(name string) bool {
+	return tempPattern.MatchString(filepath.Base(name))
+}
+
+// PartialName returns the hidden name an interrupted transfer of a file
+// named base is kept under
+func PartialName(base string) string {
+	return "." + base + ".gosync-partial"
+}
+
+// CheckpointName returns the name of the checkpoint that records how much
+// of a partial file was written
+func CheckpointName(base string) string {
+	return PartialName(base) + ".json"
+}
+
+// IsPartialFile reports whether a file name is a partial transfer or its
+// checkpoint
+func IsPartialFile(name string) bool {
+	return partialPattern.MatchString(filepath.Base(name))
+}
+
+// AtomicFile is a temporary file that replaces its destination only once
+// it is committed, so readers never see partially written contents
+type AtomicFile struct {
+	*os.File
+	dest string
+	done bool
+}
+
+// CreateAtomic creates a hidden temporary file next to dest
+func CreateAtomic(dest string, perm os.FileMode) (*AtomicFile, error) {
+	for i := 0; ; i++ {
+		tmp := filepath.Join(filepath.Dir(dest), TempName(filepath.Base(dest)))
+		file, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_EXCL, perm)
+		if os.IsExist(err) && i < 10 {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &AtomicFile{File: file, dest: dest}, nil
+	}
+}
+
+// Commit flushes the contents to stable storage and renames the file over
+// its destination
+func (f *AtomicFile) Commit() error {
+	if f.done {
+		return fmt.Errorf("%s already committed or aborted", f.Name())
+	}
+	f.done = true
+
+	if err := f.Sync(); err != nil {
+		f.File.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.File.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), f.dest); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
+// Abort discards the temporary file, leaving the destination untouched. It
+// does nothing after Commit, so it can be deferred.
+func (f *AtomicFile) Abort() {
+	if f.done {
+		return
+	}
+	f.done = true
+	f.File.Close()
+	os.Remove(f.Name())
+}
@@ -7,20 +7,32 @@ import (
 	"strings"
 )
 
-// IsPathExcluded checks if a path matches any of the ignore patterns
+// IsPathExcluded checks if a path matches any of the ignore patterns.
+// Patterns ending in "/" match any directory component of the path; other
+// patterns match the base name or the whole slash-separated path.
 func IsPathExcluded(path string, ignorePatterns []string) bool {
+	path = filepath.ToSlash(path)
+	components := strings.Split(path, "/")
+
 	for _, pattern := range ignorePatterns {
-		matched, err := filepath.Match(pattern, filepath.Base(path))
-		if err == nil && matched {
-			return true
-		}
-		
 		// Handle directory patterns ending with "/"
 		if strings.HasSuffix(pattern, "/") {
 			dirPattern := strings.TrimSuffix(pattern, "/")
-			if strings.Contains(path, dirPattern) {
-				return true
+			for _, component := range components {
+				if matched, err := filepath.Match(dirPattern, component); err == nil && matched {
+					return true
+				}
 			}
+			continue
+		}
+
+		matched, err := filepath.Match(pattern, components[len(components)-1])
+		if err == nil && matched {
+			return true
+		}
+		matched, err = filepath.Match(pattern, path)
+		if err == nil && matched {
+			return true
 		}
 	}
 	return false
@@ -45,7 +57,8 @@ func GetRelativePath(base, target string) (string, error) {
 	return filepath.Rel(base, target)
 }
 
-// CopyFile copies a file from source to destination
+// CopyFile copies a file from source to destination. The destination is
+// replaced atomically, so it never holds a partial copy.
 func CopyFile(src, dst string) error {
 	sourceFile, err := os.Open(src)
 	if err != nil {
@@ -53,17 +66,24 @@ func CopyFile(src, dst string) error {
 	}
 	defer sourceFile.Close()
 
+	info, err := sourceFile.Stat()
+	if err != nil {
+		return err
+	}
+
 	// Create destination directory if it doesn't exist
 	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
 		return err
 	}
 
-	destFile, err := os.Create(dst)
+	destFile, err := CreateAtomic(dst, info.Mode().Perm())
 	if err != nil {
 		return err
 	}
-	defer destFile.Close()
+	defer destFile.Abort()
 
-	_, err = io.Copy(destFile, sourceFile)
-	return err
+	if _, err := io.Copy(destFile, sourceFile); err != nil {
+		return err
+	}
+	return destFile.Commit()
 }